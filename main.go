@@ -22,12 +22,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"runtime"
+	"strconv"
 	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/cfunkhouser/preppi/preppi"
@@ -36,21 +41,11 @@ import (
 
 var (
 	prepConfigDefault     = "/boot/preppi/preppi.conf"
+	prepVarsDefault       = "/boot/preppi/vars.json"
 	bakeRecipeRootDefault = "/etc/preppi/recipes"
 	bakeRecipeNameDefault = "recipe.json"
 )
 
-func checkConfigExists(p string) (bool, error) {
-	_, err := os.Stat(p)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return false, nil
-		}
-		return false, err
-	}
-	return true, nil
-}
-
 type versionCmd struct{}
 
 func (*versionCmd) Name() string     { return "version" }
@@ -66,22 +61,96 @@ func (*versionCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{})
 	return subcommands.ExitSuccess
 }
 
+// configFlags are the flags shared by subcommands which read a preppi.conf.
+type configFlags struct {
+	config     string
+	vars       string
+	root       string
+	boot       string
+	sourceRoot string
+}
+
+func (c *configFlags) setFlags(f *flag.FlagSet) {
+	f.StringVar(&c.config, "config", prepConfigDefault, "override the default config file path.")
+	f.StringVar(&c.root, "root", "", "prepare the tree under this directory, eg a mounted image, instead of the running system.")
+	f.StringVar(&c.boot, "boot", "", "read the config and sources under /boot from this directory instead, eg a mounted boot partition.")
+	f.StringVar(&c.vars, "vars", prepVarsDefault, "JSON file of variables for template sources, used if it exists.")
+	f.StringVar(&c.sourceRoot, "source_root", "", "resolve relative sources against this directory instead of the config's.")
+
+	f.StringVar(&preppi.CacheDir, "cache_dir", preppi.CacheDir,
+		"directory in which fetched remote sources are cached.")
+	f.DurationVar(&preppi.FetchTimeout, "fetch_timeout", preppi.FetchTimeout,
+		"timeout for each attempt to fetch a remote source.")
+	f.IntVar(&preppi.FetchRetries, "fetch_retries", preppi.FetchRetries,
+		"number of times to retry fetching a remote source.")
+	f.StringVar(&preppi.DefaultOnFetchError, "on_fetch_error", preppi.DefaultOnFetchError,
+		"what to do when a remote source can't be fetched and its mapping doesn't say: fail or skip.")
+}
+
+// load reads the config, and gathers the variables and facts with which to
+// apply it. If the config doesn't exist, all return values are nil.
+func (c *configFlags) load() (*preppi.Mapper, *preppi.RecipeData, error) {
+	if c.config == "" {
+		return nil, nil, fmt.Errorf("No -config specified, nothing to do!")
+	}
+	if c.root != "" {
+		preppi.SetTargetRoot(c.root)
+	}
+	if c.boot != "" {
+		preppi.SetBootDir(c.boot)
+	}
+
+	if ok, err := preppi.SourceExists(c.config); !ok {
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't stat -config %q: %v", c.config, err)
+		}
+		log.Printf("specified -config %q doesn't exist, nothing to do!", c.config)
+		return nil, nil, nil
+	}
+
+	mapper, err := preppi.MapperFromConfig(c.config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error processing -config %q: %v", c.config, err)
+	}
+	if c.sourceRoot != "" {
+		mapper.SetSourceRoot(c.sourceRoot)
+	}
+
+	rd := &preppi.RecipeData{Vars: make(map[string]string)}
+	if c.vars != "" {
+		ok, err := preppi.SourceExists(c.vars)
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't stat -vars %q: %v", c.vars, err)
+		}
+		if ok {
+			if rd.Vars, err = preppi.VarsFromFile(c.vars); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if rd.Facts, err = preppi.CollectFacts(); err != nil {
+		return nil, nil, fmt.Errorf("error collecting facts: %v", err)
+	}
+	return mapper, rd, nil
+}
+
 type prepCmd struct {
+	configFlags
+
 	reboot bool
 	dryRun bool
-	config string
 }
 
 func (*prepCmd) Name() string     { return "prepare" }
 func (*prepCmd) Synopsis() string { return "prepare the system" }
 func (*prepCmd) Usage() string {
-	return "Usage:\tpreppi prepare [-config <path>] [-dry_run] [-reboot]\n"
+	return "Usage:\tpreppi prepare [-config <path>] [-vars <path>] [-root <dir>] [-boot <dir>] [-source_root <dir>] [-dry_run] [-reboot]\n"
 }
 
 func (c *prepCmd) SetFlags(f *flag.FlagSet) {
+	c.setFlags(f)
 	f.BoolVar(&c.reboot, "reboot", false, "reboot the system after preparation.")
-	f.BoolVar(&c.dryRun, "dry_run", false, "parse the config and simulate, but make no changes.")
-	f.StringVar(&c.config, "config", prepConfigDefault, "override the default config file path.")
+	f.BoolVar(&c.dryRun, "dry_run", false, "parse the config and print what would be done, but make no changes.")
 
 	f.StringVar(&preppi.RebootCommand, "reboot_command", preppi.RebootCommand,
 		"Command to run to reboot the system. No arguments may be passed.")
@@ -90,112 +159,940 @@ func (c *prepCmd) SetFlags(f *flag.FlagSet) {
 func (c *prepCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	log.Printf("%v starting", preppi.VersionString())
 
-	if c.config == "" {
-		log.Print("No -config specified, nothing to do!")
+	mapper, rd, err := c.load()
+	if err != nil {
+		log.Print(err)
 		return subcommands.ExitFailure
 	}
+	if mapper == nil {
+		return subcommands.ExitSuccess
+	}
 
-	if ok, err := checkConfigExists(c.config); !ok {
-		if err != nil {
-			log.Printf("couldn't stat -config %q: %v", c.config, err)
-			return subcommands.ExitFailure
+	if c.dryRun {
+		return printPlan(mapper, rd)
+	}
+
+	start := time.Now()
+	n, skipped, err := mapper.Apply(rd)
+	log.Printf("preppi processed %v files, modified %v in %v", len(mapper.Mappings), n, time.Since(start))
+	if len(skipped) > 0 {
+		log.Printf("skipped %v files whose sources couldn't be fetched:", len(skipped))
+		for _, e := range skipped {
+			log.Printf("  %v: %v", e.Mapping.Destination, e.Reason)
 		}
-		log.Printf("specified -config %q doesn't exist, nothing to do!", c.config)
+	}
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return subcommands.ExitFailure
+	}
+	if n > 0 && c.reboot && c.root != "" {
+		log.Print("Files changed, but not rebooting the running system for changes under -root")
+	} else if n > 0 && c.reboot {
+		log.Printf("Files changed, rebooting with: %q", preppi.RebootCommand)
+		if err := preppi.RebootSystem(); err != nil {
+			log.Printf("preppi tried to reboot the system but failed: %v", err)
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// printPlan prints what applying mapper with rd would do.
+func printPlan(mapper *preppi.Mapper, rd *preppi.RecipeData) subcommands.ExitStatus {
+	entries, err := mapper.Plan(rd)
+	if err := preppi.WritePlan(os.Stdout, entries); err != nil {
+		log.Printf("error writing plan: %v", err)
+		return subcommands.ExitFailure
+	}
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+type planCmd struct {
+	configFlags
+}
+
+func (*planCmd) Name() string     { return "plan" }
+func (*planCmd) Synopsis() string { return "print what prepare would do" }
+func (*planCmd) Usage() string {
+	return "Usage:\tpreppi plan [-config <path>] [-vars <path>] [-root <dir>] [-boot <dir>] [-source_root <dir>]\n"
+}
+
+func (c *planCmd) SetFlags(f *flag.FlagSet) {
+	c.setFlags(f)
+}
+
+func (c *planCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	mapper, rd, err := c.load()
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	if mapper == nil {
 		return subcommands.ExitSuccess
 	}
+	return printPlan(mapper, rd)
+}
 
-	mapper, err := preppi.MapperFromConfig(c.config)
+type verifyCmd struct {
+	configFlags
+}
+
+func (*verifyCmd) Name() string     { return "verify" }
+func (*verifyCmd) Synopsis() string { return "check that the system matches the config" }
+func (*verifyCmd) Usage() string {
+	return "Usage:\tpreppi verify [-config <path>] [-vars <path>] [-root <dir>] [-boot <dir>] [-source_root <dir>]\n"
+}
+
+func (c *verifyCmd) SetFlags(f *flag.FlagSet) {
+	c.setFlags(f)
+}
+
+func (c *verifyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	mapper, rd, err := c.load()
 	if err != nil {
-		log.Printf("error processing -config %q: %v", c.config, err)
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	if mapper == nil {
+		return subcommands.ExitSuccess
+	}
+	entries, err := mapper.Plan(rd)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return subcommands.ExitFailure
+	}
+	drift := 0
+	for _, e := range entries {
+		if e.Action == preppi.ActionWrite || e.Action == preppi.ActionConflict {
+			drift++
+			fmt.Printf("%v: %v\n", e.Mapping.Destination, e.Reason)
+		}
+	}
+	if drift > 0 {
+		log.Printf("%v of %v files don't match the config", drift, len(entries))
 		return subcommands.ExitFailure
 	}
+	return subcommands.ExitSuccess
+}
 
-	start := time.Now()
-	if !c.dryRun {
-		n, err := mapper.Apply()
+// recipeFlags are the flags shared by subcommands which bake a recipe.
+type recipeFlags struct {
+	recipe      string
+	recipeRoot  string
+	inlineLimit int
+	prefix      string
+	vars        string
+	varFromEnv  string
+	interactive bool
+	saveVars    string
+	varsKey     string
+	sandbox     bool
+}
+
+func (c *recipeFlags) setFlags(f *flag.FlagSet) {
+	f.StringVar(&c.recipe, "recipe", "", "name of the recipe to bake. required.")
+	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
+	f.IntVar(&c.inlineLimit, "inline", 0,
+		"inline rendered files of at most this many bytes into preppi.conf. 0 disables inlining.")
+	f.StringVar(&c.vars, "vars", "", "file of variables: .json, .yaml or .env. overridden by -var_from_env and arguments.")
+	f.StringVar(&c.varFromEnv, "var_from_env", "",
+		"take variables from environment variables with this prefix, eg PREPPI_ for PREPPI_Hostname. overridden by arguments.")
+	f.BoolVar(&c.interactive, "interactive", false, "prompt on the terminal for any variables the recipe needs but which weren't given.")
+	f.StringVar(&c.saveVars, "save_vars", "",
+		"save the variables, except secrets, to this .json, .yaml or .env file for the next bake.")
+	f.StringVar(&c.varsKey, "vars_key", "",
+		"file whose content is the key encrypting the record of generated variables, kept beside the output as <out>.vars.json.")
+	f.BoolVar(&c.sandbox, "sandbox", false,
+		"limit the output, run time and nesting of the recipe's templates, and stop them reading files, for recipes which aren't trusted.")
+	f.StringVar(&c.prefix, "prefix", "",
+		"directory on the device, eg /boot/preppi, under which preppi.conf names baked files. by default they're relative to preppi.conf.")
+}
+
+// load reads the recipe, and gathers the data with which to bake it from the
+// -vars file, the environment and the var1=val1 arguments, in increasing order
+// of precedence.
+func (c *recipeFlags) load(args []string) (*preppi.Recipe, *preppi.RecipeData, error) {
+	if c.recipe == "" {
+		return nil, nil, fmt.Errorf("No -recipe provided, nothing to do!")
+	}
+	fileVars := make(map[string]string)
+	if c.vars != "" {
+		var err error
+		if fileVars, err = preppi.VarsFromFile(c.vars); err != nil {
+			return nil, nil, err
+		}
+	}
+	envVars := make(map[string]string)
+	if c.varFromEnv != "" {
+		envVars = preppi.VarsFromEnv(c.varFromEnv, os.Environ())
+	}
+	argVars, err := preppi.VarsFromArgs(args, os.Stdin)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error processing variables: %v", err)
+	}
+	// Facts describe the device, so there are none when baking elsewhere.
+	rd := &preppi.RecipeData{}
+	rd.Vars = preppi.MergeVars(fileVars, envVars, argVars)
+
+	recipe, err := readRecipe(c.recipeRoot, c.recipe)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.interactive {
+		missing, err := recipe.MissingVars(rd.Vars)
 		if err != nil {
-			log.Printf("Error: %v", err)
+			return nil, nil, err
 		}
-		log.Printf("preppi processed %v files, modified %v in %v", len(mapper.Mappings), n, time.Since(start))
-		if n > 0 && err == nil && c.reboot {
-			log.Printf("Files changed, rebooting with: %q", preppi.RebootCommand)
-			if err := preppi.RebootSystem(); err != nil {
-				log.Printf("preppi tried to reboot the system but failed: %v", err)
-			}
+		if len(missing) == 0 {
+			return recipe, rd, nil
+		}
+		p, err := preppi.NewTerminalPrompter(os.Stdin, os.Stderr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't prompt for variables: %v", err)
+		}
+		if err := p.PromptVars(missing, rd.Vars); err != nil {
+			return nil, nil, err
 		}
 	}
-	return subcommands.ExitSuccess
+	return recipe, rd, nil
+}
+
+// save writes the variables, except secrets, to the -save_vars file, if any.
+func (c *recipeFlags) save(recipe *preppi.Recipe, rd *preppi.RecipeData) error {
+	if c.saveVars == "" {
+		return nil
+	}
+	if err := preppi.WriteVarsFile(c.saveVars, preppi.PublicVars(recipe.VarSchema(), rd.Vars)); err != nil {
+		return fmt.Errorf("error saving variables to %q: %v", c.saveVars, err)
+	}
+	return nil
+}
+
+// bakeOptions returns the BakeOptions chosen by the flags.
+func (c *recipeFlags) bakeOptions() (*preppi.BakeOptions, error) {
+	o := &preppi.BakeOptions{InlineLimit: c.inlineLimit, Prefix: c.prefix}
+	if c.sandbox {
+		o.Sandbox = preppi.DefaultSandbox()
+	}
+	if c.varsKey != "" {
+		var err error
+		if o.VarsKey, err = ioutil.ReadFile(c.varsKey); err != nil {
+			return nil, fmt.Errorf("error reading -vars_key: %v", err)
+		}
+	}
+	return o, nil
+}
+
+// readRecipe reads the named recipe from under root.
+func readRecipe(root, name string) (*preppi.Recipe, error) {
+	recipePath := path.Join(root, name, bakeRecipeNameDefault)
+	recipe, err := preppi.RecipeFromFile(recipePath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading recipe %q: %v", recipePath, err)
+	}
+	return recipe, nil
 }
 
 type bakeCmd struct {
-	recipe      string
-	recipeRoot  string
+	recipeFlags
+
 	destination string
+	inventory   string
+	key         string
+	archive     string
+	jobs        int
+	upgrade     string
+
+	// previous is the manifest of the bake being upgraded.
+	previous *preppi.Manifest
 }
 
 func (*bakeCmd) Name() string     { return "bake" }
 func (*bakeCmd) Synopsis() string { return "bake a recipe" }
 func (*bakeCmd) Usage() string {
-	return "Usage:\tpreppi bake [-root <path>] -recipe <name> -out <path> [var1=val1 [var2=val2] ...]\n"
+	return "Usage:\tpreppi bake [-root <path>] [-vars <path>] [-var_from_env <prefix>] [-interactive] [-save_vars <path>] [-inline <bytes>] [-prefix <dir>] [-sandbox] [-inventory <path> [-key <var>] [-archive <ext>] [-jobs <n>]] -recipe <name> -out <path> [var1=val1 [var2=@file [var3=@-]] ...]\n" +
+		"\tpreppi bake [-root <path>] [-vars_key <path>] [-save_vars <path>] [-inline <bytes>] [-prefix <dir>] [-recipe <name>] [-out <path>] -upgrade <path> [var1=val1 ...]\n"
 }
 
 func (c *bakeCmd) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&c.recipe, "recipe", "", "name of the recipe to bake. required.")
-	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
-	f.StringVar(&c.destination, "out", "", "path under which generated files are written")
+	c.setFlags(f)
+	f.StringVar(&c.destination, "out", "", "path under which generated files are written, or a .zip, .tar or .tar.gz archive to write them to")
+	f.StringVar(&c.inventory, "inventory", "", "a .csv, .yaml or .json file of variables for each of a fleet of devices, each baked into its own output under -out")
+	f.StringVar(&c.key, "key", "Hostname", "with -inventory, the variable which names each device's output")
+	f.StringVar(&c.archive, "archive", "", "with -inventory, the extension of an archive to write for each device, eg .zip, rather than a directory")
+	f.IntVar(&c.jobs, "jobs", runtime.NumCPU(), "with -inventory, the number of devices baked at once")
+	f.StringVar(&c.upgrade, "upgrade", "",
+		"bake again the earlier bake in this directory, with the variables it recorded, asking only for those it lacks. -recipe, -root, -prefix, -inline and -out default to the earlier ones.")
 }
 
-func unpackKV(kvs []string) (map[string]string, error) {
-	v := make(map[string]string)
-	for _, kv := range kvs {
-		s := strings.Split(kv, "=")
-		if len(s) != 2 {
-			return nil, fmt.Errorf("Invalid Value Specification: %q", kv)
+func (c *bakeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.upgrade != "" {
+		if c.inventory != "" || c.interactive {
+			log.Print("-upgrade can't be used with -inventory or -interactive")
+			return subcommands.ExitUsageError
+		}
+		var err error
+		if c.previous, err = preppi.ReadManifest(c.upgrade); err != nil {
+			log.Print(err)
+			return subcommands.ExitFailure
+		}
+		if c.recipe == "" {
+			c.recipe = c.previous.Recipe
+		}
+		if c.destination == "" {
+			c.destination = c.upgrade
+		}
+		c.reuseOptions(f)
+	}
+	if c.destination == "" {
+		log.Print("No -out provided, refusing to write to current directory without explicit instruction")
+		return subcommands.ExitFailure
+	}
+	if c.inventory != "" && c.interactive {
+		log.Print("-interactive can't be used with -inventory")
+		return subcommands.ExitUsageError
+	}
+	recipe, rd, err := c.load(f.Args())
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	if c.inventory != "" {
+		if err := c.save(recipe, rd); err != nil {
+			log.Print(err)
+			return subcommands.ExitFailure
 		}
-		v[s[0]] = s[1]
+		return c.bakeFleet(recipe, rd)
 	}
-	return v, nil
+
+	start := time.Now()
+	log.Printf("baking recipe %q", c.recipe)
+	opts, err := c.bakeOptions()
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	if c.previous != nil {
+		if err := c.upgradeVars(recipe, rd, opts.VarsKey); err != nil {
+			log.Print(err)
+			return subcommands.ExitFailure
+		}
+	}
+	if err := c.save(recipe, rd); err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	bake := recipe.Bake
+	if preppi.IsArchive(c.destination) {
+		bake = recipe.BakeArchive
+	}
+	if err := bake(c.destination, rd, opts); err != nil {
+		log.Printf("error baking recipe: %v", err)
+		return subcommands.ExitFailure
+	}
+	log.Printf("preppi baked recipe %q in %v", c.recipe, time.Since(start))
+	return subcommands.ExitSuccess
 }
 
-func (c *bakeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if c.recipe == "" {
-		log.Print("No -recipe provided, nothing to do!")
+// reuseOptions takes the recipe root, -prefix and -inline of the bake being
+// upgraded, unless they're given again.
+func (c *bakeCmd) reuseOptions(f *flag.FlagSet) {
+	given := make(map[string]bool)
+	f.Visit(func(fl *flag.Flag) { given[fl.Name] = true })
+	if !given["root"] && c.previous.Root != "" {
+		c.recipeRoot = c.previous.Root
+	}
+	if !given["prefix"] {
+		c.prefix = c.previous.Prefix
+	}
+	if !given["inline"] {
+		c.inlineLimit = c.previous.InlineLimit
+	}
+}
+
+// upgradeVars adds the variables of the bake being upgraded to rd, under
+// those given, and asks on the terminal, if there is one, for any which the
+// recipe now requires but nobody gave.
+func (c *bakeCmd) upgradeVars(recipe *preppi.Recipe, rd *preppi.RecipeData, key []byte) error {
+	digest, err := recipe.Digest()
+	if err != nil {
+		return fmt.Errorf("error reading recipe %q: %v", c.recipe, err)
+	}
+	if digest == c.previous.Digest {
+		log.Printf("recipe %q is unchanged since %v baked %q", c.recipe, c.previous.Version, c.upgrade)
+	} else {
+		log.Printf("recipe %q has changed since %v baked %q", c.recipe, c.previous.Version, c.upgrade)
+	}
+	previous, err := c.previous.Values(key)
+	if err != nil {
+		return err
+	}
+	rd.Vars = preppi.MergeVars(previous, rd.Vars)
+	missing, err := recipe.MissingVars(rd.Vars)
+	if err != nil {
+		return err
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	p, err := preppi.NewTerminalPrompter(os.Stdin, os.Stderr)
+	if err != nil {
+		// The bake reports what's missing.
+		return nil
+	}
+	return p.PromptVars(missing, rd.Vars)
+}
+
+// bakeFleet bakes the recipe for each device of the inventory, and summarizes
+// any failures.
+func (c *bakeCmd) bakeFleet(recipe *preppi.Recipe, rd *preppi.RecipeData) subcommands.ExitStatus {
+	inventory, err := preppi.InventoryFromFile(c.inventory)
+	if err != nil {
+		log.Print(err)
 		return subcommands.ExitFailure
 	}
-	if c.destination == "" {
-		log.Print("No -out provided, refusing to write to current directory without explicit instruction")
+	o, err := c.bakeOptions()
+	if err != nil {
+		log.Print(err)
 		return subcommands.ExitFailure
 	}
-	vars, err := unpackKV(f.Args())
+	start := time.Now()
+	log.Printf("baking recipe %q for %d devices", c.recipe, len(inventory))
+	opts := &preppi.FleetOptions{
+		BakeOptions: *o,
+		Key:         c.key,
+		Archive:     c.archive,
+		Jobs:        c.jobs,
+	}
+	results, err := recipe.BakeFleet(c.destination, inventory, rd, opts)
 	if err != nil {
-		log.Printf("error processing variables: %v", err)
+		log.Printf("error baking recipe: %v", err)
 		return subcommands.ExitFailure
 	}
-	rd := &preppi.RecipeData{}
-	rd.Vars = vars
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			log.Printf("row %d (%v): %v", r.Row, r.Key, r.Err)
+		}
+	}
+	log.Printf("preppi baked recipe %q for %d of %d devices in %v", c.recipe, len(results)-failed, len(results), time.Since(start))
+	if failed > 0 {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
 
-	recipePath := path.Join(c.recipeRoot, c.recipe, bakeRecipeNameDefault)
-	recipe, err := preppi.RecipeFromFile(recipePath)
+type imageCmd struct{}
+
+func (*imageCmd) Name() string     { return "image" }
+func (*imageCmd) Synopsis() string { return "work with Raspberry Pi disk images" }
+func (*imageCmd) Usage() string {
+	return "Usage:\tpreppi image inject -image <path> -recipe <name> [-root <path>] [-dir <name>] [var1=val1 [var2=@file [var3=@-]] ...]\n"
+}
+
+func (*imageCmd) SetFlags(_ *flag.FlagSet) {}
+
+func (*imageCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	cdr := subcommands.NewCommander(f, "image")
+	cdr.Register(cdr.HelpCommand(), "")
+	cdr.Register(&injectCmd{}, "")
+	return cdr.Execute(ctx, args...)
+}
+
+type injectCmd struct {
+	recipeFlags
+
+	image string
+	dir   string
+}
+
+func (*injectCmd) Name() string     { return "inject" }
+func (*injectCmd) Synopsis() string { return "bake a recipe into a disk image's boot partition" }
+func (*injectCmd) Usage() string {
+	return "Usage:\tpreppi image inject -image <path> -recipe <name> [-root <path>] [-dir <name>] [-vars <path>] [-var_from_env <prefix>] [-interactive] [-save_vars <path>] [-inline <bytes>] [-prefix <dir>] [-sandbox] [var1=val1 [var2=@file [var3=@-]] ...]\n"
+}
+
+func (c *injectCmd) SetFlags(f *flag.FlagSet) {
+	c.setFlags(f)
+	f.StringVar(&c.image, "image", "", "disk image into which the recipe is baked. required.")
+	f.StringVar(&c.dir, "dir", "preppi", "directory on the boot partition under which generated files are written.")
+}
+
+func (c *injectCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.image == "" {
+		log.Print("No -image provided, nothing to do!")
+		return subcommands.ExitFailure
+	}
+	recipe, rd, err := c.load(f.Args())
 	if err != nil {
-		log.Printf("error reading recipe %q: %v", recipePath, err)
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	if err := c.save(recipe, rd); err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+
+	img, err := os.OpenFile(c.image, os.O_RDWR, 0)
+	if err != nil {
+		log.Printf("error opening -image: %v", err)
+		return subcommands.ExitFailure
+	}
+	defer img.Close()
+	boot, err := preppi.OpenBootPartition(img)
+	if err != nil {
+		log.Printf("error opening boot partition of %q: %v", c.image, err)
 		return subcommands.ExitFailure
 	}
 
 	start := time.Now()
-	log.Printf("baking recipe %q", c.recipe)
-	if err := recipe.Bake(c.destination, rd); err != nil {
+	log.Printf("baking recipe %q into %v boot partition of %q", c.recipe, boot.Name(), c.image)
+	o, err := c.bakeOptions()
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	o.Output = boot
+	o.VarsRecord = c.image + preppi.VarsRecordExt
+	if err := recipe.Bake(path.Join("/", c.dir), rd, o); err != nil {
 		log.Printf("error baking recipe: %v", err)
+		return subcommands.ExitFailure
+	}
+	if err := img.Sync(); err != nil {
+		log.Printf("error writing %q: %v", c.image, err)
+		return subcommands.ExitFailure
 	}
 	log.Printf("preppi baked recipe %q in %v", c.recipe, time.Since(start))
 	return subcommands.ExitSuccess
 }
 
+type factsCmd struct{}
+
+func (*factsCmd) Name() string     { return "facts" }
+func (*factsCmd) Synopsis() string { return "print facts about this device" }
+func (*factsCmd) Usage() string {
+	return "Usage:\tpreppi facts\n"
+}
+
+func (*factsCmd) SetFlags(_ *flag.FlagSet) {}
+
+func (*factsCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	facts, err := preppi.CollectFacts()
+	if err != nil {
+		log.Printf("error collecting facts: %v", err)
+		return subcommands.ExitFailure
+	}
+	b, err := json.MarshalIndent(facts, "", "\t")
+	if err != nil {
+		log.Printf("error encoding facts: %v", err)
+		return subcommands.ExitFailure
+	}
+	fmt.Println(string(b))
+	return subcommands.ExitSuccess
+}
+
+type hashPasswordCmd struct {
+	method string
+}
+
+func (*hashPasswordCmd) Name() string     { return "hash-password" }
+func (*hashPasswordCmd) Synopsis() string { return "hash a password for /etc/shadow" }
+func (*hashPasswordCmd) Usage() string {
+	return "Usage:\tpreppi hash-password [-method yescrypt|sha512crypt]\n"
+}
+
+func (c *hashPasswordCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.method, "method", "yescrypt", "hash method: yescrypt, or sha512crypt for older OS releases.")
+}
+
+func (c *hashPasswordCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	password, err := preppi.ReadPassword(os.Stdin, os.Stderr)
+	if err != nil {
+		log.Printf("error reading password: %v", err)
+		return subcommands.ExitFailure
+	}
+	hash, err := preppi.HashPassword(c.method, password)
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	fmt.Println(hash)
+	return subcommands.ExitSuccess
+}
+
+type recipeCmd struct{}
+
+func (*recipeCmd) Name() string     { return "recipe" }
+func (*recipeCmd) Synopsis() string { return "work with recipes" }
+func (*recipeCmd) Usage() string {
+	return "Usage:\tpreppi recipe lint|show|test -recipe <name> [-root <path>]\n"
+}
+
+func (*recipeCmd) SetFlags(_ *flag.FlagSet) {}
+
+func (*recipeCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	cdr := subcommands.NewCommander(f, "recipe")
+	cdr.Register(cdr.HelpCommand(), "")
+	cdr.Register(&lintCmd{}, "")
+	cdr.Register(&showCmd{}, "")
+	cdr.Register(&testCmd{}, "")
+	return cdr.Execute(ctx, args...)
+}
+
+type lintCmd struct {
+	recipe     string
+	recipeRoot string
+}
+
+func (*lintCmd) Name() string     { return "lint" }
+func (*lintCmd) Synopsis() string { return "check a recipe's templates against its variables" }
+func (*lintCmd) Usage() string {
+	return "Usage:\tpreppi recipe lint -recipe <name> [-root <path>]\n"
+}
+
+func (c *lintCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.recipe, "recipe", "", "name of the recipe to lint. required.")
+	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
+}
+
+func (c *lintCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.recipe == "" {
+		log.Print("No -recipe provided, nothing to do!")
+		return subcommands.ExitFailure
+	}
+	recipe, err := readRecipe(c.recipeRoot, c.recipe)
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	status := subcommands.ExitSuccess
+	for _, p := range recipe.Lint() {
+		fmt.Println(p)
+		if !p.Warning {
+			status = subcommands.ExitFailure
+		}
+	}
+	return status
+}
+
+type showCmd struct {
+	recipe     string
+	recipeRoot string
+	json       bool
+	raw        bool
+}
+
+func (*showCmd) Name() string     { return "show" }
+func (*showCmd) Synopsis() string { return "describe a recipe's ingredients and variables" }
+func (*showCmd) Usage() string {
+	return "Usage:\tpreppi recipe show [-json|-raw] -recipe <name> [-root <path>]\n"
+}
+
+func (c *showCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.recipe, "recipe", "", "name of the recipe to show. required.")
+	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
+	f.BoolVar(&c.json, "json", false, "print JSON.")
+	f.BoolVar(&c.raw, "raw", false, "print the recipe as written, without merging the recipes it extends and includes.")
+}
+
+// shownIngredient is an ingredient along with the recipe it came from.
+type shownIngredient struct {
+	Recipe string `json:"recipe"`
+	*preppi.Ingredient
+}
+
+// recipeDetail describes a recipe for recipe show -json.
+type recipeDetail struct {
+	recipeSummary
+	Ingredients []*shownIngredient `json:"ingredients"`
+	Variables   []*preppi.Variable `json:"variables"`
+}
+
+// describeRecipe describes the named recipe, after merging the recipes it
+// extends and includes. The defaults of secret variables are left out.
+func describeRecipe(recipe *preppi.Recipe, name, recipePath string) *recipeDetail {
+	d := &recipeDetail{recipeSummary: recipeSummary{Name: name, Title: recipe.Name, Description: recipe.Description, Path: recipePath}}
+	for _, i := range recipe.Ingredients {
+		d.Ingredients = append(d.Ingredients, &shownIngredient{i.From(), i})
+	}
+	for _, v := range recipe.VarSchema() {
+		if v.IsSecret() && v.Default != nil {
+			hidden := *v
+			hidden.Default = nil
+			v = &hidden
+		}
+		d.Variables = append(d.Variables, v)
+	}
+	return d
+}
+
+func (c *showCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.recipe == "" {
+		log.Print("No -recipe provided, nothing to do!")
+		return subcommands.ExitFailure
+	}
+	recipePath := path.Join(c.recipeRoot, c.recipe, bakeRecipeNameDefault)
+	if c.raw {
+		recipe, err := preppi.UnresolvedRecipeFromFile(recipePath)
+		if err != nil {
+			log.Print(err)
+			return subcommands.ExitFailure
+		}
+		return printJSON(recipe)
+	}
+	recipe, err := readRecipe(c.recipeRoot, c.recipe)
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	if c.json {
+		return printJSON(describeRecipe(recipe, c.recipe, recipePath))
+	}
+
+	fmt.Printf("%v: %v\n", c.recipe, recipe.Name)
+	if recipe.Description != "" {
+		fmt.Printf("  %v\n", recipe.Description)
+	}
+	fmt.Printf("  %v\n\nIngredients:\n", recipePath)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  DESTINATION\tSOURCE\tMODE\tDIRMODE\tOWNER\tNOTES")
+	for _, i := range recipe.Ingredients {
+		var notes []string
+		if i.From() != c.recipe {
+			notes = append(notes, "from "+i.From())
+		}
+		if i.When != "" {
+			notes = append(notes, "when "+i.When)
+		}
+		if i.Foreach != "" {
+			notes = append(notes, "for each "+i.Foreach)
+		}
+		if i.Raw {
+			notes = append(notes, "raw")
+		}
+		fmt.Fprintf(w, "  %v\t%v\t%#o\t%#o\t%v:%v\t%v\n", i.Destination, i.Source, i.Mode, i.DirMode, i.UID, i.GID, strings.Join(notes, ", "))
+	}
+	w.Flush()
+
+	fmt.Print("\nVariables:\n")
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "  NAME\tTYPE\tDEFAULT\tDESCRIPTION")
+	conditional := recipe.ConditionalVars()
+	for _, v := range recipe.VarSchema() {
+		typ := v.Type
+		if typ == "" {
+			typ = preppi.VarString
+		}
+		if v.IsSecret() {
+			typ += ", secret"
+		}
+		def := "(required)"
+		if conditional[v.Name] {
+			def = "(conditional)"
+		}
+		if v.Generate != "" {
+			def = "(generated " + v.Generate + ")"
+		}
+		if v.Default != nil {
+			def = strconv.Quote(*v.Default)
+			if v.IsSecret() {
+				def = "(hidden)"
+			}
+		}
+		fmt.Fprintf(w, "  %v\t%v\t%v\t%v\n", v.Name, typ, def, v.Description)
+	}
+	w.Flush()
+	return subcommands.ExitSuccess
+}
+
+type testCmd struct {
+	recipe     string
+	recipeRoot string
+	update     bool
+}
+
+func (*testCmd) Name() string     { return "test" }
+func (*testCmd) Synopsis() string { return "compare a recipe's bakes with its golden files" }
+func (*testCmd) Usage() string {
+	return "Usage:\tpreppi recipe test [-update] -recipe <name> [-root <path>]\n"
+}
+
+func (c *testCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.recipe, "recipe", "", "name of the recipe to test. required.")
+	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
+	f.BoolVar(&c.update, "update", false, "rewrite the golden files which differ from the bakes.")
+}
+
+func (c *testCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if c.recipe == "" {
+		log.Print("No -recipe provided, nothing to do!")
+		return subcommands.ExitFailure
+	}
+	recipe, err := readRecipe(c.recipeRoot, c.recipe)
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	results, err := recipe.Test(c.update)
+	if err != nil {
+		log.Print(err)
+		return subcommands.ExitFailure
+	}
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Printf("FAIL\t%v: %v\n", r.Name, r.Err)
+		case r.Updated:
+			fmt.Printf("UPDATED\t%v\n", r.Name)
+		case !r.Passed():
+			fmt.Printf("FAIL\t%v\n", r.Name)
+		default:
+			fmt.Printf("ok\t%v\n", r.Name)
+		}
+		for _, d := range r.Diffs {
+			fmt.Printf("\t%v\n", strings.Replace(d, "\n", "\n\t", -1))
+		}
+		if !r.Passed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Printf("%d of %d tests of recipe %q failed", failed, len(results), c.recipe)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+type recipesCmd struct{}
+
+func (*recipesCmd) Name() string     { return "recipes" }
+func (*recipesCmd) Synopsis() string { return "list and describe available recipes" }
+func (*recipesCmd) Usage() string {
+	return "Usage:\tpreppi recipes list|show [-root <path>] [-json] [<name>]\n"
+}
+
+func (*recipesCmd) SetFlags(_ *flag.FlagSet) {}
+
+func (*recipesCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	cdr := subcommands.NewCommander(f, "recipes")
+	cdr.Register(cdr.HelpCommand(), "")
+	cdr.Register(&recipesListCmd{}, "")
+	cdr.Register(&recipesShowCmd{}, "")
+	return cdr.Execute(ctx, args...)
+}
+
+type recipesListCmd struct {
+	recipeRoot string
+	json       bool
+}
+
+func (*recipesListCmd) Name() string     { return "list" }
+func (*recipesListCmd) Synopsis() string { return "list the recipes under the recipe root" }
+func (*recipesListCmd) Usage() string {
+	return "Usage:\tpreppi recipes list [-root <path>] [-json]\n"
+}
+
+func (c *recipesListCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
+	f.BoolVar(&c.json, "json", false, "print JSON.")
+}
+
+// recipeSummary describes a recipe for recipes list.
+type recipeSummary struct {
+	Name        string `json:"name"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Path        string `json:"path"`
+	Error       string `json:"error,omitempty"`
+}
+
+func (c *recipesListCmd) Execute(_ context.Context, _ *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	entries, err := preppi.FindRecipes(c.recipeRoot)
+	if err != nil {
+		log.Printf("error finding recipes: %v", err)
+		return subcommands.ExitFailure
+	}
+	summaries := make([]*recipeSummary, 0, len(entries))
+	for _, e := range entries {
+		s := &recipeSummary{Name: e.Name, Path: e.Path}
+		if e.Err != nil {
+			s.Error = e.Err.Error()
+		} else {
+			s.Title, s.Description = e.Recipe.Name, e.Recipe.Description
+		}
+		summaries = append(summaries, s)
+	}
+	if c.json {
+		return printJSON(summaries)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tDESCRIPTION\tPATH")
+	for _, s := range summaries {
+		desc := s.Description
+		if desc == "" {
+			desc = s.Title
+		}
+		if s.Error != "" {
+			desc = "error: " + s.Error
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\n", s.Name, desc, s.Path)
+	}
+	w.Flush()
+	return subcommands.ExitSuccess
+}
+
+// recipesShowCmd is recipe show, taking the recipe's name as an argument.
+type recipesShowCmd struct {
+	showCmd
+}
+
+func (*recipesShowCmd) Usage() string {
+	return "Usage:\tpreppi recipes show [-root <path>] [-json] <name>\n"
+}
+
+func (c *recipesShowCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.recipeRoot, "root", bakeRecipeRootDefault, "override default recipe root location.")
+	f.BoolVar(&c.json, "json", false, "print JSON.")
+}
+
+func (c *recipesShowCmd) Execute(ctx context.Context, f *flag.FlagSet, args ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		log.Print("Give the name of one recipe to show")
+		return subcommands.ExitUsageError
+	}
+	c.recipe = f.Arg(0)
+	return c.showCmd.Execute(ctx, f, args...)
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(v interface{}) subcommands.ExitStatus {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Printf("error encoding JSON: %v", err)
+		return subcommands.ExitFailure
+	}
+	fmt.Println(string(b))
+	return subcommands.ExitSuccess
+}
+
 func main() {
 	subcommands.Register(subcommands.HelpCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
 	subcommands.Register(&versionCmd{}, "")
 	subcommands.Register(&prepCmd{}, "")
+	subcommands.Register(&planCmd{}, "")
+	subcommands.Register(&verifyCmd{}, "")
 	subcommands.Register(&bakeCmd{}, "")
+	subcommands.Register(&factsCmd{}, "")
+	subcommands.Register(&imageCmd{}, "")
+	subcommands.Register(&recipeCmd{}, "")
+	subcommands.Register(&hashPasswordCmd{}, "")
+	subcommands.Register(&recipesCmd{}, "")
 
 	flag.Parse()
 	ctx := context.Background()
@@ -0,0 +1,235 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/cfunkhouser/preppi/preppi"
+	"github.com/google/subcommands"
+)
+
+// executeForTest runs cmd with args, as the command line would.
+func executeForTest(t *testing.T, cmd subcommands.Command, args ...string) subcommands.ExitStatus {
+	t.Helper()
+	f := flag.NewFlagSet(cmd.Name(), flag.ContinueOnError)
+	cmd.SetFlags(f)
+	if err := f.Parse(args); err != nil {
+		t.Fatalf("%v %v: %v", cmd.Name(), args, err)
+	}
+	return cmd.Execute(context.Background(), f)
+}
+
+// writeRecipeForTest writes a recipe named test under root, whose single
+// ingredient needs a Hostname.
+func writeRecipeForTest(t *testing.T, root string) {
+	t.Helper()
+	dir := path.Join(root, "test")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"recipe.json": `{
+	"name": "Test Recipe",
+	"ingredients": [{"source": "etc-hostname", "destination": "/etc/hostname", "mode": 420, "vars": ["Hostname"]}],
+	"variables": [{"name": "Hostname", "type": "hostname"}]
+}`,
+		"etc-hostname": "{{.Vars.Hostname}}\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBakeCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBakeCmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := path.Join(dir, "recipes")
+	writeRecipeForTest(t, root)
+
+	for _, tc := range []struct {
+		args []string
+		want subcommands.ExitStatus
+	}{
+		{nil, subcommands.ExitFailure},
+		{[]string{"Hostname=not a hostname"}, subcommands.ExitFailure},
+		{[]string{"Hostname=pi"}, subcommands.ExitSuccess},
+	} {
+		out := path.Join(dir, "out")
+		os.RemoveAll(out)
+		args := append([]string{"-root", root, "-recipe", "test", "-out", out}, tc.args...)
+		if got := executeForTest(t, &bakeCmd{}, args...); got != tc.want {
+			t.Errorf("bake %v: wanted exit status %v, got %v", tc.args, tc.want, got)
+		}
+		_, err := os.Stat(path.Join(out, "etc-hostname"))
+		if baked := err == nil; baked != (tc.want == subcommands.ExitSuccess) {
+			t.Errorf("bake %v: wanted output written %v, got %v", tc.args, !baked, baked)
+		}
+	}
+}
+
+func TestRecipeFlagsLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRecipeFlagsLoad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRecipeForTest(t, dir)
+
+	c := &recipeFlags{recipe: "test", recipeRoot: dir}
+	_, rd, err := c.load([]string{"Hostname=pi"})
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if rd.Vars["Hostname"] != "pi" {
+		t.Errorf("wanted Hostname pi, got %v", rd.Vars)
+	}
+	// The baking machine's facts aren't the device's.
+	if rd.Facts != nil {
+		t.Errorf("wanted no facts when baking, got %+v", rd.Facts)
+	}
+}
+
+func TestDescribeRecipe(t *testing.T) {
+	secret, plain := "hunter2", "pi"
+	recipe := &preppi.Recipe{
+		Name: "Test Recipe",
+		Variables: []*preppi.Variable{
+			{Name: "Hostname", Type: preppi.VarHostname, Default: &plain},
+			{Name: "Password", Default: &secret, Secret: true},
+			{Name: "Token", Generate: "random_password(32)"},
+		},
+	}
+	d := describeRecipe(recipe, "test", "/recipes/test/recipe.json")
+	defaults := make(map[string]*string)
+	for _, v := range d.Variables {
+		defaults[v.Name] = v.Default
+		if v.Name == "Token" && v.Generate != "random_password(32)" {
+			t.Errorf("wanted Token shown with its generator, got %q", v.Generate)
+		}
+	}
+	if got := defaults["Hostname"]; got == nil || *got != plain {
+		t.Errorf("wanted Hostname default %q, got %v", plain, got)
+	}
+	for _, name := range []string{"Password", "Token"} {
+		if got, ok := defaults[name]; !ok || got != nil {
+			t.Errorf("wanted %v shown without a default, got %v (shown %v)", name, got, ok)
+		}
+	}
+	// Hiding a default mustn't change the recipe.
+	if recipe.Variables[1].Default != &secret {
+		t.Errorf("wanted the recipe's Password default kept, got %v", recipe.Variables[1].Default)
+	}
+}
+
+func TestShowCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestShowCmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRecipeForTest(t, dir)
+
+	for _, tc := range []struct {
+		args []string
+		want subcommands.ExitStatus
+	}{
+		{nil, subcommands.ExitFailure},
+		{[]string{"-recipe", "missing"}, subcommands.ExitFailure},
+		{[]string{"-recipe", "test"}, subcommands.ExitSuccess},
+		{[]string{"-recipe", "test", "-json"}, subcommands.ExitSuccess},
+		{[]string{"-recipe", "test", "-raw"}, subcommands.ExitSuccess},
+	} {
+		args := append([]string{"-root", dir}, tc.args...)
+		if got := executeForTest(t, &showCmd{}, args...); got != tc.want {
+			t.Errorf("show %v: wanted exit status %v, got %v", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestRecipesShowCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestRecipesShowCmd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeRecipeForTest(t, dir)
+
+	for _, tc := range []struct {
+		args []string
+		want subcommands.ExitStatus
+	}{
+		{nil, subcommands.ExitUsageError},
+		{[]string{"test", "other"}, subcommands.ExitUsageError},
+		{[]string{"missing"}, subcommands.ExitFailure},
+		{[]string{"test"}, subcommands.ExitSuccess},
+		{[]string{"-json", "test"}, subcommands.ExitSuccess},
+	} {
+		args := append([]string{"-root", dir}, tc.args...)
+		if got := executeForTest(t, &recipesShowCmd{}, args...); got != tc.want {
+			t.Errorf("recipes show %v: wanted exit status %v, got %v", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestBakeCmdUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestBakeCmdUpgrade")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := path.Join(dir, "recipes")
+	writeRecipeForTest(t, root)
+	out := path.Join(dir, "out")
+
+	if got := executeForTest(t, &bakeCmd{}, "-root", root, "-recipe", "test", "-out", out, "-prefix", "/boot/preppi", "Hostname=pi"); got != subcommands.ExitSuccess {
+		t.Fatalf("wanted bake to succeed, got %v", got)
+	}
+	saved := path.Join(dir, "saved.json")
+	// The recipe root, prefix and variables all come from the manifest.
+	if got := executeForTest(t, &bakeCmd{}, "-upgrade", out, "-save_vars", saved); got != subcommands.ExitSuccess {
+		t.Fatalf("wanted upgrade to succeed, got %v", got)
+	}
+	conf, err := ioutil.ReadFile(path.Join(out, "preppi.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(conf), `"/boot/preppi/etc-hostname"`) {
+		t.Errorf("wanted the upgrade to keep the prefix, got %s", conf)
+	}
+	vars, err := preppi.VarsFromFile(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["Hostname"] != "pi" {
+		t.Errorf("wanted the upgraded variables saved, got %v", vars)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// archiveDir is the directory in an archive holding the baked recipe, so that
+// extracting the archive onto a boot partition yields /boot/preppi.
+const archiveDir = "preppi"
+
+// archiveTime is the modification time of every archive entry, so that the
+// same recipe and vars always produce the same archive. It's the earliest
+// time a zip file can represent.
+var archiveTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// archiveEntry is a file or directory to be written to an archive.
+type archiveEntry struct {
+	name    string
+	dir     bool
+	content []byte
+}
+
+type archiveWriter func(io.Writer, []*archiveEntry) error
+
+// archiveWriterFor returns the writer for the archive format suggested by
+// name's extension, or nil if it's not an archive.
+func archiveWriterFor(name string) archiveWriter {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return writeZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return writeTarGz
+	case strings.HasSuffix(name, ".tar"):
+		return writeTar
+	}
+	return nil
+}
+
+// IsArchive returns true if name has the extension of an archive format
+// which BakeArchive can write: .zip, .tar, .tar.gz or .tgz.
+func IsArchive(name string) bool {
+	return archiveWriterFor(name) != nil
+}
+
+// BakeArchive bakes the recipe into the archive name, whose format is chosen
+// by its extension. The archive holds a single preppi directory, laid out as
+// /boot/preppi should be. o may be nil, and its Output is ignored.
+func (r *Recipe) BakeArchive(name string, d *RecipeData, o *BakeOptions) error {
+	w := archiveWriterFor(name)
+	if w == nil {
+		return fmt.Errorf("can't tell the archive format of %q", name)
+	}
+	opts := &BakeOptions{}
+	if o != nil {
+		*opts = *o
+	}
+	opts.Output = NewMemMapFs()
+	if opts.VarsRecord == "" {
+		opts.VarsRecord = name + VarsRecordExt
+	}
+	record, err := r.bake("/"+archiveDir, d, opts)
+	if err != nil {
+		return err
+	}
+	entries, err := archiveEntries(opts.Output, "/"+archiveDir)
+	if err != nil {
+		return err
+	}
+	// The archive is written beside name and renamed into place, so that a
+	// failed write can't destroy an earlier archive.
+	tmp := bakeSibling(name, "partial")
+	f, err := preppiFS.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := w(f, entries); err != nil {
+		f.Close()
+		preppiFS.Remove(tmp)
+		return fmt.Errorf("failed writing archive %q: %v", name, err)
+	}
+	if err := f.Close(); err != nil {
+		preppiFS.Remove(tmp)
+		return fmt.Errorf("failed writing archive %q: %v", name, err)
+	}
+	if err := preppiFS.Rename(tmp, name); err != nil {
+		preppiFS.Remove(tmp)
+		return err
+	}
+	return record.write()
+}
+
+// archiveEntries collects everything under root in fs, in lexical order, named
+// relative to the parent of root.
+func archiveEntries(fs Fs, root string) ([]*archiveEntry, error) {
+	var entries []*archiveEntry
+	base := path.Dir(root)
+	err := afero.Walk(fs, root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		e := &archiveEntry{
+			name: strings.TrimPrefix(strings.TrimPrefix(p, base), "/"),
+			dir:  info.IsDir(),
+		}
+		if !e.dir {
+			if e.content, err = afero.ReadFile(fs, p); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+func writeZip(w io.Writer, entries []*archiveEntry) error {
+	zw := zip.NewWriter(w)
+	for _, e := range entries {
+		h := &zip.FileHeader{
+			Name:     e.name,
+			Method:   zip.Deflate,
+			Modified: archiveTime,
+		}
+		if e.dir {
+			h.Name += "/"
+			h.Method = zip.Store
+			h.SetMode(os.ModeDir | 0755)
+		} else {
+			h.SetMode(0644)
+		}
+		f, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(e.content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTar(w io.Writer, entries []*archiveEntry) error {
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:    e.name,
+			Mode:    0644,
+			Size:    int64(len(e.content)),
+			ModTime: archiveTime,
+		}
+		if e.dir {
+			h.Name += "/"
+			h.Mode = 0755
+			h.Typeflag = tar.TypeDir
+		} else {
+			h.Typeflag = tar.TypeReg
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if _, err := tw.Write(e.content); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarGz(w io.Writer, entries []*archiveEntry) error {
+	// The gzip header is left without a name or modification time.
+	gw := gzip.NewWriter(w)
+	if err := writeTar(gw, entries); err != nil {
+		return err
+	}
+	return gw.Close()
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestRecipeBakeArchive(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/etc-motd":     &testFile{[]byte("Welcome to {{.Vars.Hostname}}, a very fine host.\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-motd", Destination: "/etc/motd", Vars: []string{"Hostname"}},
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Vars: []string{"Hostname"}},
+		},
+		root: "/recipes/test",
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+
+	wantNames := []string{"preppi/", "preppi/etc-hostname", "preppi/etc-motd", "preppi/preppi.conf", "preppi/preppi.manifest.json"}
+	for _, name := range []string{"/out/pi.zip", "/out/pi.tar", "/out/pi.tar.gz", "/out/pi.tgz"} {
+		if err := r.BakeArchive(name, d, nil); err != nil {
+			t.Fatalf("%v: wanted no error, got: %v", name, err)
+		}
+		first, err := afero.ReadFile(preppiFS, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.BakeArchive(name, d, nil); err != nil {
+			t.Fatal(err)
+		}
+		second, _ := afero.ReadFile(preppiFS, name)
+		if !bytes.Equal(first, second) {
+			t.Errorf("%v: wanted identical archives from identical input", name)
+		}
+
+		contents := readArchiveForTest(t, name, first)
+		if !reflect.DeepEqual(contents.names, wantNames) {
+			t.Errorf("%v: wanted entries %v, got %v", name, wantNames, contents.names)
+		}
+		if got := contents.files["preppi/etc-hostname"]; got != "pi\n" {
+			t.Errorf("%v: wanted rendered ingredient %q, got %q", name, "pi\n", got)
+		}
+	}
+
+	if err := r.BakeArchive("/out/pi.rar", d, nil); err == nil {
+		t.Error("wanted error for unknown archive format")
+	}
+
+	// A failed write leaves the earlier archive alone, and nothing beside it.
+	want, _ := afero.ReadFile(preppiFS, "/out/pi.zip")
+	preppiFS = &fullFs{preppiFS.(*MemMapFs)}
+	d.Vars["Hostname"] = "other"
+	if err := r.BakeArchive("/out/pi.zip", d, nil); err == nil {
+		t.Error("wanted error writing to a full file system")
+	}
+	if got, _ := afero.ReadFile(preppiFS, "/out/pi.zip"); !bytes.Equal(got, want) {
+		t.Error("wanted the earlier archive intact after a failed write")
+	}
+	if exists, _ := afero.Exists(preppiFS, bakeSibling("/out/pi.zip", "partial")); exists {
+		t.Error("wanted no partial archive left behind")
+	}
+}
+
+// fullFs is a MemMapFs on which created files can't be written.
+type fullFs struct {
+	*MemMapFs
+}
+
+func (fs *fullFs) Create(name string) (afero.File, error) {
+	f, err := fs.MemMapFs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &fullFile{f}, nil
+}
+
+type fullFile struct {
+	afero.File
+}
+
+func (f *fullFile) Write(b []byte) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+type archiveContents struct {
+	names []string
+	files map[string]string
+}
+
+func readArchiveForTest(t *testing.T, name string, b []byte) *archiveContents {
+	c := &archiveContents{files: make(map[string]string)}
+	if strings.HasSuffix(name, ".zip") {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		for _, f := range zr.File {
+			if !f.Modified.Equal(archiveTime) {
+				t.Errorf("%v: %v: wanted time %v, got %v", name, f.Name, archiveTime, f.Modified)
+			}
+			c.names = append(c.names, f.Name)
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			content, _ := ioutil.ReadAll(rc)
+			rc.Close()
+			c.files[f.Name] = string(content)
+		}
+		return c
+	}
+
+	var r io.Reader = bytes.NewReader(b)
+	if !strings.HasSuffix(name, ".tar") {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if !h.ModTime.Equal(archiveTime) {
+			t.Errorf("%v: %v: wanted time %v, got %v", name, h.Name, archiveTime, h.ModTime)
+		}
+		c.names = append(c.names, h.Name)
+		content, _ := ioutil.ReadAll(tr)
+		c.files[h.Name] = string(content)
+	}
+	return c
+}
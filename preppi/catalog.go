@@ -0,0 +1,65 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"path"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+// RecipeEntry is a recipe found under a recipe root.
+type RecipeEntry struct {
+	// Name is the name of the recipe's directory, by which it's baked.
+	Name string
+	// Path is the recipe's file.
+	Path string
+	// Recipe is the recipe, resolved, or nil if it couldn't be read.
+	Recipe *Recipe
+	// Err is why the recipe couldn't be read.
+	Err error
+}
+
+// FindRecipes returns the recipes under root, which are its subdirectories
+// holding a recipe.json, sorted by name. Recipes which can't be read are
+// included, with the reason.
+func FindRecipes(root string) ([]*RecipeEntry, error) {
+	infos, err := afero.ReadDir(preppiFS, root)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*RecipeEntry
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		name := path.Join(root, info.Name(), recipeFile)
+		if exists, err := afero.Exists(preppiFS, name); err != nil || !exists {
+			continue
+		}
+		e := &RecipeEntry{Name: info.Name(), Path: name}
+		e.Recipe, e.Err = RecipeFromFile(name)
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindRecipes(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/pi/recipe.json":     &testFile{[]byte(`{"name": "Pi", "description": "A Pi"}`), 0644, 0755, 0, 0},
+		"/recipes/kiosk/recipe.json":  &testFile{[]byte(`{"extends": "pi"}`), 0644, 0755, 0, 0},
+		"/recipes/broken/recipe.json": &testFile{[]byte(`{"name":`), 0644, 0755, 0, 0},
+		"/recipes/partials/header":    &testFile{[]byte("# header\n"), 0644, 0755, 0, 0},
+		"/recipes/README":             &testFile{[]byte("Not a recipe\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	entries, err := FindRecipes("/recipes")
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		if e.Err != nil {
+			got = append(got, e.Name+": error")
+			continue
+		}
+		got = append(got, e.Name+": "+e.Recipe.Description+" at "+e.Path)
+	}
+	want := []string{
+		"broken: error",
+		"kiosk: A Pi at /recipes/kiosk/recipe.json",
+		"pi: A Pi at /recipes/pi/recipe.json",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+	if _, err := FindRecipes("/missing"); err == nil {
+		t.Error("wanted error for missing recipe root")
+	}
+}
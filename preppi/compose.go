@@ -0,0 +1,161 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// recipeFile is the name of the file describing a recipe, in the recipe's
+// directory.
+const recipeFile = "recipe.json"
+
+// RecipeFromFile reads a recipe, along with the recipes it extends or
+// includes, which are found beside it under the same recipe root.
+func RecipeFromFile(name string) (*Recipe, error) {
+	r, err := readRecipeFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.resolve(nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// UnresolvedRecipeFromFile reads a recipe as it's written, naming the recipes
+// it extends or includes rather than merging them.
+func UnresolvedRecipeFromFile(name string) (*Recipe, error) {
+	return readRecipeFile(name)
+}
+
+// readRecipeFile reads a single recipe, as it's written.
+func readRecipeFile(name string) (*Recipe, error) {
+	data, err := afero.ReadFile(preppiFS, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading recipe %q: %v", name, err)
+	}
+	r := &Recipe{
+		root: path.Dir(name),
+	}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("failed reading recipe %q: %v", name, err)
+	}
+	return r, nil
+}
+
+// resolve merges the recipes which r extends and includes into r, in that
+// order, followed by r's own ingredients, variables and partials. An
+// ingredient replaces any earlier one with the same destination, a variable
+// any earlier one of the same name, and a partial any of the same name.
+// parents are the recipes whose resolution led to r.
+func (r *Recipe) resolve(parents []string) error {
+	name := path.Base(r.root)
+	for _, p := range parents {
+		if p == name {
+			return fmt.Errorf("recipe %q includes itself: %v", name, strings.Join(append(parents, name), " -> "))
+		}
+	}
+	parents = append(parents, name)
+	for _, i := range r.Ingredients {
+		if i.root == "" {
+			i.root, i.recipe = r.root, name
+		}
+	}
+
+	bases := r.Include
+	if r.Extends != "" {
+		bases = append([]string{r.Extends}, bases...)
+	}
+	var ingredients []*Ingredient
+	var variables []*Variable
+	var partialDirs []string
+	for _, b := range bases {
+		if b == "" || b == "." || b == ".." || strings.Contains(b, "/") {
+			return fmt.Errorf("recipe %q: invalid recipe name %q", name, b)
+		}
+		base, err := readRecipeFile(path.Join(path.Dir(r.root), b, recipeFile))
+		if err != nil {
+			return err
+		}
+		if err := base.resolve(parents); err != nil {
+			return err
+		}
+		if b == r.Extends && r.Name == "" {
+			r.Name = base.Name
+		}
+		if b == r.Extends && r.Description == "" {
+			r.Description = base.Description
+		}
+		ingredients = mergeIngredients(ingredients, base.Ingredients)
+		variables = mergeVariables(variables, base.Variables)
+		partialDirs = append(partialDirs, base.partialDirs...)
+	}
+	r.Ingredients = mergeIngredients(ingredients, r.Ingredients)
+	r.Variables = mergeVariables(variables, r.Variables)
+	r.partialDirs = append(partialDirs, path.Join(r.root, partialsDir))
+	r.Extends, r.Include = "", nil
+	return nil
+}
+
+// mergeIngredients returns base with the ingredients of over appended, or
+// replacing those of base with the same destination.
+func mergeIngredients(base, over []*Ingredient) []*Ingredient {
+	merged := append([]*Ingredient{}, base...)
+	index := make(map[string]int)
+	for n, i := range merged {
+		index[path.Clean(i.Destination)] = n
+	}
+	for _, i := range over {
+		dest := path.Clean(i.Destination)
+		if n, ok := index[dest]; ok {
+			merged[n] = i
+			continue
+		}
+		index[dest] = len(merged)
+		merged = append(merged, i)
+	}
+	return merged
+}
+
+// mergeVariables returns base with the variables of over appended, or
+// replacing those of base with the same name.
+func mergeVariables(base, over []*Variable) []*Variable {
+	merged := append([]*Variable{}, base...)
+	index := make(map[string]int)
+	for n, v := range merged {
+		index[v.Name] = n
+	}
+	for _, v := range over {
+		if n, ok := index[v.Name]; ok {
+			merged[n] = v
+			continue
+		}
+		index[v.Name] = len(merged)
+		merged = append(merged, v)
+	}
+	return merged
+}
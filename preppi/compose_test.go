@@ -0,0 +1,151 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestRecipeFromFileResolves(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/base/recipe.json": &testFile{[]byte(`{
+			"name": "Base",
+			"variables": [{"name": "Hostname", "type": "hostname"}, {"name": "Domain", "default": "local"}],
+			"ingredients": [
+				{"source": "etc-hostname", "destination": "/etc/hostname", "vars": ["Hostname"]},
+				{"source": "etc-hosts", "destination": "/etc/hosts", "vars": ["Hostname", "Domain"]}
+			]
+		}`), 0644, 0755, 0, 0},
+		"/recipes/base/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+		"/recipes/base/etc-hosts":    &testFile{[]byte("127.0.1.1 {{.Vars.Hostname}}.{{.Vars.Domain}}\n"), 0644, 0755, 0, 0},
+		"/recipes/wifi/recipe.json": &testFile{[]byte(`{
+			"name": "WiFi",
+			"variables": [{"name": "SSID"}],
+			"ingredients": [{"source": "wpa_supplicant.conf", "destination": "/etc/wpa_supplicant/wpa_supplicant.conf", "vars": ["SSID"]}]
+		}`), 0644, 0755, 0, 0},
+		"/recipes/wifi/wpa_supplicant.conf": &testFile{[]byte("ssid={{wpaquote .Vars.SSID}}\n"), 0644, 0755, 0, 0},
+		"/recipes/kiosk/recipe.json": &testFile{[]byte(`{
+			"extends": "base",
+			"include": ["wifi"],
+			"variables": [{"name": "Domain", "default": "kiosk.example.com"}],
+			"ingredients": [{"source": "etc-hosts", "destination": "/etc/hosts", "vars": ["Hostname"]}]
+		}`), 0644, 0755, 0, 0},
+		"/recipes/kiosk/etc-hosts": &testFile{[]byte("127.0.1.1 {{.Vars.Hostname}} kiosk\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	r, err := RecipeFromFile("/recipes/kiosk/recipe.json")
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if r.Name != "Base" {
+		t.Errorf("wanted name inherited from extended recipe, got %q", r.Name)
+	}
+	var got []string
+	for _, i := range r.Ingredients {
+		got = append(got, i.From()+":"+i.Destination)
+	}
+	want := []string{"base:/etc/hostname", "kiosk:/etc/hosts", "wifi:/etc/wpa_supplicant/wpa_supplicant.conf"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted ingredients %v, got %v", want, got)
+	}
+	got = nil
+	for _, v := range r.Variables {
+		def := ""
+		if v.Default != nil {
+			def = *v.Default
+		}
+		got = append(got, v.Name+"="+def)
+	}
+	want = []string{"Hostname=", "Domain=kiosk.example.com", "SSID="}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted variables %v, got %v", want, got)
+	}
+
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi", "SSID": "home"}}
+	if err := r.Bake("/out", d, nil); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	for name, want := range map[string]string{
+		"/out/etc-hostname":        "pi\n",
+		"/out/etc-hosts":           "127.0.1.1 pi kiosk\n",
+		"/out/wpa_supplicant.conf": "ssid=\"home\"\n",
+	} {
+		if got, err := afero.ReadFile(preppiFS, name); err != nil || string(got) != want {
+			t.Errorf("%v: wanted %q, got %q, %v", name, want, got, err)
+		}
+	}
+	for _, p := range r.Lint() {
+		if !p.Warning {
+			t.Errorf("wanted no lint errors, got: %v", p)
+		}
+	}
+}
+
+func TestRecipeFromFileCycle(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/a/recipe.json":  &testFile{[]byte(`{"extends": "b"}`), 0644, 0755, 0, 0},
+		"/recipes/b/recipe.json":  &testFile{[]byte(`{"include": ["a"]}`), 0644, 0755, 0, 0},
+		"/recipes/c/recipe.json":  &testFile{[]byte(`{"extends": "../a"}`), 0644, 0755, 0, 0},
+		"/recipes/d/recipe.json":  &testFile{[]byte(`{"include": ["missing"]}`), 0644, 0755, 0, 0},
+		"/recipes/ok/recipe.json": &testFile{[]byte(`{"include": ["e", "e"]}`), 0644, 0755, 0, 0},
+		"/recipes/e/recipe.json":  &testFile{[]byte(`{"ingredients": [{"source": "x", "destination": "/x"}]}`), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	_, err := RecipeFromFile("/recipes/a/recipe.json")
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Errorf("wanted error naming the cycle, got: %v", err)
+	}
+	for _, name := range []string{"c", "d"} {
+		if _, err := RecipeFromFile("/recipes/" + name + "/recipe.json"); err == nil {
+			t.Errorf("%v: wanted error", name)
+		}
+	}
+	// Including the same recipe twice isn't a cycle.
+	r, err := RecipeFromFile("/recipes/ok/recipe.json")
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if len(r.Ingredients) != 1 {
+		t.Errorf("wanted 1 ingredient, got %d", len(r.Ingredients))
+	}
+	// Unresolved, a recipe just names what it extends.
+	r, err = UnresolvedRecipeFromFile("/recipes/a/recipe.json")
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if r.Extends != "b" {
+		t.Errorf("wanted recipe extending b, got %q", r.Extends)
+	}
+}
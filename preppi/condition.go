@@ -0,0 +1,107 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Condition selects the devices to which a Mapping applies, so that a single
+// preppi.conf can carry sections for many devices. Every field which is set
+// must match. Facts are compared case-insensitively.
+type Condition struct {
+	// CPUSerial matches the CPU serial number.
+	CPUSerial string `json:"cpu_serial,omitempty"`
+	// MAC matches the hardware address of any network interface.
+	MAC string `json:"mac,omitempty"`
+	// Model matches any board model containing it, eg "Pi 3".
+	Model string `json:"model,omitempty"`
+	// Hostname matches the current hostname.
+	Hostname string `json:"hostname,omitempty"`
+	// FileExists matches when the named file exists.
+	FileExists string `json:"file_exists,omitempty"`
+	// Vars match when each named variable has the given value.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// Match reports whether the condition holds for d. When it doesn't, the reason
+// is described.
+func (c *Condition) Match(d *RecipeData) (bool, string, error) {
+	facts := &Facts{}
+	var vars map[string]string
+	if d != nil {
+		if d.Facts != nil {
+			facts = d.Facts
+		}
+		vars = d.Vars
+	}
+
+	if c.CPUSerial != "" && !strings.EqualFold(c.CPUSerial, facts.CPUSerial) {
+		return false, fmt.Sprintf("cpu_serial is %q, wanted %q", facts.CPUSerial, c.CPUSerial), nil
+	}
+	if c.MAC != "" && !hasMAC(facts, c.MAC) {
+		return false, fmt.Sprintf("no interface has mac %q", c.MAC), nil
+	}
+	if c.Model != "" && !strings.Contains(strings.ToLower(facts.Model), strings.ToLower(c.Model)) {
+		return false, fmt.Sprintf("model is %q, wanted %q", facts.Model, c.Model), nil
+	}
+	if c.Hostname != "" && !strings.EqualFold(c.Hostname, facts.Hostname) {
+		return false, fmt.Sprintf("hostname is %q, wanted %q", facts.Hostname, c.Hostname), nil
+	}
+	if c.FileExists != "" {
+		_, err := preppiFS.Stat(c.FileExists)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				return false, "", err
+			}
+			return false, fmt.Sprintf("%q doesn't exist", c.FileExists), nil
+		}
+	}
+	// Check vars in order, so the reason is deterministic.
+	names := make([]string, 0, len(c.Vars))
+	for name := range c.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		got, ok := vars[name]
+		if !ok {
+			return false, fmt.Sprintf("var %q is not set", name), nil
+		}
+		if got != c.Vars[name] {
+			return false, fmt.Sprintf("var %q is %q, wanted %q", name, got, c.Vars[name]), nil
+		}
+	}
+	return true, "", nil
+}
+
+// hasMAC is true when any of the device's interfaces has the address mac.
+func hasMAC(facts *Facts, mac string) bool {
+	for _, addr := range facts.MACAddresses {
+		if strings.EqualFold(addr, mac) {
+			return true
+		}
+	}
+	return false
+}
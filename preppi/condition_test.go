@@ -0,0 +1,85 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import "testing"
+
+func TestConditionMatch(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/etc/flag": &testFile{Content: []byte("present")},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	d := &RecipeData{
+		Vars: map[string]string{"Role": "kiosk"},
+		Facts: &Facts{
+			CPUSerial:    "00000000deadbeef",
+			Model:        "Raspberry Pi 3 Model B Rev 1.2",
+			Hostname:     "raspberrypi",
+			MACAddresses: map[string]string{"eth0": "b8:27:eb:00:00:01"},
+		},
+	}
+
+	for _, tt := range []struct {
+		name string
+		cond *Condition
+		want bool
+	}{
+		{name: "empty", cond: &Condition{}, want: true},
+		{name: "serial", cond: &Condition{CPUSerial: "00000000DEADBEEF"}, want: true},
+		{name: "wrong serial", cond: &Condition{CPUSerial: "00000000cafef00d"}},
+		{name: "mac", cond: &Condition{MAC: "B8:27:EB:00:00:01"}, want: true},
+		{name: "wrong mac", cond: &Condition{MAC: "b8:27:eb:00:00:02"}},
+		{name: "model", cond: &Condition{Model: "pi 3"}, want: true},
+		{name: "wrong model", cond: &Condition{Model: "Pi Zero"}},
+		{name: "hostname", cond: &Condition{Hostname: "raspberrypi"}, want: true},
+		{name: "wrong hostname", cond: &Condition{Hostname: "kiosk1"}},
+		{name: "file exists", cond: &Condition{FileExists: "/etc/flag"}, want: true},
+		{name: "file doesn't exist", cond: &Condition{FileExists: "/etc/nope"}},
+		{name: "var", cond: &Condition{Vars: map[string]string{"Role": "kiosk"}}, want: true},
+		{name: "wrong var", cond: &Condition{Vars: map[string]string{"Role": "server"}}},
+		{name: "missing var", cond: &Condition{Vars: map[string]string{"Site": "home"}}},
+		{
+			name: "all match",
+			cond: &Condition{CPUSerial: "00000000deadbeef", Model: "Pi 3", Vars: map[string]string{"Role": "kiosk"}},
+			want: true,
+		},
+		{
+			name: "one doesn't match",
+			cond: &Condition{CPUSerial: "00000000deadbeef", Model: "Pi Zero"},
+		},
+	} {
+		got, why, err := tt.cond.Match(d)
+		if err != nil {
+			t.Fatalf("%v: wanted no error, got: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: wanted %v, got %v", tt.name, tt.want, got)
+		}
+		if !got && why == "" {
+			t.Errorf("%v: wanted a reason for not matching", tt.name)
+		}
+	}
+}
@@ -0,0 +1,471 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"strconv"
+)
+
+// cryptAlphabet is the base64 alphabet of crypt(3).
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// HashPassword hashes password for /etc/shadow with a random salt. method is
+// "yescrypt", as used by current Raspberry Pi OS, or "sha512crypt", which
+// older releases understand.
+func HashPassword(method, password string) (string, error) {
+	switch method {
+	case "yescrypt":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		return yescryptHash([]byte(password), salt), nil
+	case "sha512crypt":
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		for i, b := range salt {
+			salt[i] = cryptAlphabet[b&0x3f]
+		}
+		return sha512Crypt([]byte(password), salt, sha512CryptRounds), nil
+	}
+	return "", fmt.Errorf("unknown password hash method %q", method)
+}
+
+// sha512CryptRounds is the default, and so implicit, number of SHA-512-crypt
+// rounds.
+const sha512CryptRounds = 5000
+
+// sha512Crypt implements SHA-512-crypt, "$6$", as specified by Ulrich Drepper
+// in "Unix crypt using SHA-256 and SHA-512".
+func sha512Crypt(password, salt []byte, rounds int) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	alt := sha512.New()
+	alt.Write(password)
+	alt.Write(salt)
+	alt.Write(password)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(salt)
+	i := len(password)
+	for ; i > 64; i -= 64 {
+		a.Write(altSum)
+	}
+	a.Write(altSum[:i])
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(password)
+		}
+	}
+	c := a.Sum(nil)
+
+	dp := sha512.New()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeatBytes(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(c[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeatBytes(ds.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(c[:0])
+	}
+
+	out := []byte("$6$")
+	if rounds != sha512CryptRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt...)
+	out = append(out, '$')
+	for i := 0; i < 21; i++ {
+		// The bytes are taken in a fixed, interleaved order.
+		b2, b1, b0 := c[(i*22)%63], c[(i*22+21)%63], c[(i*22+42)%63]
+		out = appendCrypt64(out, uint32(b2)<<16|uint32(b1)<<8|uint32(b0), 4)
+	}
+	out = appendCrypt64(out, uint32(c[63]), 2)
+	return string(out)
+}
+
+// repeatBytes returns b repeated to n bytes.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b...)
+	}
+	return out[:n]
+}
+
+// appendCrypt64 appends the n least significant 6-bit groups of v, least
+// significant first.
+func appendCrypt64(out []byte, v uint32, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[v&0x3f])
+		v >>= 6
+	}
+	return out
+}
+
+// yescrypt parameters, those of libxcrypt's default cost: N = 4096, r = 32,
+// p = 1, with the default read-write flavor.
+const (
+	yescryptNLog2 = 12
+	yescryptR     = 32
+
+	yescryptRW      = 0x002
+	yescryptFlavor  = 0x0b6 // RW, 6 rounds, gather 4, simple 2, 12 KiB S-boxes.
+	yescryptPrehash = 0x10000000
+
+	pwxSimple = 2
+	pwxGather = 4
+	pwxRounds = 6
+	pwxWords  = pwxGather * pwxSimple * 2
+	sWidth    = 8
+	sPairs    = (1 << sWidth) * pwxSimple
+	sWords    = 3 * sPairs * 2
+	sMask     = ((1 << sWidth) - 1) * pwxSimple * 8
+)
+
+// yescryptHash implements the yescrypt password hashing scheme, "$y$", of
+// Solar Designer's reference implementation, for a single set of parameters.
+func yescryptHash(password, salt []byte) string {
+	n := uint32(1) << yescryptNLog2
+	// Large hashes are first computed at 1/64th of the cost, and that hash used
+	// as the password.
+	dk := yescryptKDF(password, salt, n>>6, yescryptR, yescryptFlavor|yescryptPrehash)
+	hash := yescryptKDF(dk, salt, n, yescryptR, yescryptFlavor)
+
+	out := []byte("$y$")
+	out = append(out, cryptAlphabet[2+(yescryptFlavor-yescryptRW)>>2])
+	out = append(out, cryptAlphabet[yescryptNLog2-1], cryptAlphabet[yescryptR-1], '$')
+	out = appendYescrypt64(out, salt)
+	out = append(out, '$')
+	return string(appendYescrypt64(out, hash))
+}
+
+// appendYescrypt64 appends b in yescrypt's encoding: little-endian groups of
+// three bytes, each as four characters, least significant first.
+func appendYescrypt64(out, b []byte) []byte {
+	for i := 0; i < len(b); i += 3 {
+		var v uint32
+		n := 0
+		for j := 0; j < 3 && i+j < len(b); j++ {
+			v |= uint32(b[i+j]) << uint(8*j)
+			n += 8
+		}
+		out = appendCrypt64(out, v, (n+5)/6)
+	}
+	return out
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 is PBKDF2 with HMAC-SHA-256 and a single iteration, all that
+// yescrypt needs.
+func pbkdf2SHA256(password, salt []byte, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	for block := uint32(1); len(out) < n; block++ {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], block)
+		out = append(out, hmacSHA256(password, append(append([]byte{}, salt...), b[:]...))...)
+	}
+	return out[:n]
+}
+
+// yescryptKDF derives a 32 byte key, with p = 1 and t = 0.
+func yescryptKDF(password, salt []byte, n, r uint32, flags int) []byte {
+	key := "yescrypt"
+	if flags&yescryptPrehash != 0 {
+		key = "yescrypt-prehash"
+	}
+	password = hmacSHA256([]byte(key), password)
+
+	s := 32 * r
+	b := pbkdf2SHA256(password, salt, int(128*r))
+	password = append([]byte{}, b[:32]...)
+	bw := make([]uint32, s)
+	for i := range bw {
+		bw[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+
+	v := make([]uint32, n*s)
+	xy := make([]uint32, 2*s)
+	sbox := make([]uint32, sWords)
+	password = yescryptSMix(bw, r, n, flags, v, xy, sbox, password)
+
+	for i, w := range bw {
+		binary.LittleEndian.PutUint32(b[i*4:], w)
+	}
+	dk := pbkdf2SHA256(password, b, 32)
+	if flags&yescryptPrehash != 0 {
+		return dk
+	}
+	// The final steps are those of SCRAM's StoredKey.
+	clientKey := hmacSHA256(dk, []byte("Client Key"))
+	stored := sha256.Sum256(clientKey)
+	return stored[:]
+}
+
+// yescryptSMix mixes b, returning the updated password.
+func yescryptSMix(b []uint32, r, n uint32, flags int, v, xy, sbox []uint32, password []byte) []byte {
+	s := 32 * r
+	// With t = 0, the read-write loop runs a third as many times as the first.
+	nloopRW := ((n+2)/3 + 1) &^ 1
+
+	// Fill the S-boxes using classic scrypt.
+	yescryptSMix1(b, 1, sWords/32, 0, sbox, xy, nil)
+	ctx := &pwxformCtx{
+		s2: sbox[:2*sPairs],
+		s1: sbox[2*sPairs : 4*sPairs],
+		s0: sbox[4*sPairs:],
+	}
+	last := make([]byte, 64)
+	for i, w := range b[s-16 : s] {
+		binary.LittleEndian.PutUint32(last[i*4:], w)
+	}
+	password = hmacSHA256(last, password)
+
+	yescryptSMix1(b, r, n, flags, v, xy, ctx)
+	yescryptSMix2(b, r, p2floor(n), nloopRW, flags, v, xy, ctx)
+	return password
+}
+
+func p2floor(x uint32) uint32 {
+	return 1 << uint(31-bits.LeadingZeros32(x))
+}
+
+// wrap returns x modulo the largest power of two at most i, offset into the
+// top of [0, i).
+func wrap(x uint64, i uint32) uint32 {
+	n := p2floor(i)
+	return uint32(x&uint64(n-1)) + (i - n)
+}
+
+// integerify returns the first 64 bits of the last 64 byte block of x, which
+// is SIMD-shuffled.
+func integerify(x []uint32, r uint32) uint64 {
+	last := x[(2*r-1)*16:]
+	return uint64(last[13])<<32 | uint64(last[0])
+}
+
+// shuffle copies b into x, SIMD-shuffling each 64 byte block, as the
+// reference implementation works on.
+func shuffle(x, b []uint32) {
+	for k := 0; k < len(b); k += 16 {
+		for i := 0; i < 16; i++ {
+			x[k+i] = b[k+(i*5%16)]
+		}
+	}
+}
+
+func unshuffle(b, x []uint32) {
+	for k := 0; k < len(b); k += 16 {
+		for i := 0; i < 16; i++ {
+			b[k+(i*5%16)] = x[k+i]
+		}
+	}
+}
+
+func yescryptSMix1(b []uint32, r, n uint32, flags int, v, xy []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	x, y := xy[:s], xy[s:2*s]
+	shuffle(x, b[:s])
+	for i := uint32(0); i < n; i++ {
+		copy(v[i*s:(i+1)*s], x)
+		if flags&yescryptRW != 0 && i > 1 {
+			j := wrap(integerify(x, r), i)
+			blkxor(x, v[j*s:(j+1)*s])
+		}
+		blockmix(x, y, r, ctx)
+	}
+	unshuffle(b[:s], x)
+}
+
+func yescryptSMix2(b []uint32, r, n, nloop uint32, flags int, v, xy []uint32, ctx *pwxformCtx) {
+	s := 32 * r
+	x, y := xy[:s], xy[s:2*s]
+	shuffle(x, b[:s])
+	for i := uint32(0); i < nloop; i++ {
+		j := uint32(integerify(x, r)) & (n - 1)
+		blkxor(x, v[j*s:(j+1)*s])
+		if flags&yescryptRW != 0 {
+			copy(v[j*s:(j+1)*s], x)
+		}
+		blockmix(x, y, r, ctx)
+	}
+	unshuffle(b[:s], x)
+}
+
+func blkxor(dst, src []uint32) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
+
+func blockmix(b, y []uint32, r uint32, ctx *pwxformCtx) {
+	if ctx == nil {
+		blockmixSalsa8(b, y, r)
+		return
+	}
+	// Each pwxform block is 64 bytes, so there are 2r of them.
+	x := make([]uint32, pwxWords)
+	r1 := 2 * r
+	copy(x, b[(r1-1)*pwxWords:])
+	for i := uint32(0); i < r1; i++ {
+		if r1 > 1 {
+			blkxor(x, b[i*pwxWords:(i+1)*pwxWords])
+		}
+		ctx.pwxform(x)
+		copy(b[i*pwxWords:], x)
+	}
+	salsa20(b[(r1-1)*16:r1*16], 2)
+}
+
+func blockmixSalsa8(b, y []uint32, r uint32) {
+	var x [16]uint32
+	copy(x[:], b[(2*r-1)*16:])
+	for i := uint32(0); i < 2*r; i++ {
+		blkxor(x[:], b[i*16:(i+1)*16])
+		salsa20(x[:], 8)
+		copy(y[i*16:], x[:])
+	}
+	for i := uint32(0); i < r; i++ {
+		copy(b[i*16:(i+1)*16], y[(2*i)*16:])
+		copy(b[(i+r)*16:(i+r+1)*16], y[(2*i+1)*16:])
+	}
+}
+
+// salsa20 applies the Salsa20 core with the given number of rounds to the
+// SIMD-shuffled block b.
+func salsa20(b []uint32, rounds int) {
+	var x [16]uint32
+	for i := 0; i < 16; i++ {
+		x[i*5%16] = b[i]
+	}
+	rl := bits.RotateLeft32
+	for i := 0; i < rounds; i += 2 {
+		// Columns.
+		x[4] ^= rl(x[0]+x[12], 7)
+		x[8] ^= rl(x[4]+x[0], 9)
+		x[12] ^= rl(x[8]+x[4], 13)
+		x[0] ^= rl(x[12]+x[8], 18)
+		x[9] ^= rl(x[5]+x[1], 7)
+		x[13] ^= rl(x[9]+x[5], 9)
+		x[1] ^= rl(x[13]+x[9], 13)
+		x[5] ^= rl(x[1]+x[13], 18)
+		x[14] ^= rl(x[10]+x[6], 7)
+		x[2] ^= rl(x[14]+x[10], 9)
+		x[6] ^= rl(x[2]+x[14], 13)
+		x[10] ^= rl(x[6]+x[2], 18)
+		x[3] ^= rl(x[15]+x[11], 7)
+		x[7] ^= rl(x[3]+x[15], 9)
+		x[11] ^= rl(x[7]+x[3], 13)
+		x[15] ^= rl(x[11]+x[7], 18)
+		// Rows.
+		x[1] ^= rl(x[0]+x[3], 7)
+		x[2] ^= rl(x[1]+x[0], 9)
+		x[3] ^= rl(x[2]+x[1], 13)
+		x[0] ^= rl(x[3]+x[2], 18)
+		x[6] ^= rl(x[5]+x[4], 7)
+		x[7] ^= rl(x[6]+x[5], 9)
+		x[4] ^= rl(x[7]+x[6], 13)
+		x[5] ^= rl(x[4]+x[7], 18)
+		x[11] ^= rl(x[10]+x[9], 7)
+		x[8] ^= rl(x[11]+x[10], 9)
+		x[9] ^= rl(x[8]+x[11], 13)
+		x[10] ^= rl(x[9]+x[8], 18)
+		x[12] ^= rl(x[15]+x[14], 7)
+		x[13] ^= rl(x[12]+x[15], 9)
+		x[14] ^= rl(x[13]+x[12], 13)
+		x[15] ^= rl(x[14]+x[13], 18)
+	}
+	for i := 0; i < 16; i++ {
+		b[i] += x[i*5%16]
+	}
+}
+
+// pwxformCtx holds yescrypt's three S-boxes, as pairs of 32-bit words, and
+// the write position in s2.
+type pwxformCtx struct {
+	s0, s1, s2 []uint32
+	w          uint32
+}
+
+func (c *pwxformCtx) pwxform(b []uint32) {
+	for i := 0; i < pwxRounds; i++ {
+		for j := 0; j < pwxGather; j++ {
+			x := b[j*pwxSimple*2:]
+			p0 := (x[0] & sMask) / 8
+			p1 := (x[1] & sMask) / 8
+			for k := uint32(0); k < pwxSimple; k++ {
+				s0 := uint64(c.s0[(p0+k)*2+1])<<32 | uint64(c.s0[(p0+k)*2])
+				s1 := uint64(c.s1[(p1+k)*2+1])<<32 | uint64(c.s1[(p1+k)*2])
+				v := uint64(x[k*2+1])*uint64(x[k*2]) + s0
+				v ^= s1
+				x[k*2], x[k*2+1] = uint32(v), uint32(v>>32)
+				if i != 0 && i != pwxRounds-1 {
+					c.s2[c.w*2], c.s2[c.w*2+1] = uint32(v), uint32(v>>32)
+					c.w++
+				}
+			}
+		}
+	}
+	c.s0, c.s1, c.s2 = c.s2, c.s0, c.s1
+	c.w &= sPairs - 1
+}
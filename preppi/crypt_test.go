@@ -0,0 +1,88 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The expected hashes were produced by libxcrypt's crypt(3).
+
+func TestSHA512Crypt(t *testing.T) {
+	for _, tt := range []struct {
+		password, salt string
+		rounds         int
+		want           string
+	}{
+		{"password", "saltsalt", 5000, "$6$saltsalt$qFmFH.bQmmtXzyBY0s9v7Oicd2z4XSIecDzlB5KiA2/jctKu9YterLp8wwnSq.qc.eoxqOmSuNp2xS0ktL3nh/"},
+		{"", "abcdefghijklmnopqrst", 5000, "$6$abcdefghijklmnop$6.vC8ffobuN7AxcHvesxeeksF2DXFfpYyFt3PFU8pYpEQPhWFSN7hwaUQRfHg/LkfB3jIPEitUcU7ZTqjaQUp1"},
+		{strings.Repeat("x", 100), "pi", 1000, "$6$rounds=1000$pi$K1h149hRtvlYlik.f..UHdp/9VzY23reDhqTZJZ.HOQjp2O2Zom3Ix5osP9LYha82Um38JrMi2zMEPJhzBKpy0"},
+	} {
+		if got := sha512Crypt([]byte(tt.password), []byte(tt.salt), tt.rounds); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q, %d): wanted %q, got %q", tt.password, tt.salt, tt.rounds, tt.want, got)
+		}
+	}
+}
+
+func TestYescrypt(t *testing.T) {
+	salt := make([]byte, 16)
+	for i := range salt {
+		salt[i] = byte(i)
+	}
+	for _, tt := range []struct {
+		password, want string
+	}{
+		{"password", "$y$j9T$.2U.1EE/4Q.07ck0AoU1D.$oTWzmC2x.N26ebvBUewT97nMFz0Ppuhjrf1cD6RWPLA"},
+		{"", "$y$j9T$.2U.1EE/4Q.07ck0AoU1D.$SmJZIbjHRp4Z4W4wxy1fs7FwUQaU7p33Xm6oOyuYI22"},
+		{"raspberry pi ✓", "$y$j9T$.2U.1EE/4Q.07ck0AoU1D.$pTvK2Alxjb455WZYBPnOzWEHgM6xqlPfLjxYwniBIL5"},
+	} {
+		if got := yescryptHash([]byte(tt.password), salt); got != tt.want {
+			t.Errorf("yescryptHash(%q): wanted %q, got %q", tt.password, tt.want, got)
+		}
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	for method, pattern := range map[string]string{
+		"sha512crypt": `^\$6\$[./0-9A-Za-z]{16}\$[./0-9A-Za-z]{86}$`,
+		"yescrypt":    `^\$y\$j9T\$[./0-9A-Za-z]{22}\$[./0-9A-Za-z]{43}$`,
+	} {
+		first, err := HashPassword(method, "raspberry")
+		if err != nil {
+			t.Fatalf("%v: wanted no error, got: %v", method, err)
+		}
+		if !regexp.MustCompile(pattern).MatchString(first) {
+			t.Errorf("%v: wanted hash matching %v, got %q", method, pattern, first)
+		}
+		second, err := HashPassword(method, "raspberry")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == second {
+			t.Errorf("%v: wanted random salts, got %q twice", method, first)
+		}
+	}
+	if _, err := HashPassword("md5crypt", "raspberry"); err == nil {
+		t.Error("wanted error for unknown method")
+	}
+}
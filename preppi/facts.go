@@ -0,0 +1,223 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Locations from which facts are read.
+const (
+	cpuinfoPath    = "/proc/cpuinfo"
+	meminfoPath    = "/proc/meminfo"
+	modelPath      = "/proc/device-tree/model"
+	netClassPath   = "/sys/class/net"
+	osReleasePath  = "/etc/os-release"
+	hostnamePath   = "/etc/hostname"
+	noHardwareAddr = "00:00:00:00:00:00"
+)
+
+// Facts describe the device on which PrepPi is running. Facts which can't be
+// determined are left empty.
+type Facts struct {
+	// Hostname is the content of /etc/hostname.
+	Hostname string `json:"hostname"`
+	// Model is the board model, eg "Raspberry Pi 3 Model B Rev 1.2".
+	Model string `json:"model"`
+
+	// CPUSerial, CPUHardware, CPURevision and CPUModel are read from
+	// /proc/cpuinfo. On a Raspberry Pi, the serial uniquely identifies the
+	// board.
+	CPUSerial   string `json:"cpu_serial"`
+	CPUHardware string `json:"cpu_hardware"`
+	CPURevision string `json:"cpu_revision"`
+	CPUModel    string `json:"cpu_model"`
+	// CPUCount is the number of processors.
+	CPUCount int `json:"cpu_count"`
+
+	// MemTotal is the total usable RAM, in bytes.
+	MemTotal uint64 `json:"mem_total"`
+
+	// MACAddresses maps network interface names to their hardware addresses.
+	MACAddresses map[string]string `json:"mac_addresses"`
+
+	// OSRelease holds the variables from /etc/os-release, eg ID and VERSION_ID.
+	OSRelease map[string]string `json:"os_release"`
+}
+
+// readFact reads a file for a fact. A file which doesn't exist is not an error,
+// and results in nil content.
+func readFact(name string) ([]byte, error) {
+	b, err := afero.ReadFile(preppiFS, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return b, nil
+}
+
+// splitFact splits a "key: value" or "key=value" line around sep, trimming
+// whitespace from both halves.
+func splitFact(line, sep string) (string, string, bool) {
+	i := strings.Index(line, sep)
+	if i < 0 {
+		return "", "", false
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+len(sep):]), true
+}
+
+func (f *Facts) parseCPUInfo(b []byte) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		k, v, ok := splitFact(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		switch k {
+		case "processor":
+			f.CPUCount++
+		case "model name":
+			// Repeated for each processor, the first will do.
+			if f.CPUModel == "" {
+				f.CPUModel = v
+			}
+		case "Hardware":
+			f.CPUHardware = v
+		case "Revision":
+			f.CPURevision = v
+		case "Serial":
+			f.CPUSerial = v
+		}
+	}
+}
+
+func (f *Facts) parseMemInfo(b []byte) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		k, v, ok := splitFact(s.Text(), ":")
+		if !ok || k != "MemTotal" {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(v, " kB"), 10, 64)
+		if err == nil {
+			f.MemTotal = n * 1024
+		}
+		return
+	}
+}
+
+func (f *Facts) parseOSRelease(b []byte) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := splitFact(line, "=")
+		if !ok {
+			continue
+		}
+		f.OSRelease[k] = unquoteShell(v)
+	}
+}
+
+// unquoteShell removes the quoting from a simple shell-style value, as used in
+// /etc/os-release.
+func unquoteShell(v string) string {
+	if len(v) < 2 {
+		return v
+	}
+	switch {
+	case v[0] == '\'' && v[len(v)-1] == '\'':
+		return v[1 : len(v)-1]
+	case v[0] == '"' && v[len(v)-1] == '"':
+		v = v[1 : len(v)-1]
+		var b strings.Builder
+		for i := 0; i < len(v); i++ {
+			if v[i] == '\\' && i+1 < len(v) {
+				i++
+			}
+			b.WriteByte(v[i])
+		}
+		return b.String()
+	}
+	return v
+}
+
+// collectMACAddresses reads the hardware address of each network interface.
+func (f *Facts) collectMACAddresses() error {
+	ifaces, err := afero.ReadDir(preppiFS, netClassPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, iface := range ifaces {
+		b, err := readFact(path.Join(netClassPath, iface.Name(), "address"))
+		if err != nil {
+			return err
+		}
+		addr := strings.ToLower(strings.TrimSpace(string(b)))
+		if addr == "" || addr == noHardwareAddr {
+			continue
+		}
+		f.MACAddresses[iface.Name()] = addr
+	}
+	return nil
+}
+
+// CollectFacts gathers Facts about the running device.
+func CollectFacts() (*Facts, error) {
+	f := &Facts{
+		MACAddresses: make(map[string]string),
+		OSRelease:    make(map[string]string),
+	}
+	for _, fact := range []struct {
+		name  string
+		parse func([]byte)
+	}{
+		{cpuinfoPath, f.parseCPUInfo},
+		{meminfoPath, f.parseMemInfo},
+		{osReleasePath, f.parseOSRelease},
+		{modelPath, func(b []byte) { f.Model = strings.TrimSpace(strings.TrimRight(string(b), "\x00")) }},
+		{hostnamePath, func(b []byte) { f.Hostname = strings.TrimSpace(string(b)) }},
+	} {
+		b, err := readFact(fact.name)
+		if err != nil {
+			return nil, err
+		}
+		fact.parse(b)
+	}
+	if err := f.collectMACAddresses(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
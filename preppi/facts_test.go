@@ -0,0 +1,104 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollectFacts(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		cpuinfoPath: &testFile{Content: []byte(`processor	: 0
+model name	: ARMv7 Processor rev 4 (v7l)
+BogoMIPS	: 38.40
+
+processor	: 1
+model name	: ARMv7 Processor rev 4 (v7l)
+BogoMIPS	: 38.40
+
+Hardware	: BCM2835
+Revision	: a02082
+Serial		: 00000000deadbeef
+`)},
+		meminfoPath: &testFile{Content: []byte("MemTotal:         948304 kB\nMemFree:          777528 kB\n")},
+		modelPath:   &testFile{Content: []byte("Raspberry Pi 3 Model B Rev 1.2\x00")},
+		osReleasePath: &testFile{Content: []byte(`PRETTY_NAME="Raspbian GNU/Linux 9 (stretch)"
+# A comment
+ID=raspbian
+VERSION_ID="9"
+`)},
+		hostnamePath:                   &testFile{Content: []byte("raspberrypi\n")},
+		"/sys/class/net/eth0/address":  &testFile{Content: []byte("B8:27:EB:00:00:01\n")},
+		"/sys/class/net/wlan0/address": &testFile{Content: []byte("b8:27:eb:00:00:02\n")},
+		"/sys/class/net/lo/address":    &testFile{Content: []byte("00:00:00:00:00:00\n")},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	want := &Facts{
+		Hostname:    "raspberrypi",
+		Model:       "Raspberry Pi 3 Model B Rev 1.2",
+		CPUSerial:   "00000000deadbeef",
+		CPUHardware: "BCM2835",
+		CPURevision: "a02082",
+		CPUModel:    "ARMv7 Processor rev 4 (v7l)",
+		CPUCount:    2,
+		MemTotal:    948304 * 1024,
+		MACAddresses: map[string]string{
+			"eth0":  "b8:27:eb:00:00:01",
+			"wlan0": "b8:27:eb:00:00:02",
+		},
+		OSRelease: map[string]string{
+			"PRETTY_NAME": "Raspbian GNU/Linux 9 (stretch)",
+			"ID":          "raspbian",
+			"VERSION_ID":  "9",
+		},
+	}
+	got, err := CollectFacts()
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %+v, got %+v", want, got)
+	}
+}
+
+func TestCollectFactsEmpty(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	want := &Facts{
+		MACAddresses: map[string]string{},
+		OSRelease:    map[string]string{},
+	}
+	got, err := CollectFacts()
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %+v, got %+v", want, got)
+	}
+}
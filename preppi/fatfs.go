@@ -0,0 +1,1487 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// FatFs reads and writes FAT16 and FAT32 file systems in pure Go, so that
+// PrepPi can write to a Raspberry Pi boot partition inside a disk image without
+// loop devices or root privileges. FAT12 is not supported.
+
+package preppi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"github.com/spf13/afero"
+)
+
+// Directory entry attributes.
+const (
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolumeID  = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+	attrLongName  = attrReadOnly | attrHidden | attrSystem | attrVolumeID
+)
+
+const (
+	dirEntrySize = 32
+	// lfnChars is the number of UTF-16 code units in each long name entry.
+	lfnChars = 13
+	// lfnLast marks the last (and physically first) long name entry.
+	lfnLast = 0x40
+	// deletedEntry marks a free directory entry.
+	deletedEntry = 0xe5
+	// maxLongName is the longest name FAT can store.
+	maxLongName = 255
+)
+
+var (
+	errNotFAT      = errors.New("not a FAT16 or FAT32 file system")
+	errFAT12       = errors.New("FAT12 file systems are not supported")
+	errFATCorrupt  = errors.New("FAT file system is corrupt")
+	errFATFull     = errors.New("FAT file system is full")
+	errRootDirFull = errors.New("FAT16 root directory is full")
+)
+
+// fatNow is the time used to stamp files. It is a var for testing.
+var fatNow = time.Now
+
+// BlockDevice is the storage underlying a FatFs, usually a disk image file.
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// FatFs is an Fs for a FAT16 or FAT32 file system, such as the Raspberry Pi
+// boot partition in a disk image. Files are read into memory when opened, and
+// written back when closed, which suits the small files found on a boot
+// partition. FAT has no ownership or permissions, so Chown and Chmod do
+// nothing.
+type FatFs struct {
+	mu sync.Mutex
+
+	dev    BlockDevice
+	offset int64 // of the file system on dev
+
+	fat32        bool
+	clusterSize  int64
+	clusterCount uint32
+	numFATs      int64
+	fatStart     int64 // byte offset of the first FAT
+	fatSize      int64 // in bytes
+	rootDirStart int64 // byte offset of the FAT16 root directory
+	rootDirSize  int64 // in bytes
+	dataStart    int64 // byte offset of cluster 2
+	rootCluster  uint32
+	fsInfoStart  int64 // byte offset of the FAT32 FSInfo sector, or 0
+
+	bytesPerSector int64
+	fat            []byte
+	dirtySectors   map[int64]bool // of the FAT, by index
+	nextFree       uint32
+}
+
+// NewFatFs opens the FAT file system at offset bytes into dev.
+func NewFatFs(dev BlockDevice, offset int64) (*FatFs, error) {
+	bs := make([]byte, 512)
+	if _, err := dev.ReadAt(bs, offset); err != nil {
+		return nil, err
+	}
+	if bs[510] != 0x55 || bs[511] != 0xaa {
+		return nil, errNotFAT
+	}
+	bps := int64(binary.LittleEndian.Uint16(bs[11:]))
+	spc := int64(bs[13])
+	reserved := int64(binary.LittleEndian.Uint16(bs[14:]))
+	numFATs := int64(bs[16])
+	rootEntries := int64(binary.LittleEndian.Uint16(bs[17:]))
+	total := int64(binary.LittleEndian.Uint16(bs[19:]))
+	if total == 0 {
+		total = int64(binary.LittleEndian.Uint32(bs[32:]))
+	}
+	fatSectors := int64(binary.LittleEndian.Uint16(bs[22:]))
+	if fatSectors == 0 {
+		fatSectors = int64(binary.LittleEndian.Uint32(bs[36:]))
+	}
+	switch bps {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, errNotFAT
+	}
+	if spc == 0 || spc&(spc-1) != 0 || reserved == 0 || numFATs == 0 || fatSectors == 0 {
+		return nil, errNotFAT
+	}
+
+	rootDirSectors := (rootEntries*dirEntrySize + bps - 1) / bps
+	dataSectors := total - (reserved + numFATs*fatSectors + rootDirSectors)
+	if dataSectors <= 0 {
+		return nil, errNotFAT
+	}
+	clusters := dataSectors / spc
+	if clusters < 4085 {
+		return nil, errFAT12
+	}
+
+	fs := &FatFs{
+		dev:            dev,
+		offset:         offset,
+		fat32:          clusters >= 65525,
+		bytesPerSector: bps,
+		clusterSize:    bps * spc,
+		clusterCount:   uint32(clusters),
+		numFATs:        numFATs,
+		fatStart:       reserved * bps,
+		fatSize:        fatSectors * bps,
+		rootDirStart:   (reserved + numFATs*fatSectors) * bps,
+		rootDirSize:    rootDirSectors * bps,
+		dataStart:      (reserved + numFATs*fatSectors + rootDirSectors) * bps,
+		dirtySectors:   make(map[int64]bool),
+		nextFree:       2,
+	}
+	entrySize := int64(2)
+	if fs.fat32 {
+		entrySize = 4
+		fs.rootCluster = binary.LittleEndian.Uint32(bs[44:])
+		if info := int64(binary.LittleEndian.Uint16(bs[48:])); info != 0 && info != 0xffff {
+			fs.fsInfoStart = info * bps
+		}
+		if fs.rootCluster < 2 || fs.rootCluster >= fs.clusterCount+2 {
+			return nil, errFATCorrupt
+		}
+	} else if rootEntries == 0 {
+		return nil, errNotFAT
+	}
+	if int64(fs.clusterCount+2)*entrySize > fs.fatSize {
+		return nil, errFATCorrupt
+	}
+	fs.fat = make([]byte, fs.fatSize)
+	if _, err := dev.ReadAt(fs.fat, offset+fs.fatStart); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Name of this file system.
+func (fs *FatFs) Name() string {
+	if fs.fat32 {
+		return "FAT32"
+	}
+	return "FAT16"
+}
+
+// entry returns the FAT entry for cluster c.
+func (fs *FatFs) entry(c uint32) uint32 {
+	if fs.fat32 {
+		return binary.LittleEndian.Uint32(fs.fat[c*4:]) & 0x0fffffff
+	}
+	return uint32(binary.LittleEndian.Uint16(fs.fat[c*2:]))
+}
+
+// setEntry sets the FAT entry for cluster c, preserving the reserved high bits
+// of FAT32 entries.
+func (fs *FatFs) setEntry(c, v uint32) {
+	var off int64
+	if fs.fat32 {
+		off = int64(c) * 4
+		old := binary.LittleEndian.Uint32(fs.fat[off:])
+		binary.LittleEndian.PutUint32(fs.fat[off:], old&0xf0000000|v&0x0fffffff)
+	} else {
+		off = int64(c) * 2
+		binary.LittleEndian.PutUint16(fs.fat[off:], uint16(v))
+	}
+	fs.dirtySectors[off/fs.bytesPerSector] = true
+}
+
+// endOfChain is the value marking the last cluster of a chain.
+func (fs *FatFs) endOfChain() uint32 {
+	if fs.fat32 {
+		return 0x0fffffff
+	}
+	return 0xffff
+}
+
+func (fs *FatFs) isEndOfChain(v uint32) bool {
+	if fs.fat32 {
+		return v >= 0x0ffffff8
+	}
+	return v >= 0xfff8
+}
+
+func (fs *FatFs) validCluster(c uint32) bool {
+	return c >= 2 && c < fs.clusterCount+2
+}
+
+// chain returns the clusters in the chain beginning at first. A first cluster
+// of 0 is an empty chain.
+func (fs *FatFs) chain(first uint32) ([]uint32, error) {
+	var clusters []uint32
+	for c := first; c != 0; {
+		if !fs.validCluster(c) || uint32(len(clusters)) >= fs.clusterCount {
+			return nil, errFATCorrupt
+		}
+		clusters = append(clusters, c)
+		next := fs.entry(c)
+		if fs.isEndOfChain(next) {
+			break
+		}
+		c = next
+	}
+	return clusters, nil
+}
+
+// allocate links n free clusters into a chain, returning them.
+func (fs *FatFs) allocate(n int) ([]uint32, error) {
+	clusters := make([]uint32, 0, n)
+	for i := uint32(0); i < fs.clusterCount && len(clusters) < n; i++ {
+		c := (fs.nextFree-2+i)%fs.clusterCount + 2
+		if fs.entry(c) == 0 {
+			clusters = append(clusters, c)
+		}
+	}
+	if len(clusters) < n {
+		return nil, errFATFull
+	}
+	for i, c := range clusters {
+		if i == len(clusters)-1 {
+			fs.setEntry(c, fs.endOfChain())
+		} else {
+			fs.setEntry(c, clusters[i+1])
+		}
+	}
+	if n > 0 {
+		fs.nextFree = clusters[n-1] + 1
+		if !fs.validCluster(fs.nextFree) {
+			fs.nextFree = 2
+		}
+	}
+	return clusters, nil
+}
+
+// resize grows or shrinks the chain beginning at first to n clusters,
+// returning the chain's new first cluster and its clusters. New clusters are
+// zeroed. Existing clusters keep their place in the chain.
+func (fs *FatFs) resize(first uint32, n int) (uint32, []uint32, error) {
+	clusters, err := fs.chain(first)
+	if err != nil {
+		return 0, nil, err
+	}
+	switch {
+	case n == len(clusters):
+		return first, clusters, nil
+	case n < len(clusters):
+		for _, c := range clusters[n:] {
+			fs.setEntry(c, 0)
+		}
+		clusters = clusters[:n]
+		if n == 0 {
+			return 0, nil, nil
+		}
+		fs.setEntry(clusters[n-1], fs.endOfChain())
+		return first, clusters, nil
+	}
+	added, err := fs.allocate(n - len(clusters))
+	if err != nil {
+		return 0, nil, err
+	}
+	zero := make([]byte, fs.clusterSize)
+	for _, c := range added {
+		if err := fs.writeCluster(c, zero); err != nil {
+			return 0, nil, err
+		}
+	}
+	if len(clusters) == 0 {
+		return added[0], added, nil
+	}
+	fs.setEntry(clusters[len(clusters)-1], added[0])
+	return first, append(clusters, added...), nil
+}
+
+func (fs *FatFs) clusterOffset(c uint32) int64 {
+	return fs.offset + fs.dataStart + int64(c-2)*fs.clusterSize
+}
+
+func (fs *FatFs) writeCluster(c uint32, b []byte) error {
+	_, err := fs.dev.WriteAt(b, fs.clusterOffset(c))
+	return err
+}
+
+// readChain reads the content of the chain beginning at first.
+func (fs *FatFs) readChain(first uint32) ([]byte, error) {
+	clusters, err := fs.chain(first)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, int64(len(clusters))*fs.clusterSize)
+	for i, c := range clusters {
+		if _, err := fs.dev.ReadAt(b[int64(i)*fs.clusterSize:int64(i+1)*fs.clusterSize], fs.clusterOffset(c)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// writeChain stores b in the chain beginning at first, resizing it to fit,
+// and returns the chain's new first cluster.
+func (fs *FatFs) writeChain(first uint32, b []byte) (uint32, error) {
+	n := int((int64(len(b)) + fs.clusterSize - 1) / fs.clusterSize)
+	first, clusters, err := fs.resize(first, n)
+	if err != nil {
+		return 0, err
+	}
+	for i, c := range clusters {
+		end := int64(i+1) * fs.clusterSize
+		if end > int64(len(b)) {
+			end = int64(len(b))
+		}
+		if err := fs.writeCluster(c, b[int64(i)*fs.clusterSize:end]); err != nil {
+			return 0, err
+		}
+	}
+	return first, nil
+}
+
+// flush writes the modified parts of the FAT to every copy, and updates the
+// FAT32 FSInfo sector.
+func (fs *FatFs) flush() error {
+	for s := range fs.dirtySectors {
+		b := fs.fat[s*fs.bytesPerSector : (s+1)*fs.bytesPerSector]
+		for i := int64(0); i < fs.numFATs; i++ {
+			if _, err := fs.dev.WriteAt(b, fs.offset+fs.fatStart+i*fs.fatSize+s*fs.bytesPerSector); err != nil {
+				return err
+			}
+		}
+		delete(fs.dirtySectors, s)
+	}
+	if fs.fsInfoStart == 0 {
+		return nil
+	}
+	info := make([]byte, 512)
+	if _, err := fs.dev.ReadAt(info, fs.offset+fs.fsInfoStart); err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(info[0:]) != 0x41615252 || binary.LittleEndian.Uint32(info[484:]) != 0x61417272 {
+		// Not a valid FSInfo sector, leave it be.
+		return nil
+	}
+	free := uint32(0)
+	for c := uint32(2); c < fs.clusterCount+2; c++ {
+		if fs.entry(c) == 0 {
+			free++
+		}
+	}
+	binary.LittleEndian.PutUint32(info[488:], free)
+	binary.LittleEndian.PutUint32(info[492:], fs.nextFree)
+	_, err := fs.dev.WriteAt(info[484:500], fs.offset+fs.fsInfoStart+484)
+	return err
+}
+
+// fatDir is a directory, loaded into memory.
+type fatDir struct {
+	// cluster is the directory's first cluster, 0 for the FAT16 root.
+	cluster uint32
+	data    []byte
+}
+
+// fatEntry is a parsed directory entry.
+type fatEntry struct {
+	name    string
+	short   [11]byte
+	attr    byte
+	cluster uint32
+	size    uint32
+	modTime time.Time
+	// start and end are the offsets in the directory data of the entry's first
+	// long name slot, and of the end of its short entry.
+	start, end int
+}
+
+func (e *fatEntry) isDir() bool {
+	return e.attr&attrDirectory != 0
+}
+
+// shortName formats an 8.3 name for display.
+func shortName(b [11]byte, caseFlags byte) string {
+	if b[0] == 0x05 {
+		b[0] = deletedEntry
+	}
+	base := strings.TrimRight(string(b[:8]), " ")
+	ext := strings.TrimRight(string(b[8:]), " ")
+	if caseFlags&0x08 != 0 {
+		base = strings.ToLower(base)
+	}
+	if caseFlags&0x10 != 0 {
+		ext = strings.ToLower(ext)
+	}
+	if ext == "" {
+		return base
+	}
+	return base + "." + ext
+}
+
+// shortChecksum is the checksum of an 8.3 name stored in long name entries.
+func shortChecksum(b [11]byte) byte {
+	var sum byte
+	for _, c := range b {
+		sum = (sum&1)<<7 + sum>>1 + c
+	}
+	return sum
+}
+
+func dosTime(t time.Time) (uint16, uint16) {
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, t.Location())
+	} else if t.Year() > 2107 {
+		t = time.Date(2107, 12, 31, 23, 59, 58, 0, t.Location())
+	}
+	date := uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm := uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+func fromDOSTime(date, tm uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0x0f), int(date&0x1f),
+		int(tm>>11), int(tm>>5&0x3f), int(tm&0x1f)*2, 0, time.Local)
+}
+
+// entries parses the directory, skipping deleted entries, volume labels and
+// the "." and ".." entries.
+func (d *fatDir) entries() []*fatEntry {
+	var (
+		entries  []*fatEntry
+		lfn      []uint16
+		lfnStart = -1
+		lfnSum   byte
+		lfnNext  int
+	)
+	for i := 0; i+dirEntrySize <= len(d.data); i += dirEntrySize {
+		b := d.data[i : i+dirEntrySize]
+		if b[0] == 0 {
+			break
+		}
+		if b[0] == deletedEntry {
+			lfnStart = -1
+			continue
+		}
+		attr := b[11]
+		if attr&0x3f == attrLongName {
+			ord := int(b[0] & 0x1f)
+			if b[0]&lfnLast != 0 {
+				lfn = make([]uint16, ord*lfnChars)
+				lfnStart, lfnSum, lfnNext = i, b[13], ord
+			}
+			if lfnStart < 0 || ord != lfnNext || ord == 0 || b[13] != lfnSum {
+				lfnStart = -1
+				continue
+			}
+			chars := lfn[(ord-1)*lfnChars:]
+			for j := 0; j < 5; j++ {
+				chars[j] = binary.LittleEndian.Uint16(b[1+j*2:])
+			}
+			for j := 0; j < 6; j++ {
+				chars[5+j] = binary.LittleEndian.Uint16(b[14+j*2:])
+			}
+			for j := 0; j < 2; j++ {
+				chars[11+j] = binary.LittleEndian.Uint16(b[28+j*2:])
+			}
+			lfnNext--
+			continue
+		}
+
+		e := &fatEntry{
+			attr:    attr,
+			cluster: uint32(binary.LittleEndian.Uint16(b[20:]))<<16 | uint32(binary.LittleEndian.Uint16(b[26:])),
+			size:    binary.LittleEndian.Uint32(b[28:]),
+			modTime: fromDOSTime(binary.LittleEndian.Uint16(b[24:]), binary.LittleEndian.Uint16(b[22:])),
+			start:   i,
+			end:     i + dirEntrySize,
+		}
+		copy(e.short[:], b[:11])
+		e.name = shortName(e.short, b[12])
+		if lfnStart >= 0 && lfnNext == 0 && lfnSum == shortChecksum(e.short) {
+			for j, c := range lfn {
+				if c == 0 {
+					lfn = lfn[:j]
+					break
+				}
+			}
+			e.name = string(utf16.Decode(lfn))
+			e.start = lfnStart
+		}
+		lfnStart = -1
+
+		if attr&attrVolumeID != 0 || e.name == "." || e.name == ".." {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// find returns the entry with the given name, ignoring case, or nil.
+func (d *fatDir) find(name string) *fatEntry {
+	for _, e := range d.entries() {
+		if strings.EqualFold(e.name, name) || strings.EqualFold(shortName(e.short, 0), name) {
+			return e
+		}
+	}
+	return nil
+}
+
+// hasShort is true when the directory contains the given 8.3 name.
+func (d *fatDir) hasShort(short [11]byte) bool {
+	for i := 0; i+dirEntrySize <= len(d.data); i += dirEntrySize {
+		b := d.data[i : i+dirEntrySize]
+		if b[0] == 0 {
+			break
+		}
+		if b[0] != deletedEntry && b[11]&0x3f != attrLongName && string(b[:11]) == string(short[:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// shortNameChar maps a character to one valid in an 8.3 name, and reports
+// whether it was already valid.
+func shortNameChar(r rune) (byte, bool) {
+	switch {
+	case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return byte(r), true
+	case r >= 'a' && r <= 'z':
+		return byte(r - 'a' + 'A'), true
+	case r < 0x80 && strings.ContainsRune("$%'-_@~`!(){}^#&", r):
+		return byte(r), true
+	}
+	return '_', false
+}
+
+// makeShortName returns an 8.3 name for name, unique within d, and whether a
+// long name is needed to store name faithfully.
+func (d *fatDir) makeShortName(name string) ([11]byte, bool) {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	lossy := strings.HasPrefix(name, ".") || len(base) > 8 || len(ext) > 3
+	convert := func(s string, max int) []byte {
+		var out []byte
+		for _, r := range s {
+			if r == ' ' || r == '.' {
+				lossy = true
+				continue
+			}
+			c, ok := shortNameChar(r)
+			if !ok {
+				lossy = true
+			}
+			out = append(out, c)
+		}
+		if len(out) > max {
+			out = out[:max]
+		}
+		return out
+	}
+	b, x := convert(base, 8), convert(ext, 3)
+	if len(b) == 0 {
+		b = []byte("_")
+	}
+
+	var short [11]byte
+	for i := range short {
+		short[i] = ' '
+	}
+	copy(short[:8], b)
+	copy(short[8:], x)
+	if !lossy && !d.hasShort(short) {
+		// The name fits, but a long name is still needed to keep its case.
+		return short, name != strings.ToUpper(name)
+	}
+
+	// Add a numeric tail, eg "ETC-WP~1.CON", to make the name unique.
+	for n := 1; ; n++ {
+		tail := fmt.Sprintf("~%d", n)
+		keep := 8 - len(tail)
+		if keep > len(b) {
+			keep = len(b)
+		}
+		for i := 0; i < 8; i++ {
+			short[i] = ' '
+		}
+		copy(short[:keep], b[:keep])
+		copy(short[keep:8], tail)
+		if !d.hasShort(short) {
+			return short, true
+		}
+	}
+}
+
+// add creates an entry for name in the directory, growing it if need be.
+func (fs *FatFs) add(d *fatDir, name string, attr byte, cluster, size uint32) error {
+	if name == "" || name == "." || name == ".." || len(name) > maxLongName || strings.ContainsAny(name, "/\\:*?\"<>|") {
+		return syscall.EINVAL
+	}
+	short, long := d.makeShortName(name)
+	var lfn []uint16
+	if long {
+		lfn = utf16.Encode([]rune(name))
+		if len(lfn) > maxLongName {
+			return syscall.ENAMETOOLONG
+		}
+	}
+	nLFN := (len(lfn) + lfnChars - 1) / lfnChars
+	slots := nLFN + 1
+
+	// Find a run of free slots, growing the directory if there isn't one.
+	// Everything from the first never-used slot onwards is free.
+	unused := len(d.data)
+	for i := 0; i < len(d.data); i += dirEntrySize {
+		if d.data[i] == 0 {
+			unused = i
+			break
+		}
+	}
+	start, run := 0, 0
+	for i := 0; i < len(d.data) && run < slots; i += dirEntrySize {
+		if i >= unused || d.data[i] == deletedEntry {
+			if run == 0 {
+				start = i
+			}
+			run++
+		} else {
+			run = 0
+		}
+	}
+	for run < slots {
+		if d.cluster == 0 {
+			return errRootDirFull
+		}
+		if run == 0 {
+			start = len(d.data)
+		}
+		d.data = append(d.data, make([]byte, fs.clusterSize)...)
+		run += int(fs.clusterSize / dirEntrySize)
+	}
+	// If the new entry extends into the unused slots, the slot after it must
+	// still mark the end of the directory.
+	end := start + slots*dirEntrySize
+	if end > unused && end < len(d.data) {
+		for i := end; i < end+dirEntrySize; i++ {
+			d.data[i] = 0
+		}
+	}
+
+	sum := shortChecksum(short)
+	for i := 0; i < nLFN; i++ {
+		ord := nLFN - i
+		b := d.data[start+i*dirEntrySize : start+(i+1)*dirEntrySize]
+		for j := range b {
+			b[j] = 0
+		}
+		b[0] = byte(ord)
+		if i == 0 {
+			b[0] |= lfnLast
+		}
+		b[11], b[13] = attrLongName, sum
+		char := func(k int) uint16 {
+			k += (ord - 1) * lfnChars
+			switch {
+			case k < len(lfn):
+				return lfn[k]
+			case k == len(lfn):
+				return 0
+			}
+			return 0xffff
+		}
+		for j := 0; j < 5; j++ {
+			binary.LittleEndian.PutUint16(b[1+j*2:], char(j))
+		}
+		for j := 0; j < 6; j++ {
+			binary.LittleEndian.PutUint16(b[14+j*2:], char(5+j))
+		}
+		for j := 0; j < 2; j++ {
+			binary.LittleEndian.PutUint16(b[28+j*2:], char(11+j))
+		}
+	}
+
+	b := d.data[start+nLFN*dirEntrySize : end]
+	for j := range b {
+		b[j] = 0
+	}
+	copy(b, short[:])
+	b[11] = attr
+	date, tm := dosTime(fatNow())
+	binary.LittleEndian.PutUint16(b[14:], tm)
+	binary.LittleEndian.PutUint16(b[16:], date)
+	binary.LittleEndian.PutUint16(b[18:], date)
+	binary.LittleEndian.PutUint16(b[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(b[22:], tm)
+	binary.LittleEndian.PutUint16(b[24:], date)
+	binary.LittleEndian.PutUint16(b[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(b[28:], size)
+	return nil
+}
+
+// update rewrites the cluster, size and modification time of an entry.
+func (d *fatDir) update(e *fatEntry, cluster, size uint32, modTime time.Time) {
+	b := d.data[e.end-dirEntrySize : e.end]
+	date, tm := dosTime(modTime)
+	if e.attr&attrDirectory == 0 {
+		b[11] |= attrArchive
+	}
+	binary.LittleEndian.PutUint16(b[18:], date)
+	binary.LittleEndian.PutUint16(b[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(b[22:], tm)
+	binary.LittleEndian.PutUint16(b[24:], date)
+	binary.LittleEndian.PutUint16(b[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(b[28:], size)
+	e.cluster, e.size, e.modTime = cluster, size, modTime
+}
+
+// remove marks an entry's slots as free.
+func (d *fatDir) remove(e *fatEntry) {
+	for i := e.start; i < e.end; i += dirEntrySize {
+		d.data[i] = deletedEntry
+	}
+}
+
+// rootDir returns the first cluster of the root directory, 0 for FAT16.
+func (fs *FatFs) rootDir() uint32 {
+	if fs.fat32 {
+		return fs.rootCluster
+	}
+	return 0
+}
+
+func (fs *FatFs) loadDir(cluster uint32) (*fatDir, error) {
+	d := &fatDir{cluster: cluster}
+	if cluster == 0 {
+		if fs.fat32 {
+			return fs.loadDir(fs.rootCluster)
+		}
+		d.data = make([]byte, fs.rootDirSize)
+		if _, err := fs.dev.ReadAt(d.data, fs.offset+fs.rootDirStart); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	var err error
+	if d.data, err = fs.readChain(cluster); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (fs *FatFs) saveDir(d *fatDir) error {
+	if d.cluster == 0 {
+		_, err := fs.dev.WriteAt(d.data, fs.offset+fs.rootDirStart)
+		return err
+	}
+	first, err := fs.writeChain(d.cluster, d.data)
+	if err != nil {
+		return err
+	}
+	if first != d.cluster {
+		// Directories only grow, so this can't happen.
+		return errFATCorrupt
+	}
+	return nil
+}
+
+// splitPath cleans name, and splits it into its components.
+func splitPath(name string) []string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil
+	}
+	return strings.Split(name[1:], "/")
+}
+
+// walk returns the directory containing the last component of name, and that
+// component's entry, which is nil if it doesn't exist. The parent is nil for
+// the root directory.
+func (fs *FatFs) walk(op, name string) (*fatDir, *fatEntry, error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		return nil, nil, nil
+	}
+	d, err := fs.loadDir(fs.rootDir())
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, part := range parts {
+		e := d.find(part)
+		if i == len(parts)-1 {
+			return d, e, nil
+		}
+		if e == nil {
+			return nil, nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+		}
+		if !e.isDir() {
+			return nil, nil, &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		if d, err = fs.loadDir(e.cluster); err != nil {
+			return nil, nil, err
+		}
+	}
+	panic("unreachable")
+}
+
+// lookup is walk, but the named file must exist. For the root directory, the
+// parent and entry are both nil.
+func (fs *FatFs) lookup(op, name string) (*fatDir, *fatEntry, error) {
+	d, e, err := fs.walk(op, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if d != nil && e == nil {
+		return nil, nil, &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return d, e, nil
+}
+
+// Create creates or truncates the named file.
+func (fs *FatFs) Create(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// Mkdir creates a directory.
+func (fs *FatFs) Mkdir(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.mkdir(name)
+}
+
+func (fs *FatFs) mkdir(name string) error {
+	d, e, err := fs.walk("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if d == nil || e != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	clusters, err := fs.allocate(1)
+	if err != nil {
+		return err
+	}
+	sub := &fatDir{cluster: clusters[0], data: make([]byte, fs.clusterSize)}
+	// A ".." entry refers to the root directory as cluster 0, even on FAT32.
+	parent := d.cluster
+	if parent == fs.rootDir() {
+		parent = 0
+	}
+	date, tm := dosTime(fatNow())
+	for i, dot := range []struct {
+		name    string
+		cluster uint32
+	}{{".", sub.cluster}, {"..", parent}} {
+		b := sub.data[i*dirEntrySize : (i+1)*dirEntrySize]
+		copy(b, fmt.Sprintf("%-11s", dot.name))
+		b[11] = attrDirectory
+		binary.LittleEndian.PutUint16(b[14:], tm)
+		binary.LittleEndian.PutUint16(b[16:], date)
+		binary.LittleEndian.PutUint16(b[18:], date)
+		binary.LittleEndian.PutUint16(b[20:], uint16(dot.cluster>>16))
+		binary.LittleEndian.PutUint16(b[22:], tm)
+		binary.LittleEndian.PutUint16(b[24:], date)
+		binary.LittleEndian.PutUint16(b[26:], uint16(dot.cluster))
+	}
+	if err := fs.writeCluster(sub.cluster, sub.data); err != nil {
+		return err
+	}
+	if err := fs.add(d, path.Base(name), attrDirectory, sub.cluster, 0); err != nil {
+		fs.setEntry(sub.cluster, 0)
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if err := fs.saveDir(d); err != nil {
+		return err
+	}
+	return fs.flush()
+}
+
+// MkdirAll creates a directory and any parents which don't exist.
+func (fs *FatFs) MkdirAll(name string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	p := "/"
+	for _, part := range splitPath(name) {
+		p = path.Join(p, part)
+		_, e, err := fs.walk("mkdir", p)
+		if err != nil {
+			return err
+		}
+		if e != nil {
+			if !e.isDir() {
+				return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+			}
+			continue
+		}
+		if err := fs.mkdir(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open opens the named file for reading.
+func (fs *FatFs) Open(name string) (afero.File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// OpenFile opens the named file with the given flags. The perm is ignored.
+func (fs *FatFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	d, e, err := fs.walk("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &fatFile{fs: fs, name: name, flag: flag}
+	if d == nil {
+		// The root directory.
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		f.isDir, f.cluster = true, fs.rootDir()
+		f.info = &fatFileInfo{name: "/", dir: true}
+		return f, nil
+	}
+	f.parent = d.cluster
+
+	if e == nil {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := fs.add(d, path.Base(name), attrArchive, 0, 0); err != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: err}
+		}
+		if err := fs.saveDir(d); err != nil {
+			return nil, err
+		}
+		if err := fs.flush(); err != nil {
+			return nil, err
+		}
+		if e = d.find(path.Base(name)); e == nil {
+			return nil, errFATCorrupt
+		}
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	f.entryName, f.info = e.name, e.info()
+
+	if e.isDir() {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		f.isDir, f.cluster = true, e.cluster
+		return f, nil
+	}
+	if flag&os.O_TRUNC != 0 && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		f.dirty = e.size != 0
+		return f, nil
+	}
+	data, err := fs.readChain(e.cluster)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) < int64(e.size) {
+		return nil, errFATCorrupt
+	}
+	f.data = data[:e.size]
+	if flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.data))
+	}
+	return f, nil
+}
+
+// writeBack stores the content of a file opened for writing.
+func (fs *FatFs) writeBack(f *fatFile) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, err := fs.loadDir(f.parent)
+	if err != nil {
+		return err
+	}
+	e := d.find(f.entryName)
+	if e == nil {
+		return &os.PathError{Op: "write", Path: f.name, Err: os.ErrNotExist}
+	}
+	first, err := fs.writeChain(e.cluster, f.data)
+	if err != nil {
+		return err
+	}
+	d.update(e, first, uint32(len(f.data)), fatNow())
+	if err := fs.saveDir(d); err != nil {
+		return err
+	}
+	return fs.flush()
+}
+
+// Remove removes the named file or empty directory.
+func (fs *FatFs) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.remove(name)
+}
+
+func (fs *FatFs) remove(name string) error {
+	d, e, err := fs.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.EBUSY}
+	}
+	if e.isDir() {
+		sub, err := fs.loadDir(e.cluster)
+		if err != nil {
+			return err
+		}
+		if len(sub.entries()) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	if _, _, err := fs.resize(e.cluster, 0); err != nil {
+		return err
+	}
+	d.remove(e)
+	if err := fs.saveDir(d); err != nil {
+		return err
+	}
+	return fs.flush()
+}
+
+// RemoveAll removes the named file or directory, and anything it contains. It
+// is not an error if it doesn't exist.
+func (fs *FatFs) RemoveAll(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.removeAll(name)
+}
+
+func (fs *FatFs) removeAll(name string) error {
+	d, e, err := fs.walk("remove", name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if d != nil && e == nil {
+		return nil
+	}
+	cluster := fs.rootDir()
+	if e != nil {
+		if !e.isDir() {
+			return fs.remove(name)
+		}
+		cluster = e.cluster
+	}
+	sub, err := fs.loadDir(cluster)
+	if err != nil {
+		return err
+	}
+	for _, child := range sub.entries() {
+		if err := fs.removeAll(path.Join(name, child.name)); err != nil {
+			return err
+		}
+	}
+	if d == nil {
+		// The root directory itself stays.
+		return nil
+	}
+	return fs.remove(name)
+}
+
+// Rename moves oldname to newname, replacing newname if it's a file.
+func (fs *FatFs) Rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	od, oe, err := fs.lookup("rename", oldname)
+	if err != nil {
+		return err
+	}
+	if od == nil {
+		return &os.PathError{Op: "rename", Path: oldname, Err: syscall.EBUSY}
+	}
+	nd, ne, err := fs.walk("rename", newname)
+	if err != nil {
+		return err
+	}
+	if nd == nil {
+		return &os.PathError{Op: "rename", Path: newname, Err: os.ErrExist}
+	}
+	if oe.isDir() && strings.HasPrefix(path.Clean("/"+newname)+"/", path.Clean("/"+oldname)+"/") &&
+		!strings.EqualFold(path.Clean("/"+newname), path.Clean("/"+oldname)) {
+		return &os.PathError{Op: "rename", Path: newname, Err: syscall.EINVAL}
+	}
+	// Names are case-insensitive, so newname may be oldname with its case
+	// changed.
+	same := ne != nil && nd.cluster == od.cluster && ne.start == oe.start
+	if ne != nil && !same {
+		if ne.isDir() || oe.isDir() {
+			return &os.PathError{Op: "rename", Path: newname, Err: os.ErrExist}
+		}
+		if err := fs.remove(newname); err != nil {
+			return err
+		}
+		// Removal changed the directories on disk.
+		if od, oe, err = fs.lookup("rename", oldname); err != nil {
+			return err
+		}
+		if nd, _, err = fs.walk("rename", newname); err != nil {
+			return err
+		}
+	}
+
+	if nd.cluster == od.cluster {
+		nd = od
+	}
+	od.remove(oe)
+	if err := fs.add(nd, path.Base(newname), oe.attr, oe.cluster, oe.size); err != nil {
+		return &os.PathError{Op: "rename", Path: newname, Err: err}
+	}
+	if nd != od {
+		if err := fs.saveDir(od); err != nil {
+			return err
+		}
+		if oe.isDir() {
+			// Point the moved directory's ".." at its new parent.
+			sub, err := fs.loadDir(oe.cluster)
+			if err != nil {
+				return err
+			}
+			if len(sub.data) >= 2*dirEntrySize && sub.data[dirEntrySize] == '.' && sub.data[dirEntrySize+1] == '.' {
+				parent := nd.cluster
+				if parent == fs.rootDir() {
+					parent = 0
+				}
+				binary.LittleEndian.PutUint16(sub.data[dirEntrySize+20:], uint16(parent>>16))
+				binary.LittleEndian.PutUint16(sub.data[dirEntrySize+26:], uint16(parent))
+				if err := fs.saveDir(sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := fs.saveDir(nd); err != nil {
+		return err
+	}
+	return fs.flush()
+}
+
+// Stat returns a FileInfo describing the named file.
+func (fs *FatFs) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, e, err := fs.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if d == nil {
+		return &fatFileInfo{name: "/", dir: true}, nil
+	}
+	return e.info(), nil
+}
+
+// Chmod does nothing but check that the file exists, FAT has no permissions.
+func (fs *FatFs) Chmod(name string, mode os.FileMode) error {
+	_, err := fs.Stat(name)
+	return err
+}
+
+// Chown does nothing but check that the file exists, FAT has no ownership.
+func (fs *FatFs) Chown(name string, uid, gid int) error {
+	_, err := fs.Stat(name)
+	return err
+}
+
+// Chtimes sets the modification time of the named file. FAT doesn't record
+// access times with any precision, so atime is ignored.
+func (fs *FatFs) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	d, e, err := fs.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return nil
+	}
+	d.update(e, e.cluster, e.size, mtime)
+	if err := fs.saveDir(d); err != nil {
+		return err
+	}
+	return fs.flush()
+}
+
+func (e *fatEntry) info() *fatFileInfo {
+	return &fatFileInfo{
+		name:     e.name,
+		size:     int64(e.size),
+		dir:      e.isDir(),
+		readOnly: e.attr&attrReadOnly != 0,
+		modTime:  e.modTime,
+	}
+}
+
+// fatFileInfo describes a file on a FatFs.
+type fatFileInfo struct {
+	name     string
+	size     int64
+	dir      bool
+	readOnly bool
+	modTime  time.Time
+}
+
+func (i *fatFileInfo) Name() string       { return i.name }
+func (i *fatFileInfo) Size() int64        { return i.size }
+func (i *fatFileInfo) ModTime() time.Time { return i.modTime }
+func (i *fatFileInfo) IsDir() bool        { return i.dir }
+func (i *fatFileInfo) Sys() interface{}   { return nil }
+
+func (i *fatFileInfo) Mode() os.FileMode {
+	switch {
+	case i.dir:
+		return os.ModeDir | 0755
+	case i.readOnly:
+		return 0444
+	}
+	return 0644
+}
+
+// fatFile is an open file on a FatFs. Its content is held in memory, and
+// written back on Sync or Close.
+type fatFile struct {
+	fs   *FatFs
+	name string
+	flag int
+	info *fatFileInfo
+
+	// parent is the first cluster of the containing directory, and entryName
+	// the file's name within it.
+	parent    uint32
+	entryName string
+
+	isDir   bool
+	cluster uint32 // of a directory
+	listed  []os.FileInfo
+	listPos int
+
+	data   []byte
+	pos    int64
+	dirty  bool
+	closed bool
+}
+
+func (f *fatFile) Name() string {
+	return f.name
+}
+
+func (f *fatFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	case f.isDir:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	case write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	case !write && f.flag&os.O_WRONLY != 0:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+func (f *fatFile) Read(b []byte) (int, error) {
+	n, err := f.ReadAt(b, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fatFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EINVAL}
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, f.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *fatFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.pos = offset
+	return f.pos, nil
+}
+
+func (f *fatFile) Write(b []byte) (int, error) {
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.data))
+	}
+	n, err := f.WriteAt(b, f.pos)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *fatFile) WriteAt(b []byte, off int64) (int, error) {
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EINVAL}
+	}
+	if end := off + int64(len(b)); end > int64(len(f.data)) {
+		if end > 0xffffffff {
+			return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EFBIG}
+		}
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	copy(f.data[off:], b)
+	f.dirty = true
+	return len(b), nil
+}
+
+func (f *fatFile) WriteString(s string) (int, error) {
+	return f.Write([]byte(s))
+}
+
+func (f *fatFile) Truncate(size int64) error {
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 || size > 0xffffffff {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size <= int64(len(f.data)) {
+		f.data = f.data[:size]
+	} else {
+		f.data = append(f.data, make([]byte, size-int64(len(f.data)))...)
+	}
+	f.dirty = true
+	return nil
+}
+
+func (f *fatFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.isDir {
+		return nil, &os.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	if f.listed == nil {
+		f.fs.mu.Lock()
+		d, err := f.fs.loadDir(f.cluster)
+		f.fs.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		f.listed = make([]os.FileInfo, 0)
+		for _, e := range d.entries() {
+			f.listed = append(f.listed, e.info())
+		}
+	}
+	remaining := f.listed[f.listPos:]
+	if count <= 0 {
+		f.listPos = len(f.listed)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.listPos += count
+	return remaining[:count], nil
+}
+
+func (f *fatFile) Readdirnames(n int) ([]string, error) {
+	infos, err := f.Readdir(n)
+	names := make([]string, len(infos))
+	for i, info := range infos {
+		names[i] = info.Name()
+	}
+	return names, err
+}
+
+func (f *fatFile) Stat() (os.FileInfo, error) {
+	if f.closed {
+		return nil, &os.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	info := *f.info
+	if !f.isDir {
+		info.size = int64(len(f.data))
+	}
+	return &info, nil
+}
+
+// Sync writes the file's content back to the file system, if it has changed.
+func (f *fatFile) Sync() error {
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.dirty {
+		return nil
+	}
+	if err := f.fs.writeBack(f); err != nil {
+		return err
+	}
+	f.dirty = false
+	return nil
+}
+
+func (f *fatFile) Close() error {
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	err := f.Sync()
+	f.closed = true
+	return err
+}
@@ -0,0 +1,632 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// memDevice is a BlockDevice in memory.
+type memDevice []byte
+
+func (d memDevice) ReadAt(b []byte, off int64) (int, error) {
+	if off >= int64(len(d)) {
+		return 0, io.EOF
+	}
+	n := copy(b, d[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (d memDevice) WriteAt(b []byte, off int64) (int, error) {
+	if off+int64(len(b)) > int64(len(d)) {
+		return 0, fmt.Errorf("write of %d bytes at %d is beyond the end of the device", len(b), off)
+	}
+	return copy(d[off:], b), nil
+}
+
+// formatFATForTest writes an empty FAT file system of the given number of
+// 512 byte sectors, one sector per cluster, at offset into dev.
+func formatFATForTest(t *testing.T, dev memDevice, offset, sectors int64, fat32 bool) {
+	bs := make([]byte, 512)
+	copy(bs, []byte{0xeb, 0x3c, 0x90})
+	copy(bs[3:], "MSWIN4.1")
+	binary.LittleEndian.PutUint16(bs[11:], 512)
+	bs[13] = 1
+	bs[16] = 2
+	bs[21] = 0xf8
+	binary.LittleEndian.PutUint32(bs[32:], uint32(sectors))
+	bs[510], bs[511] = 0x55, 0xaa
+
+	var reserved, fatSectors int64
+	var fat func(start int)
+	if fat32 {
+		reserved = 32
+		fatSectors = ((sectors+2)*4 + 511) / 512
+		binary.LittleEndian.PutUint32(bs[36:], uint32(fatSectors))
+		binary.LittleEndian.PutUint32(bs[44:], 2)
+		binary.LittleEndian.PutUint16(bs[48:], 1)
+		bs[66] = 0x29
+		copy(bs[82:], "FAT32   ")
+
+		info := make([]byte, 512)
+		binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+		binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+		binary.LittleEndian.PutUint32(info[488:], 0xffffffff)
+		binary.LittleEndian.PutUint32(info[492:], 0xffffffff)
+		binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+		copy(dev[offset+512:], info)
+
+		fat = func(start int) {
+			binary.LittleEndian.PutUint32(dev[start:], 0x0ffffff8)
+			binary.LittleEndian.PutUint32(dev[start+4:], 0x0fffffff)
+			// The root directory is cluster 2.
+			binary.LittleEndian.PutUint32(dev[start+8:], 0x0fffffff)
+		}
+	} else {
+		reserved = 1
+		fatSectors = ((sectors+2)*2 + 511) / 512
+		binary.LittleEndian.PutUint16(bs[17:], 512)
+		binary.LittleEndian.PutUint16(bs[22:], uint16(fatSectors))
+		bs[38] = 0x29
+		copy(bs[54:], "FAT16   ")
+		fat = func(start int) {
+			binary.LittleEndian.PutUint16(dev[start:], 0xfff8)
+			binary.LittleEndian.PutUint16(dev[start+2:], 0xffff)
+		}
+	}
+	binary.LittleEndian.PutUint16(bs[14:], uint16(reserved))
+	copy(dev[offset:], bs)
+	for i := int64(0); i < 2; i++ {
+		fat(int(offset + (reserved+i*fatSectors)*512))
+	}
+}
+
+// newFatFsForTest returns a freshly formatted FatFs, and its device.
+func newFatFsForTest(t *testing.T, fat32 bool) (*FatFs, memDevice) {
+	sectors := int64(8192)
+	if fat32 {
+		sectors = 70000
+	}
+	dev := make(memDevice, sectors*512)
+	formatFATForTest(t, dev, 0, sectors, fat32)
+	fs, err := NewFatFs(dev, 0)
+	if err != nil {
+		t.Fatalf("couldn't open test file system: %v", err)
+	}
+	if fs.fat32 != fat32 {
+		t.Fatalf("wanted FAT32 %v, got %v", fat32, fs.fat32)
+	}
+	return fs, dev
+}
+
+// freeClusters counts the free clusters of fs.
+func freeClusters(fs *FatFs) int {
+	free := 0
+	for c := uint32(2); c < fs.clusterCount+2; c++ {
+		if fs.entry(c) == 0 {
+			free++
+		}
+	}
+	return free
+}
+
+func TestFatFs(t *testing.T) {
+	origNow := fatNow
+	defer func() { fatNow = origNow }()
+	fatNow = func() time.Time { return time.Date(2017, 9, 25, 12, 30, 10, 0, time.Local) }
+
+	big := bytes.Repeat([]byte("Here we are extending into shooting stars\n"), 50)
+	files := map[string][]byte{
+		"/CONFIG.TXT":          []byte("dtparam=audio=on\n"),
+		"/cmdline.txt":         []byte("console=serial0,115200 root=/dev/mmcblk0p2\n"),
+		"/preppi/preppi.conf":  []byte(`{"map": []}`),
+		"/preppi/etc-hostname": []byte("raspberrypi\n"),
+		"/preppi/etc-wpa_supplicant-wpa_supplicant.conf": big,
+		"/preppi/sub/dir/Mixed Case Name.txt":            []byte("mixed\n"),
+		"/preppi/empty":                                  nil,
+	}
+
+	for _, fat32 := range []bool{false, true} {
+		fs, dev := newFatFsForTest(t, fat32)
+		initialFree := freeClusters(fs)
+
+		for name, content := range files {
+			if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
+				t.Fatalf("%v: couldn't create directory for %q: %v", fs.Name(), name, err)
+			}
+			if err := afero.WriteFile(fs, name, content, 0644); err != nil {
+				t.Fatalf("%v: couldn't write %q: %v", fs.Name(), name, err)
+			}
+		}
+
+		// Everything must have made it to the device.
+		fs, err := NewFatFs(dev, 0)
+		if err != nil {
+			t.Fatalf("couldn't reopen file system: %v", err)
+		}
+		for name, content := range files {
+			got, err := afero.ReadFile(fs, name)
+			if err != nil {
+				t.Errorf("%v: couldn't read %q: %v", fs.Name(), name, err)
+				continue
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("%v: %q: wanted %q, got %q", fs.Name(), name, content, got)
+			}
+			info, err := fs.Stat(strings.ToUpper(name))
+			if err != nil {
+				t.Errorf("%v: names should be case-insensitive: %v", fs.Name(), err)
+				continue
+			}
+			if info.Size() != int64(len(content)) || info.IsDir() {
+				t.Errorf("%v: %q: wanted file of size %d, got %v", fs.Name(), name, len(content), info)
+			}
+			if want := fatNow(); !info.ModTime().Equal(want) {
+				t.Errorf("%v: %q: wanted mod time %v, got %v", fs.Name(), name, want, info.ModTime())
+			}
+		}
+
+		root, err := fs.Open("/preppi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, err := root.Readdirnames(-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root.Close()
+		sort.Strings(names)
+		wantNames := []string{"empty", "etc-hostname", "etc-wpa_supplicant-wpa_supplicant.conf", "preppi.conf", "sub"}
+		if !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("%v: wanted names %v, got %v", fs.Name(), wantNames, names)
+		}
+
+		// Shrinking a file frees its clusters.
+		before := freeClusters(fs)
+		if err := afero.WriteFile(fs, "/preppi/etc-wpa_supplicant-wpa_supplicant.conf", []byte("short"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := freeClusters(fs), before+len(big)/512; got != want {
+			t.Errorf("%v: wanted %d free clusters after shrinking, got %d", fs.Name(), want, got)
+		}
+
+		if err := fs.Rename("/preppi/etc-hostname", "/preppi/sub/hostname"); err != nil {
+			t.Fatalf("%v: couldn't rename: %v", fs.Name(), err)
+		}
+		if _, err := fs.Stat("/preppi/etc-hostname"); !os.IsNotExist(err) {
+			t.Errorf("%v: wanted renamed file gone, got: %v", fs.Name(), err)
+		}
+		if got, err := afero.ReadFile(fs, "/preppi/sub/hostname"); err != nil || string(got) != "raspberrypi\n" {
+			t.Errorf("%v: wanted renamed content, got %q, %v", fs.Name(), got, err)
+		}
+		if err := fs.Rename("/preppi/sub", "/moved"); err != nil {
+			t.Fatalf("%v: couldn't rename directory: %v", fs.Name(), err)
+		}
+		if _, err := fs.Stat("/moved/dir/Mixed Case Name.txt"); err != nil {
+			t.Errorf("%v: wanted moved directory content: %v", fs.Name(), err)
+		}
+
+		if err := fs.Remove("/preppi"); err == nil {
+			t.Errorf("%v: wanted error removing non-empty directory", fs.Name())
+		}
+		for _, name := range []string{"/preppi", "/moved", "/CONFIG.TXT", "/cmdline.txt"} {
+			if err := fs.RemoveAll(name); err != nil {
+				t.Fatalf("%v: couldn't remove %q: %v", fs.Name(), name, err)
+			}
+		}
+		if err := fs.RemoveAll("/doesnt/exist"); err != nil {
+			t.Errorf("%v: wanted no error removing what doesn't exist, got: %v", fs.Name(), err)
+		}
+
+		// Everything is gone, so nothing should have leaked.
+		fs, err = NewFatFs(dev, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := freeClusters(fs); got != initialFree {
+			t.Errorf("%v: wanted %d free clusters once empty, got %d", fs.Name(), initialFree, got)
+		}
+		if fat32 {
+			if got := binary.LittleEndian.Uint32(dev[512+488:]); int(got) != initialFree {
+				t.Errorf("wanted FSInfo free count %d, got %d", initialFree, got)
+			}
+		}
+		if !bytes.Equal(dev[fs.fatStart:fs.fatStart+fs.fatSize], dev[fs.fatStart+fs.fatSize:fs.fatStart+2*fs.fatSize]) {
+			t.Errorf("%v: wanted FAT copies to match", fs.Name())
+		}
+	}
+}
+
+func TestFatFsShortNames(t *testing.T) {
+	fs, _ := newFatFsForTest(t, false)
+	for _, name := range []string{"etc-hosts-one", "etc-hosts-two", "README", "readme.md", "a.b.c"} {
+		if err := afero.WriteFile(fs, "/"+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := fs.loadDir(fs.rootDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, e := range d.entries() {
+		got[e.name] = string(e.short[:])
+	}
+	want := map[string]string{
+		"etc-hosts-one": "ETC-HO~1   ",
+		"etc-hosts-two": "ETC-HO~2   ",
+		"README":        "README     ",
+		"readme.md":     "README  MD ",
+		"a.b.c":         "AB~1    C  ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted short names %q, got %q", want, got)
+	}
+}
+
+func TestFatFsDirectoryGrowth(t *testing.T) {
+	for _, fat32 := range []bool{false, true} {
+		fs, dev := newFatFsForTest(t, fat32)
+		// Each name needs three entries, so a 512 byte cluster fits five.
+		for i := 0; i < 40; i++ {
+			name := fmt.Sprintf("/dir/a-rather-long-file-name-%02d", i)
+			if err := fs.MkdirAll("/dir", 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := afero.WriteFile(fs, name, []byte(name), 0644); err != nil {
+				t.Fatalf("%v: couldn't write %q: %v", fs.Name(), name, err)
+			}
+		}
+		fs, err := NewFatFs(dev, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos, err := afero.ReadDir(fs, "/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 40 {
+			t.Errorf("%v: wanted 40 files, got %d", fs.Name(), len(infos))
+		}
+	}
+}
+
+func TestFatFsRootDirFull(t *testing.T) {
+	fs, _ := newFatFsForTest(t, false)
+	// The FAT16 root directory has 512 entries, and each of these names needs
+	// three.
+	var err error
+	for i := 0; i < 200 && err == nil; i++ {
+		err = afero.WriteFile(fs, fmt.Sprintf("/a-rather-long-file-name-%03d", i), nil, 0644)
+	}
+	if err == nil {
+		t.Error("wanted error filling the FAT16 root directory")
+	}
+}
+
+func TestFatFsOpenFlags(t *testing.T) {
+	fs, _ := newFatFsForTest(t, true)
+	if _, err := fs.Open("/missing"); !os.IsNotExist(err) {
+		t.Errorf("wanted not exist error, got: %v", err)
+	}
+	if err := afero.WriteFile(fs, "/file", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("/file", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644); !os.IsExist(err) {
+		t.Errorf("wanted exists error, got: %v", err)
+	}
+	f, err := fs.OpenFile("/file", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" appended")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("wanted error reading file opened write-only")
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := afero.ReadFile(fs, "/file"); string(got) != "content appended" {
+		t.Errorf("wanted %q, got %q", "content appended", got)
+	}
+	if _, err := fs.OpenFile("/file/under", os.O_WRONLY|os.O_CREATE, 0644); err == nil {
+		t.Error("wanted error creating a file under a file")
+	}
+	if err := fs.Mkdir("/file", 0755); !os.IsExist(err) {
+		t.Errorf("wanted exists error, got: %v", err)
+	}
+}
+
+// fixtureForTest reads one of the gzipped file system images in testdata.
+func fixtureForTest(t *testing.T, name string) memDevice {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatalf("%v: %v", name, err)
+	}
+	return memDevice(b)
+}
+
+// TestFatFsFixtures checks FatFs against images laid out as mkfs.fat and
+// mtools lay them out, which testdata/mkfat.go writes.
+func TestFatFsFixtures(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/network/wpa_supplicant.conf": &testFile{[]byte("ssid=\"{{.Vars.SSID}}\"\n"), 0644, 0755, 0, 0},
+	})
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "network/wpa_supplicant.conf", Destination: "/etc/wpa_supplicant/wpa_supplicant.conf", Vars: []string{"SSID"}},
+		},
+		root: "/recipes/test",
+	}
+
+	files := map[string][]byte{
+		"/config.txt":                      []byte("dtparam=audio=on\n"),
+		"/cmdline.txt":                     []byte("console=serial0,115200 root=/dev/mmcblk0p2\n"),
+		"/empty":                           nil,
+		"/overlays/Long Overlay Name.dtbo": bytes.Repeat([]byte("dtoverlay\n"), 300),
+	}
+	for i := 1; i <= 40; i++ {
+		files[fmt.Sprintf("/overlays/overlay-%02d-with-a-long-name.dtbo", i)] = []byte(fmt.Sprintf("%d\n", i))
+	}
+	written := map[string][]byte{
+		"/config.txt":                         []byte("dtparam=audio=off\n"),
+		"/overlays/Long Overlay Name 2.dtbo":  []byte("another\n"),
+		"/preppi/network/wpa_supplicant.conf": []byte("ssid=\"home\"\n"),
+	}
+
+	for _, tc := range []struct {
+		image, name string
+	}{
+		{"fat16.img.gz", "FAT16"},
+		{"fat32.img.gz", "FAT32"},
+	} {
+		dev := fixtureForTest(t, tc.image)
+		fs, err := OpenBootPartition(dev)
+		if err != nil {
+			t.Fatalf("%v: wanted no error, got: %v", tc.image, err)
+		}
+		if fs.Name() != tc.name {
+			t.Errorf("%v: wanted %v, got %v", tc.image, tc.name, fs.Name())
+		}
+		initialFree := freeClusters(fs)
+		var names []string
+		infos, err := afero.ReadDir(fs, "/")
+		if err != nil {
+			t.Fatalf("%v: wanted no error reading the root, got: %v", tc.image, err)
+		}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		sort.Strings(names)
+		// The volume label and the deleted file aren't listed.
+		if want := []string{"cmdline.txt", "config.txt", "empty", "overlays"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%v: wanted %v in the root, got %v", tc.image, want, names)
+		}
+		if infos, err := afero.ReadDir(fs, "/overlays"); err != nil || len(infos) != 41 {
+			t.Errorf("%v: wanted 41 overlays, got %d, %v", tc.image, len(infos), err)
+		}
+		for name, want := range files {
+			if got, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: wanted %d bytes, got %d, %v", tc.image, name, len(want), len(got), err)
+			}
+		}
+		if _, err := fs.Stat("/OVERLAYS/long overlay name.dtbo"); err != nil {
+			t.Errorf("%v: names should be case-insensitive: %v", tc.image, err)
+		}
+
+		for name, content := range written {
+			if name == "/preppi/network/wpa_supplicant.conf" {
+				continue
+			}
+			if err := afero.WriteFile(fs, name, content, 0644); err != nil {
+				t.Errorf("%v: couldn't write %v: %v", tc.image, name, err)
+			}
+		}
+		d := &RecipeData{Vars: map[string]string{"SSID": "home"}}
+		if err := r.Bake("/preppi", d, &BakeOptions{Output: fs}); err != nil {
+			t.Errorf("%v: wanted no error baking, got: %v", tc.image, err)
+		}
+
+		// Read everything back from the device.
+		fs, err = OpenBootPartition(dev)
+		if err != nil {
+			t.Fatalf("%v: couldn't reopen: %v", tc.image, err)
+		}
+		for name, want := range files {
+			if w, ok := written[name]; ok {
+				want = w
+			}
+			if got, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: wanted %q after writing, got %q, %v", tc.image, name, want, got, err)
+			}
+		}
+		for name, want := range written {
+			if got, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: wanted %q written, got %q, %v", tc.image, name, want, got, err)
+			}
+		}
+		if freeClusters(fs) >= initialFree {
+			t.Errorf("%v: wanted clusters allocated, got %d free of %d", tc.image, freeClusters(fs), initialFree)
+		}
+		// Both copies of the FAT must agree.
+		fat1 := dev[fs.fatStart : fs.fatStart+fs.fatSize]
+		fat2 := dev[fs.fatStart+fs.fatSize : fs.fatStart+2*fs.fatSize]
+		if !bytes.Equal(fat1, fat2) {
+			t.Errorf("%v: wanted the copies of the FAT to match", tc.image)
+		}
+		if fs.fat32 {
+			if got := binary.LittleEndian.Uint32(dev[fs.fsInfoStart+488:]); int(got) != freeClusters(fs) {
+				t.Errorf("%v: wanted FSInfo to count %d free clusters, got %d", tc.image, freeClusters(fs), got)
+			}
+		}
+	}
+}
+
+// runFATToolForTest runs one of dosfstools or mtools, skipping the test if it
+// isn't installed.
+func runFATToolForTest(t *testing.T, name string, args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath(name); err != nil {
+		t.Skipf("%v isn't installed: %v", name, err)
+	}
+	cmd := exec.Command(name, args...)
+	// mtools otherwise refuses images whose geometry it finds odd.
+	cmd.Env = append(os.Environ(), "MTOOLS_SKIP_CHECK=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v %v: %v\n%s", name, strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// TestFatFsMkfsFat checks FatFs against file systems made and written by
+// mkfs.fat and mtools, rather than by formatFATForTest, and that what inject
+// bakes into them can be read back by mtools.
+func TestFatFsMkfsFat(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/network/wpa_supplicant.conf": &testFile{[]byte("ssid=\"{{.Vars.SSID}}\"\n"), 0644, 0755, 0, 0},
+	})
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "network/wpa_supplicant.conf", Destination: "/etc/wpa_supplicant/wpa_supplicant.conf", Vars: []string{"SSID"}},
+		},
+		root: "/recipes/test",
+	}
+
+	dir, err := ioutil.TempDir("", "TestFatFsMkfsFat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	overlay := filepath.Join(dir, "overlay")
+	if err := ioutil.WriteFile(overlay, bytes.Repeat([]byte("dtoverlay\n"), 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(config, []byte("dtparam=audio=on\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+	}{
+		{"FAT16", []string{"-F", "16"}},
+		{"FAT32", []string{"-F", "32", "-s", "1"}},
+	} {
+		img := filepath.Join(dir, tc.name+".img")
+		size := "16384"
+		if tc.name == "FAT32" {
+			size = "40960"
+		}
+		runFATToolForTest(t, "mkfs.fat", append(append([]string{"-C", "-n", "BOOT"}, tc.args...), img, size)...)
+		runFATToolForTest(t, "mmd", "-i", img, "::/overlays")
+		runFATToolForTest(t, "mcopy", "-i", img, overlay, "::/overlays/Long Overlay Name.dtbo")
+		runFATToolForTest(t, "mcopy", "-i", img, config, "::/config.txt")
+
+		f, err := os.OpenFile(img, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := OpenBootPartition(f)
+		if err != nil {
+			f.Close()
+			t.Fatalf("%v: wanted no error, got: %v", tc.name, err)
+		}
+		if fs.Name() != tc.name {
+			t.Errorf("wanted %v, got %v", tc.name, fs.Name())
+		}
+		var names []string
+		infos, err := afero.ReadDir(fs, "/")
+		if err != nil {
+			t.Errorf("%v: wanted no error reading the root, got: %v", tc.name, err)
+		}
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		sort.Strings(names)
+		if want := []string{"config.txt", "overlays"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("%v: wanted %v in the root, got %v", tc.name, want, names)
+		}
+		for name, local := range map[string]string{"/config.txt": config, "/overlays/Long Overlay Name.dtbo": overlay} {
+			want, _ := ioutil.ReadFile(local)
+			if got, err := afero.ReadFile(fs, name); err != nil || !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: wanted %d bytes written by mcopy, got %d, %v", tc.name, name, len(want), len(got), err)
+			}
+		}
+
+		d := &RecipeData{Vars: map[string]string{"SSID": "home"}}
+		if err := r.Bake("/preppi", d, &BakeOptions{Output: fs}); err != nil {
+			t.Errorf("%v: wanted no error baking, got: %v", tc.name, err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := runFATToolForTest(t, "mtype", "-i", img, "::/preppi/network/wpa_supplicant.conf")
+		if want := "ssid=\"home\"\n"; got != want {
+			t.Errorf("%v: wanted mtools to read %q, got %q", tc.name, want, got)
+		}
+		runFATToolForTest(t, "mtype", "-i", img, "::/preppi/preppi.conf")
+		if _, err := exec.LookPath("fsck.fat"); err == nil {
+			runFATToolForTest(t, "fsck.fat", "-n", img)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// Policies for handling a remote source which can't be fetched.
+const (
+	// FetchErrorFail stops preparation with an error.
+	FetchErrorFail = "fail"
+	// FetchErrorSkip skips the mapping and carries on with the rest.
+	FetchErrorSkip = "skip"
+)
+
+var (
+	// CacheDir is where remote sources are kept once fetched, so they needn't
+	// be fetched again.
+	CacheDir = "/var/cache/preppi"
+
+	// FetchTimeout bounds each attempt to fetch a remote source.
+	FetchTimeout = 30 * time.Second
+
+	// FetchRetries is the number of times a failed fetch is retried.
+	FetchRetries = 3
+
+	// DefaultOnFetchError is the policy for mappings which don't specify one.
+	DefaultOnFetchError = FetchErrorFail
+
+	// fetchRetryDelay is the pause before the first retry, doubled for each
+	// retry after that. It is a var for testing.
+	fetchRetryDelay = 2 * time.Second
+)
+
+// fetchError is returned when a remote source can't be fetched, as opposed to
+// being fetched and found to be wrong.
+type fetchError struct {
+	url string
+	err error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("couldn't fetch %q: %v", e.url, e.err)
+}
+
+// statusError is returned when a fetch gets a response other than 200 OK.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %q", e.status)
+}
+
+// retryable is true for errors worth retrying: those from the network, and
+// server errors. Other statuses, such as 404, won't change by asking again.
+func retryable(err error) bool {
+	if se, ok := err.(*statusError); ok {
+		return se.code >= 500
+	}
+	return true
+}
+
+// isRemote is true when the source is to be fetched over HTTP(S).
+func isRemote(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// checksum returns the hex-encoded SHA256 sum of b.
+func checksum(b []byte) string {
+	s := sha256.Sum256(b)
+	return hex.EncodeToString(s[:])
+}
+
+// cachePath is where content with the given checksum is cached.
+func cachePath(sum string) string {
+	return path.Join(CacheDir, sum)
+}
+
+// cachedSource returns the cached content of url, which must have the SHA256
+// checksum sum, or nil if it isn't cached.
+func cachedSource(url, sum string) ([]byte, error) {
+	if sum == "" {
+		return nil, fmt.Errorf("remote source %q requires a sha256", url)
+	}
+	sum = strings.ToLower(sum)
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return nil, fmt.Errorf("invalid sha256 %q for remote source %q", sum, url)
+	}
+	b, err := afero.ReadFile(preppiFS, cachePath(sum))
+	if err != nil {
+		return nil, nil
+	}
+	if checksum(b) != sum {
+		log.Printf("ignoring corrupt cache entry %q", cachePath(sum))
+		return nil, nil
+	}
+	return b, nil
+}
+
+// fetchSource returns the content at url, which must have the SHA256 checksum
+// sum. Content is served from CacheDir if present, and added to it otherwise.
+func fetchSource(url, sum string) ([]byte, error) {
+	if b, err := cachedSource(url, sum); err != nil || b != nil {
+		return b, err
+	}
+	sum = strings.ToLower(sum)
+
+	b, err := fetch(url)
+	if err != nil {
+		return nil, &fetchError{url, err}
+	}
+	if got := checksum(b); got != sum {
+		return nil, fmt.Errorf("remote source %q has sha256 %v, wanted %v", url, got, sum)
+	}
+
+	// Failing to cache is unfortunate, but not fatal.
+	if err := preppiFS.MkdirAll(CacheDir, 0755); err != nil {
+		log.Printf("couldn't create cache directory %q: %v", CacheDir, err)
+	} else if err := afero.WriteFile(preppiFS, cachePath(sum), b, 0644); err != nil {
+		log.Printf("couldn't cache %q: %v", url, err)
+	}
+	return b, nil
+}
+
+// fetch gets url, retrying up to FetchRetries times after network and server
+// errors.
+func fetch(url string) ([]byte, error) {
+	client := &http.Client{Timeout: FetchTimeout}
+	delay := fetchRetryDelay
+	var err error
+	for attempt := 0; attempt <= FetchRetries; attempt++ {
+		if attempt > 0 {
+			log.Printf("retrying %q in %v after: %v", url, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		var b []byte
+		if b, err = fetchOnce(client, url); err == nil {
+			return b, nil
+		}
+		if !retryable(err) {
+			break
+		}
+	}
+	return nil, err
+}
+
+func fetchOnce(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{resp.StatusCode, resp.Status}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
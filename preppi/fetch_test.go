@@ -0,0 +1,192 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+const fetchTestContent = "Here we are extending into shooting stars"
+
+// fetchTestSum is the SHA256 checksum of fetchTestContent.
+var fetchTestSum = checksum([]byte(fetchTestContent))
+
+// setUpFetchForTest replaces the preppiFS with an empty MemMapFs and disables
+// retry delays. The returned func restores everything.
+func setUpFetchForTest() func() {
+	origPreppiFS, origDelay, origRetries := preppiFS, fetchRetryDelay, FetchRetries
+	preppiFS = NewMemMapFs()
+	fetchRetryDelay = 0
+	FetchRetries = 1
+	return func() {
+		preppiFS, fetchRetryDelay, FetchRetries = origPreppiFS, origDelay, origRetries
+	}
+}
+
+func TestFetchSource(t *testing.T) {
+	defer setUpFetchForTest()()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, fetchTestContent)
+	}))
+
+	got, err := fetchSource(srv.URL, fetchTestSum)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if string(got) != fetchTestContent {
+		t.Errorf("wanted %q, got %q", fetchTestContent, string(got))
+	}
+	if exists, _ := afero.Exists(preppiFS, cachePath(fetchTestSum)); !exists {
+		t.Error("wanted fetched content to be cached")
+	}
+
+	// With the server gone, the content must come from the cache.
+	srv.Close()
+	got, err = fetchSource(srv.URL, fetchTestSum)
+	if err != nil {
+		t.Fatalf("wanted no error from cache, got: %v", err)
+	}
+	if string(got) != fetchTestContent {
+		t.Errorf("wanted %q from cache, got %q", fetchTestContent, string(got))
+	}
+	if requests != 1 {
+		t.Errorf("wanted 1 request, got %d", requests)
+	}
+}
+
+func TestFetchSourceErrors(t *testing.T) {
+	defer setUpFetchForTest()()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+			return
+		case "/broken":
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, fetchTestContent)
+	}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		name         string
+		url          string
+		sum          string
+		wantFetchErr bool
+		wantRequests int
+	}{
+		{
+			name: "no sha256",
+			url:  srv.URL,
+		},
+		{
+			name: "bad sha256",
+			url:  srv.URL,
+			sum:  "abc123",
+		},
+		{
+			name:         "checksum mismatch",
+			url:          srv.URL,
+			sum:          checksum([]byte("something else")),
+			wantRequests: 1,
+		},
+		{
+			name:         "not found",
+			url:          srv.URL + "/missing",
+			sum:          fetchTestSum,
+			wantFetchErr: true,
+			wantRequests: 1,
+		},
+		{
+			name:         "server error",
+			url:          srv.URL + "/broken",
+			sum:          fetchTestSum,
+			wantFetchErr: true,
+			wantRequests: 2,
+		},
+	} {
+		requests = 0
+		_, err := fetchSource(tt.url, tt.sum)
+		if err == nil {
+			t.Errorf("%v: wanted error, but got none", tt.name)
+			continue
+		}
+		if _, ok := err.(*fetchError); ok != tt.wantFetchErr {
+			t.Errorf("%v: wanted fetch error %v, got %v", tt.name, tt.wantFetchErr, err)
+		}
+		if requests != tt.wantRequests {
+			t.Errorf("%v: wanted %d requests, got %d", tt.name, tt.wantRequests, requests)
+		}
+	}
+}
+
+func TestMapperApplyFetchPolicy(t *testing.T) {
+	defer setUpFetchForTest()()
+
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		policy       string
+		wantErr      bool
+		wantModified int
+		wantSkipped  int
+	}{
+		{policy: FetchErrorSkip, wantModified: 1, wantSkipped: 1},
+		{policy: FetchErrorFail, wantErr: true},
+		{policy: "", wantErr: true},
+		{policy: "shrug", wantErr: true},
+	} {
+		preppiFS = NewMemMapFs()
+		m := &Mapper{Mappings: []*Mapping{
+			&Mapping{Source: srv.URL, SHA256: fetchTestSum, Destination: "/etc/remote", OnFetchError: tt.policy},
+			&Mapping{Content: "pi\n", Destination: "/etc/hostname", Mode: 0644, DirMode: 0755},
+		}}
+		modified, skipped, err := m.Apply(nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("policy %q: wanted error %v, got: %v", tt.policy, tt.wantErr, err)
+		}
+		if modified != tt.wantModified {
+			t.Errorf("policy %q: wanted %d modified, got %d", tt.policy, tt.wantModified, modified)
+		}
+		if len(skipped) != tt.wantSkipped {
+			t.Fatalf("policy %q: wanted %d skipped, got %d", tt.policy, tt.wantSkipped, len(skipped))
+		}
+		for _, e := range skipped {
+			if e.Mapping != m.Mappings[0] || e.Action != ActionSkip || !strings.Contains(e.Reason, srv.URL) {
+				t.Errorf("policy %q: wanted the remote mapping skipped, got %v %v: %v", tt.policy, e.Mapping.Destination, e.Action, e.Reason)
+			}
+		}
+	}
+}
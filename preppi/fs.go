@@ -22,6 +22,8 @@ package preppi
 
 import (
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/spf13/afero"
 )
@@ -44,10 +46,11 @@ type BasePathFs struct {
 
 // Chown changes the numeric uid and gid of the named file.
 func (b *BasePathFs) Chown(name string, uid, gid int) error {
-	if name, err := b.RealPath(name); err != nil {
+	realName, err := b.RealPath(name)
+	if err != nil {
 		return &os.PathError{Op: "chown", Path: name, Err: err}
 	}
-	return b.source.Chown(name, uid, gid)
+	return b.source.Chown(realName, uid, gid)
 }
 
 // NewBasePathFs creates and return a BasePathFs instance.
@@ -83,6 +86,56 @@ func (m *MemMapFs) Chown(name string, uid, gid int) error {
 	return nil
 }
 
+// Rename renames a file, or a directory along with everything under it.
+// afero.MemMapFs renames only the directory itself, orphaning its contents.
+func (m *MemMapFs) Rename(oldname, newname string) error {
+	info, err := m.MemMapFs.Stat(oldname)
+	if err != nil || !info.IsDir() {
+		return m.MemMapFs.Rename(oldname, newname)
+	}
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	err = afero.Walk(m.MemMapFs, oldname, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := newname + strings.TrimPrefix(p, oldname)
+		if info.IsDir() {
+			return m.MemMapFs.MkdirAll(target, info.Mode().Perm())
+		}
+		return m.MemMapFs.Rename(p, target)
+	})
+	if err != nil {
+		return err
+	}
+	return m.RemoveAll(oldname)
+}
+
+// RemoveAll removes path and everything under it. afero.MemMapFs removes every
+// path merely starting with path, taking siblings like "path.txt" along.
+func (m *MemMapFs) RemoveAll(path string) error {
+	path = filepath.Clean(path)
+	var names []string
+	err := afero.Walk(m.MemMapFs, path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		names = append(names, p)
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := m.MemMapFs.Remove(names[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewMemMapFs creates and return a MemMapFs instance.
 func NewMemMapFs() Fs {
 	return &MemMapFs{afero.NewMemMapFs().(*afero.MemMapFs)}
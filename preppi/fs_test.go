@@ -0,0 +1,56 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestMemMapFsRemoveAll(t *testing.T) {
+	fs := NewMemMapFs()
+	files := map[string]*testFile{
+		"/out/preppi.conf":      &testFile{[]byte("{}\n"), 0644, 0755, 0, 0},
+		"/out/etc/hostname":     &testFile{[]byte("pi\n"), 0644, 0755, 0, 0},
+		"/out.vars.json":        &testFile{[]byte("{}\n"), 0600, 0755, 0, 0},
+		"/out-staging/hostname": &testFile{[]byte("pi\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, fs, files)
+
+	if err := fs.RemoveAll("/out/"); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	for _, name := range []string{"/out", "/out/etc", "/out/etc/hostname", "/out/preppi.conf"} {
+		if exists, _ := afero.Exists(fs, name); exists {
+			t.Errorf("wanted %v removed", name)
+		}
+	}
+	// Siblings sharing the name as a prefix stay.
+	for _, name := range []string{"/out.vars.json", "/out-staging/hostname"} {
+		if exists, _ := afero.Exists(fs, name); !exists {
+			t.Errorf("wanted %v kept", name)
+		}
+	}
+	if err := fs.RemoveAll("/missing"); err != nil {
+		t.Errorf("wanted no error removing what doesn't exist, got: %v", err)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateFuncs returns the functions available to templates, besides the
+// text/template builtins. Files read by readFile are relative to root.
+// Arguments are ordered so that each works at the end of a pipeline, eg
+// {{.Vars.DNSServers | split "," | join " "}}.
+//
+//	default DEF S     S, or DEF if S is empty.
+//	upper S, lower S  S in upper or lower case.
+//	split SEP S       S split around each SEP.
+//	join SEP LIST     LIST joined by SEP.
+//	indent N S        S with every line indented by N spaces.
+//	quote S           S double quoted, with Go escapes.
+//	shquote S         S single quoted for a POSIX shell.
+//	wpaquote S        S double quoted for wpa_supplicant.conf.
+//	cidrHost N CIDR   the Nth address in the CIDR's network. Negative N
+//	                  counts back from the last address.
+//	cidrNetmask CIDR  the netmask of an IPv4 CIDR, eg 255.255.255.0.
+//	uuid              a random UUID.
+//	sha256 S          the hex-encoded SHA-256 checksum of S.
+//	b64enc S          S base64 encoded.
+//	b64dec S          S base64 decoded.
+//	readFile NAME     the content of the file NAME, which must be under root.
+//	sha512crypt S     S hashed for /etc/shadow with SHA-512-crypt.
+//	yescrypt S        S hashed for /etc/shadow with yescrypt.
+func templateFuncs(root string) template.FuncMap {
+	return template.FuncMap{
+		"default":     defaultFunc,
+		"upper":       strings.ToUpper,
+		"lower":       strings.ToLower,
+		"split":       splitFunc,
+		"join":        joinFunc,
+		"indent":      indentFunc,
+		"quote":       strconv.Quote,
+		"shquote":     shquoteFunc,
+		"wpaquote":    wpaquoteFunc,
+		"cidrHost":    cidrHostFunc,
+		"cidrNetmask": cidrNetmaskFunc,
+		"uuid":        uuidFunc,
+		"sha256":      sha256Func,
+		"b64enc":      b64encFunc,
+		"b64dec":      b64decFunc,
+		"readFile":    readFileFunc(root),
+		"sha512crypt": sha512cryptFunc,
+		"yescrypt":    yescryptFunc,
+	}
+}
+
+func defaultFunc(def, s string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func splitFunc(sep, s string) []string {
+	return strings.Split(s, sep)
+}
+
+func joinFunc(sep string, list []string) string {
+	return strings.Join(list, sep)
+}
+
+func indentFunc(n int, s string) string {
+	pad := strings.Repeat(" ", n)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1)
+}
+
+func shquoteFunc(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// wpaquoteFunc quotes s as wpa_supplicant does, taking everything between
+// the first and last double quotes literally. There are no escapes, so only
+// line breaks and NULs can't be quoted.
+func wpaquoteFunc(s string) (string, error) {
+	if strings.ContainsAny(s, "\r\n\x00") {
+		return "", fmt.Errorf("wpa_supplicant can't quote %q", s)
+	}
+	return `"` + s + `"`, nil
+}
+
+func cidrHostFunc(n int, cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := network.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	offset := big.NewInt(int64(n))
+	if n < 0 {
+		offset.Add(offset, size)
+	}
+	if offset.Sign() < 0 || offset.Cmp(size) >= 0 {
+		return "", fmt.Errorf("%v has no host number %d", cidr, n)
+	}
+	ip := network.IP
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	addr := new(big.Int).SetBytes(ip)
+	b := addr.Add(addr, offset).Bytes()
+	host := make(net.IP, len(ip))
+	copy(host[len(host)-len(b):], b)
+	return host.String(), nil
+}
+
+func cidrNetmaskFunc(cidr string) (string, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	if len(network.Mask) != net.IPv4len {
+		return "", fmt.Errorf("%v is not an IPv4 CIDR", cidr)
+	}
+	return net.IP(network.Mask).String(), nil
+}
+
+func uuidFunc() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	// Version 4, variant RFC 4122.
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
+		binary.BigEndian.Uint32(b[0:]), b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func sha256Func(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+func b64encFunc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func b64decFunc(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+func readFileFunc(root string) func(string) (string, error) {
+	return func(name string) (string, error) {
+		clean := path.Clean(name)
+		if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return "", fmt.Errorf("can't read %q, which is outside %q", name, root)
+		}
+		b, err := readSource(path.Join(root, clean))
+		return string(b), err
+	}
+}
+
+func sha512cryptFunc(password string) (string, error) {
+	return HashPassword("sha512crypt", password)
+}
+
+func yescryptFunc(password string) (string, error) {
+	return HashPassword("yescrypt", password)
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+	"text/template"
+)
+
+// execFuncForTest executes tmpl, returning its output.
+func execFuncForTest(t *testing.T, tmpl string, vars map[string]string) (string, error) {
+	tt, err := template.New("test").Funcs(templateFuncs("/recipes/test")).Parse(tmpl)
+	if err != nil {
+		t.Fatalf("%q: couldn't parse: %v", tmpl, err)
+	}
+	var b bytes.Buffer
+	err = tt.Execute(&b, &RecipeData{Vars: vars})
+	return b.String(), err
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/authorized_keys": &testFile{[]byte("ssh-ed25519 AAAA user@host\n"), 0644, 0755, 0, 0},
+		"/recipes/secret":               &testFile{[]byte("hunter2\n"), 0600, 0755, 0, 0},
+	})
+
+	vars := map[string]string{
+		"Empty":    "",
+		"Hostname": "Pi",
+		"DNS":      "8.8.8.8,8.8.4.4",
+		"Lines":    "one\ntwo",
+		"SSID":     `Bob's "Wifi"`,
+		"Eth0CIDR": "192.168.1.5/24",
+		"V6CIDR":   "fd00::5/64",
+		"Password": "raspberry",
+		"Encoded":  "cGk=",
+	}
+	for _, tc := range []struct {
+		tmpl    string
+		want    string
+		wantErr bool
+	}{
+		{tmpl: `{{.Vars.Empty | default "raspberrypi"}}`, want: "raspberrypi"},
+		{tmpl: `{{.Vars.Hostname | default "raspberrypi"}}`, want: "Pi"},
+		{tmpl: `{{upper .Vars.Hostname}} {{lower .Vars.Hostname}}`, want: "PI pi"},
+		{tmpl: `{{range split "," .Vars.DNS}}[{{.}}]{{end}}`, want: "[8.8.8.8][8.8.4.4]"},
+		{tmpl: `{{.Vars.DNS | split "," | join " "}}`, want: "8.8.8.8 8.8.4.4"},
+		{tmpl: `{{.Vars.Lines | indent 2}}`, want: "  one\n  two"},
+		{tmpl: `{{quote .Vars.SSID}}`, want: `"Bob's \"Wifi\""`},
+		{tmpl: `{{shquote .Vars.SSID}}`, want: `'Bob'\''s "Wifi"'`},
+		{tmpl: `{{wpaquote .Vars.SSID}}`, want: `"Bob's "Wifi""`},
+		{tmpl: `{{wpaquote .Vars.Lines}}`, wantErr: true},
+		{tmpl: `{{.Vars.Eth0CIDR | cidrHost 1}}`, want: "192.168.1.1"},
+		{tmpl: `{{.Vars.Eth0CIDR | cidrHost -2}}`, want: "192.168.1.254"},
+		{tmpl: `{{.Vars.Eth0CIDR | cidrHost 256}}`, wantErr: true},
+		{tmpl: `{{.Vars.V6CIDR | cidrHost 1}}`, want: "fd00::1"},
+		{tmpl: `{{.Vars.Hostname | cidrHost 1}}`, wantErr: true},
+		{tmpl: `{{cidrNetmask .Vars.Eth0CIDR}}`, want: "255.255.255.0"},
+		{tmpl: `{{cidrNetmask .Vars.V6CIDR}}`, wantErr: true},
+		{tmpl: `{{sha256 .Vars.Hostname}}`, want: "4d87941d681ca4e89ca303d033b7d383d3acfbb6d9d9616bd88d7c19cf92c3dd"},
+		{tmpl: `{{b64enc "pi"}}`, want: "cGk="},
+		{tmpl: `{{b64dec .Vars.Encoded}}`, want: "pi"},
+		{tmpl: `{{b64dec .Vars.Hostname}}`, wantErr: true},
+		{tmpl: `{{readFile "authorized_keys"}}`, want: "ssh-ed25519 AAAA user@host\n"},
+		{tmpl: `{{readFile "./keys/../authorized_keys"}}`, want: "ssh-ed25519 AAAA user@host\n"},
+		{tmpl: `{{readFile "/recipes/test/authorized_keys"}}`, wantErr: true},
+		{tmpl: `{{readFile "/etc/passwd"}}`, wantErr: true},
+		{tmpl: `{{readFile "../test/authorized_keys"}}`, wantErr: true},
+		{tmpl: `{{readFile "keys/../../secret"}}`, wantErr: true},
+		{tmpl: `{{readFile "missing"}}`, wantErr: true},
+		{tmpl: `{{.Vars.Password | sha512crypt | printf "%.3s"}}`, want: "$6$"},
+		{tmpl: `{{.Vars.Password | yescrypt | printf "%.7s"}}`, want: "$y$j9T$"},
+	} {
+		got, err := execFuncForTest(t, tc.tmpl, vars)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%q: wanted error, got %q", tc.tmpl, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: wanted no error, got: %v", tc.tmpl, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q: wanted %q, got %q", tc.tmpl, tc.want, got)
+		}
+	}
+}
+
+func TestTemplateFuncUUID(t *testing.T) {
+	re := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, err := execFuncForTest(t, "{{uuid}}", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := execFuncForTest(t, "{{uuid}}", nil)
+	if !re.MatchString(first) {
+		t.Errorf("wanted a version 4 UUID, got %q", first)
+	}
+	if first == second {
+		t.Errorf("wanted different UUIDs, got %q twice", first)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/spf13/afero"
+)
+
+// VarsRecordExt is appended to the name of a bake's output to name the file
+// recording its generated variables.
+const VarsRecordExt = ".vars.json"
+
+// generator matches a variable's Generate: a name, with an optional argument.
+var generator = regexp.MustCompile(`^([a-z_]+)(?:\(([0-9]+)\))?$`)
+
+// passwordChars are those used by random_password.
+const passwordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// parseGenerator returns the name of the generator gen, and its length, or
+// that generator's default length.
+func parseGenerator(gen string) (string, int, error) {
+	m := generator.FindStringSubmatch(gen)
+	if m == nil {
+		return "", 0, fmt.Errorf("invalid generator %q", gen)
+	}
+	n := -1
+	if m[2] != "" {
+		var err error
+		if n, err = strconv.Atoi(m[2]); err != nil || n < 1 || n > 1024 {
+			return "", 0, fmt.Errorf("invalid length in generator %q", gen)
+		}
+	}
+	switch m[1] {
+	case "random_password":
+		if n < 0 {
+			n = 20
+		}
+	case "hex":
+		if n < 0 {
+			n = 16
+		}
+	case "uuid":
+		if n >= 0 {
+			return "", 0, fmt.Errorf("generator uuid takes no length")
+		}
+	default:
+		return "", 0, fmt.Errorf("unknown generator %q", m[1])
+	}
+	return m[1], n, nil
+}
+
+// generate returns a new random value from the generator gen:
+//
+//	random_password(N)  N letters and digits, 20 by default.
+//	hex(N)              N random bytes, 16 by default, hex-encoded.
+//	uuid                a random UUID.
+func generate(gen string) (string, error) {
+	name, n, err := parseGenerator(gen)
+	if err != nil {
+		return "", err
+	}
+	switch name {
+	case "random_password":
+		b := make([]byte, n)
+		max := big.NewInt(int64(len(passwordChars)))
+		for i := range b {
+			c, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return "", err
+			}
+			b[i] = passwordChars[c.Int64()]
+		}
+		return string(b), nil
+	case "hex":
+		b := make([]byte, n)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(b), nil
+	}
+	return uuidFunc()
+}
+
+// varsRecord is a record of generated variables waiting to be written, once
+// the bake they were generated for has succeeded.
+type varsRecord struct {
+	name string
+	key  []byte
+	vars map[string]string
+}
+
+// write writes the record, if there's anything new to record.
+func (v *varsRecord) write() error {
+	if v == nil || v.name == "" || v.vars == nil {
+		return nil
+	}
+	if err := writeVarsRecord(v.name, v.key, v.vars); err != nil {
+		return fmt.Errorf("failed recording generated variables in %q: %v", v.name, err)
+	}
+	return nil
+}
+
+// generateVars returns a copy of d with values for the recipe's generated
+// variables which d lacks. Values are taken from the record, a file on the
+// local file system, if it has them, and otherwise generated. The returned
+// varsRecord holds what the record should then hold, to be written once the
+// values are put to use. An empty record keeps nothing. key, if set, encrypts
+// the record.
+func (r *Recipe) generateVars(d *RecipeData, record string, key []byte) (*RecipeData, *varsRecord, error) {
+	filled := &RecipeData{}
+	if d != nil {
+		*filled = *d
+	}
+	filled.Vars = MergeVars(filled.Vars)
+	var recorded map[string]string
+	changed := false
+	for _, v := range r.Variables {
+		if v.Generate == "" {
+			continue
+		}
+		if _, ok := filled.Vars[v.Name]; ok {
+			continue
+		}
+		if recorded == nil {
+			var err error
+			if recorded, err = readVarsRecord(record, key); err != nil {
+				return nil, nil, err
+			}
+		}
+		value, ok := recorded[v.Name]
+		if !ok {
+			var err error
+			if value, err = generate(v.Generate); err != nil {
+				return nil, nil, fmt.Errorf("variable %q: %v", v.Name, err)
+			}
+			recorded[v.Name] = value
+			changed = true
+		}
+		filled.Vars[v.Name] = value
+	}
+	pending := &varsRecord{name: record, key: key}
+	if changed {
+		pending.vars = recorded
+	}
+	return filled, pending, nil
+}
+
+// encryptedVars is the content of an encrypted record of variables: a JSON
+// object of the variables, encrypted with AES-256-GCM.
+type encryptedVars struct {
+	Cipher string `json:"cipher"`
+	Nonce  []byte `json:"nonce"`
+	Data   []byte `json:"data"`
+}
+
+// varsCipher returns the AEAD for records encrypted with key, whose SHA-256 is
+// the AES-256 key.
+func varsCipher(key []byte) (cipher.AEAD, error) {
+	sum := sha256.Sum256(key)
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealVars encrypts vars with key.
+func sealVars(key []byte, vars map[string]string) (*encryptedVars, error) {
+	data, err := json.Marshal(vars)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := varsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	e := &encryptedVars{Cipher: "AES-256-GCM", Nonce: make([]byte, aead.NonceSize())}
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Data = aead.Seal(nil, e.Nonce, data, nil)
+	return e, nil
+}
+
+// openVars decrypts variables which sealVars encrypted with key.
+func openVars(key []byte, e *encryptedVars) (map[string]string, error) {
+	aead, err := varsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce")
+	}
+	data, err := aead.Open(nil, e.Nonce, e.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("wrong key?")
+	}
+	vars := make(map[string]string)
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// readVarsRecord reads a record of generated variables, which is empty if it
+// doesn't exist.
+func readVarsRecord(name string, key []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	if name == "" {
+		return vars, nil
+	}
+	data, err := afero.ReadFile(preppiFS, name)
+	if os.IsNotExist(err) {
+		return vars, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var envelope struct {
+		Encrypted *encryptedVars `json:"encrypted"`
+	}
+	if err := json.Unmarshal(data, &envelope); err == nil && envelope.Encrypted != nil {
+		if key == nil {
+			return nil, fmt.Errorf("%q is encrypted, and no key was given", name)
+		}
+		if vars, err = openVars(key, envelope.Encrypted); err != nil {
+			return nil, fmt.Errorf("can't decrypt %q: %v", name, err)
+		}
+		return vars, nil
+	}
+	if err := json.Unmarshal(data, &vars); err != nil {
+		return nil, fmt.Errorf("failed reading %q: %v", name, err)
+	}
+	return vars, nil
+}
+
+// writeVarsRecord writes a record of generated variables, only readable by
+// its owner, and encrypted if key is set.
+func writeVarsRecord(name string, key []byte, vars map[string]string) error {
+	if key == nil {
+		return WriteVarsFile(name, vars)
+	}
+	e, err := sealVars(key, vars)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(map[string]*encryptedVars{"encrypted": e}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(preppiFS, name, append(data, '\n'), 0600)
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bytes"
+	"regexp"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestGenerate(t *testing.T) {
+	for gen, pattern := range map[string]string{
+		"random_password":     `^[A-Za-z0-9]{20}$`,
+		"random_password(32)": `^[A-Za-z0-9]{32}$`,
+		"hex":                 `^[0-9a-f]{32}$`,
+		"hex(4)":              `^[0-9a-f]{8}$`,
+		"uuid":                `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+	} {
+		got, err := generate(gen)
+		if err != nil {
+			t.Errorf("%v: wanted no error, got: %v", gen, err)
+			continue
+		}
+		if !regexp.MustCompile(pattern).MatchString(got) {
+			t.Errorf("%v: wanted value matching %v, got %q", gen, pattern, got)
+		}
+	}
+	for _, gen := range []string{"", "password", "hex(0)", "hex(", "uuid(4)", "random_password(99999)"} {
+		if _, err := generate(gen); err == nil {
+			t.Errorf("%q: wanted error", gen)
+		}
+	}
+}
+
+func TestRecipeBakeGeneratedVars(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/token": &testFile{[]byte("{{.Vars.Token}} {{.Vars.ID}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "token", Destination: "/etc/token", Vars: []string{"Token", "ID"}},
+		},
+		Variables: []*Variable{
+			&Variable{Name: "Token", Generate: "hex(8)"},
+			&Variable{Name: "ID", Generate: "uuid"},
+		},
+		root: "/recipes/test",
+	}
+	bake := func(dest string, o *BakeOptions) string {
+		t.Helper()
+		if err := r.Bake(dest, nil, o); err != nil {
+			t.Fatalf("wanted no error, got: %v", err)
+		}
+		got, err := afero.ReadFile(preppiFS, dest+"/token")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(got)
+	}
+
+	first := bake("/out", nil)
+	if again := bake("/out", nil); again != first {
+		t.Errorf("wanted generated values kept between bakes, got %q then %q", first, again)
+	}
+	record, err := VarsFromFile("/out.vars.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := record["Token"] + " " + record["ID"] + "\n"; first != want {
+		t.Errorf("wanted %q recorded, got %v", first, record)
+	}
+	// Given values aren't generated, or recorded.
+	if err := r.Bake("/given", &RecipeData{Vars: map[string]string{"Token": "t", "ID": "i"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(preppiFS, "/given.vars.json"); exists {
+		t.Error("wanted no record when nothing was generated")
+	}
+	if other := bake("/other", nil); other == first {
+		t.Error("wanted different values for a different output")
+	}
+
+	// Failed bakes record nothing.
+	if err := afero.WriteFile(preppiFS, "/full/stray", []byte("stray\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Bake("/full", nil, nil); err == nil {
+		t.Error("wanted error baking over a directory which isn't a bake")
+	}
+	broken := *r
+	broken.Ingredients = append(r.Ingredients, &Ingredient{Source: "missing", Destination: "/etc/missing"})
+	if err := broken.Bake("/broken", nil, nil); err == nil {
+		t.Error("wanted error baking a missing source")
+	}
+	for _, name := range []string{"/full.vars.json", "/broken.vars.json"} {
+		if exists, _ := afero.Exists(preppiFS, name); exists {
+			t.Errorf("wanted no record %v of a failed bake", name)
+		}
+	}
+
+	key := []byte("correct horse battery staple")
+	encrypted := bake("/secret", &BakeOptions{VarsKey: key})
+	data, err := afero.ReadFile(preppiFS, "/secret.vars.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(encrypted[:16])) {
+		t.Errorf("wanted the record encrypted, got %s", data)
+	}
+	if again := bake("/secret", &BakeOptions{VarsKey: key}); again != encrypted {
+		t.Errorf("wanted generated values kept between encrypted bakes, got %q then %q", encrypted, again)
+	}
+	for _, k := range [][]byte{nil, []byte("wrong")} {
+		if err := r.Bake("/secret", nil, &BakeOptions{VarsKey: k}); err == nil {
+			t.Errorf("wanted error reading encrypted record with key %q", k)
+		}
+	}
+
+	if err := r.BakeArchive("/out.zip", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := afero.Exists(preppiFS, "/out.zip.vars.json"); !exists {
+		t.Error("wanted a record beside the archive")
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package preppi
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	// testsDir is the directory of a recipe holding its tests, each a
+	// directory of variables to bake with, and the golden files expected.
+	testsDir = "tests"
+	// goldenDir is the directory of a test holding its golden files, laid out
+	// as the bake's output.
+	goldenDir = "golden"
+	// testVersion stands in for the version of PrepPi in tests' bakes, so
+	// that golden files don't change with it.
+	testVersion = "PrepPi (recipe test)"
+)
+
+// testVarsFiles are the names a test's variables may have, in order of
+// preference.
+var testVarsFiles = []string{"vars.json", "vars.yaml", "vars.yml", "vars.env"}
+
+// TestResult is the outcome of one of a recipe's tests.
+type TestResult struct {
+	// Name is the name of the test's directory.
+	Name string
+	// Diffs describe each file which the bake got different from the golden
+	// files.
+	Diffs []string
+	// Updated is whether the golden files were rewritten to match the bake.
+	Updated bool
+	// Err is why the test couldn't be run.
+	Err error
+}
+
+// Passed is whether the bake matched the golden files.
+func (t *TestResult) Passed() bool {
+	return t.Err == nil && (len(t.Diffs) == 0 || t.Updated)
+}
+
+// Test bakes the recipe, in memory, with the variables of each of its tests,
+// which are the directories under tests, and compares the output with each
+// test's golden files. With update, golden files which differ are rewritten
+// instead. Results are sorted by test name.
+//
+// Generated variables which a test doesn't give are "generated-" followed by
+// their names, and the manifest isn't compared, so that tests are repeatable.
+func (r *Recipe) Test(update bool) ([]*TestResult, error) {
+	infos, err := afero.ReadDir(preppiFS, path.Join(r.root, testsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading tests of recipe %q: %v", r.Name, err)
+	}
+	var results []*TestResult
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		res := &TestResult{Name: info.Name()}
+		res.Diffs, res.Err = r.runTest(path.Join(r.root, testsDir, info.Name()), update)
+		res.Updated = update && res.Err == nil && len(res.Diffs) > 0
+		results = append(results, res)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	return results, nil
+}
+
+// runTest bakes the test in dir, and returns how the output differs from its
+// golden files, rewriting them if update is set.
+func (r *Recipe) runTest(dir string, update bool) ([]string, error) {
+	vars, err := testVars(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range r.Variables {
+		if _, ok := vars[v.Name]; !ok && v.Generate != "" {
+			vars[v.Name] = "generated-" + v.Name
+		}
+	}
+	out := NewMemMapFs()
+	d := &RecipeData{Vars: vars, version: testVersion}
+	if err := r.Bake("/"+goldenDir, d, &BakeOptions{Output: out}); err != nil {
+		return nil, err
+	}
+	got, err := archiveEntries(out, "/"+goldenDir)
+	if err != nil {
+		return nil, err
+	}
+	golden := path.Join(dir, goldenDir)
+	want, err := archiveEntries(preppiFS, golden)
+	if os.IsNotExist(err) && update {
+		want, err = nil, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no golden files in %q", golden)
+	}
+	if err != nil {
+		return nil, err
+	}
+	diffs := diffEntries(want, got)
+	if update && len(diffs) > 0 {
+		if err := writeGolden(golden, got); err != nil {
+			return nil, fmt.Errorf("failed updating golden files: %v", err)
+		}
+	}
+	return diffs, nil
+}
+
+// testVars reads the variables of the test in dir, which has none if it has
+// no variables file.
+func testVars(dir string) (map[string]string, error) {
+	for _, name := range testVarsFiles {
+		p := path.Join(dir, name)
+		if exists, err := afero.Exists(preppiFS, p); err != nil || !exists {
+			continue
+		}
+		return VarsFromFile(p)
+	}
+	return make(map[string]string), nil
+}
+
+// goldenFiles returns the content of the files among entries, by name under
+// the golden directory, leaving out the manifest.
+func goldenFiles(entries []*archiveEntry) map[string][]byte {
+	files := make(map[string][]byte)
+	for _, e := range entries {
+		name := strings.TrimPrefix(e.name, goldenDir+"/")
+		if e.dir || name == manifestFile {
+			continue
+		}
+		files[name] = e.content
+	}
+	return files
+}
+
+// diffEntries describes how the files of got differ from those of want.
+func diffEntries(want, got []*archiveEntry) []string {
+	wantFiles, gotFiles := goldenFiles(want), goldenFiles(got)
+	names := make([]string, 0, len(wantFiles)+len(gotFiles))
+	for name := range wantFiles {
+		names = append(names, name)
+	}
+	for name := range gotFiles {
+		if _, ok := wantFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var diffs []string
+	for _, name := range names {
+		w, inWant := wantFiles[name]
+		g, inGot := gotFiles[name]
+		switch {
+		case !inGot:
+			diffs = append(diffs, fmt.Sprintf("%v: golden, but not baked", name))
+		case !inWant:
+			diffs = append(diffs, fmt.Sprintf("%v: baked, but not golden", name))
+		case !bytes.Equal(w, g):
+			diffs = append(diffs, fmt.Sprintf("%v:\n%v", name, diffLines(string(w), string(g))))
+		}
+	}
+	return diffs
+}
+
+// writeGolden replaces the golden files in dir with the files of entries.
+func writeGolden(dir string, entries []*archiveEntry) error {
+	if err := preppiFS.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := preppiFS.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files := goldenFiles(entries)
+	for name, content := range files {
+		p := path.Join(dir, name)
+		if err := preppiFS.MkdirAll(path.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := afero.WriteFile(preppiFS, p, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffContext is the number of unchanged lines shown around changed ones.
+const diffContext = 2
+
+// diffLines returns a line by line diff from want to got. Lines only in want
+// start with "-", those only in got with "+", and unchanged lines near them
+// with " ". Unchanged lines further away are elided with "...".
+func diffLines(want, got string) string {
+	a, b := strings.Split(want, "\n"), strings.Split(got, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	// Keep the unchanged lines within diffContext of a change.
+	keep := make([]bool, len(lines))
+	for n, l := range lines {
+		if l[0] == ' ' {
+			continue
+		}
+		for k := n - diffContext; k <= n+diffContext; k++ {
+			if k >= 0 && k < len(lines) {
+				keep[k] = true
+			}
+		}
+	}
+	var out []string
+	elided := false
+	for n, l := range lines {
+		if !keep[n] {
+			if !elided {
+				out = append(out, "...")
+				elided = true
+			}
+			continue
+		}
+		out = append(out, l)
+		elided = false
+	}
+	return strings.Join(out, "\n")
+}
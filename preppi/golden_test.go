@@ -0,0 +1,118 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package preppi
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, tc := range []struct {
+		want, got string
+		diff      string
+	}{
+		{"a\nb\nc\n", "a\nB\nc\n", " a\n-b\n+B\n c\n "},
+		{"a\n", "a\nb\n", " a\n+b\n "},
+		{"1\n2\n3\n4\n5\n6\n7\n8\n", "1\n2\n3\n4\n5\n6\n7\nx\n", "...\n 6\n 7\n-8\n+x\n "},
+	} {
+		if got := diffLines(tc.want, tc.got); got != tc.diff {
+			t.Errorf("diff of %q and %q: wanted %q, got %q", tc.want, tc.got, tc.diff, got)
+		}
+	}
+}
+
+func TestRecipeTest(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/motd":                 &testFile{[]byte("{{.GeneratedByPrepPi}}\n{{.Vars.Hostname}} {{.Vars.Token}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/tests/pi1/vars.yaml":  &testFile{[]byte("Hostname: pi1\n"), 0644, 0755, 0, 0},
+		"/recipes/test/tests/pi2/vars.env":   &testFile{[]byte("Hostname=pi2\nToken=abcd\n"), 0644, 0755, 0, 0},
+		"/recipes/test/tests/nogolden/.keep": &testFile{[]byte{}, 0644, 0755, 0, 0},
+	})
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "motd", Destination: "/etc/motd", Vars: []string{"Hostname", "Token"}},
+		},
+		Variables: []*Variable{
+			&Variable{Name: "Token", Generate: "hex"},
+		},
+		root: "/recipes/test",
+	}
+	run := func(update bool) map[string]*TestResult {
+		t.Helper()
+		results, err := r.Test(update)
+		if err != nil {
+			t.Fatalf("wanted no error, got: %v", err)
+		}
+		byName := make(map[string]*TestResult)
+		for _, res := range results {
+			byName[res.Name] = res
+		}
+		if len(byName) != 3 {
+			t.Fatalf("wanted 3 results, got %v", len(byName))
+		}
+		return byName
+	}
+
+	results := run(false)
+	for name, res := range results {
+		if res.Passed() || res.Err == nil {
+			t.Errorf("%v: wanted failure without golden files, got %+v", name, res)
+		}
+	}
+
+	results = run(true)
+	for _, name := range []string{"pi1", "pi2"} {
+		if res := results[name]; !res.Passed() || !res.Updated {
+			t.Errorf("%v: wanted golden files written, got %+v", name, res)
+		}
+	}
+	got, err := afero.ReadFile(preppiFS, "/recipes/test/tests/pi1/golden/motd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Generated by " + testVersion + "\npi1 generated-Token\n"; string(got) != want {
+		t.Errorf("wanted golden motd %q, got %q", want, got)
+	}
+	if exists, _ := afero.Exists(preppiFS, "/recipes/test/tests/pi1/golden/"+manifestFile); exists {
+		t.Error("wanted no manifest among the golden files")
+	}
+
+	results = run(false)
+	for _, name := range []string{"pi1", "pi2"} {
+		if res := results[name]; !res.Passed() || res.Updated {
+			t.Errorf("%v: wanted a pass, got %+v", name, res)
+		}
+	}
+
+	afero.WriteFile(preppiFS, "/recipes/test/motd", []byte("{{.Vars.Hostname}}\n"), 0644)
+	results = run(false)
+	res := results["pi2"]
+	if res.Passed() || len(res.Diffs) != 1 || !strings.Contains(res.Diffs[0], "-pi2 abcd\n+pi2") {
+		t.Errorf("wanted a diff of motd, got %+v", res)
+	}
+}
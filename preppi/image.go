@@ -0,0 +1,172 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// imageSectorSize is the sector size assumed for partition tables.
+const imageSectorSize = 512
+
+// mbrGPTProtective is the MBR partition type which marks a GPT disk.
+const mbrGPTProtective = 0xee
+
+var (
+	errNoPartitions    = errors.New("no partitions found")
+	errNoBootPartition = errors.New("no FAT boot partition found")
+)
+
+// Partition is an entry in a disk image's partition table.
+type Partition struct {
+	// Number is the partition's 1-based position in the table.
+	Number int
+	// Type is the MBR partition type, eg "0x0c", or the GPT type GUID.
+	Type string
+	// Name is the GPT partition name. MBR partitions have none.
+	Name string
+	// Start and Size are in bytes.
+	Start int64
+	Size  int64
+}
+
+func (p *Partition) String() string {
+	return fmt.Sprintf("partition %d (type %v) at %d, %d bytes", p.Number, p.Type, p.Start, p.Size)
+}
+
+// ReadPartitions reads the MBR or GPT partition table of a disk image.
+func ReadPartitions(dev BlockDevice) ([]*Partition, error) {
+	mbr := make([]byte, imageSectorSize)
+	if _, err := dev.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, errNoPartitions
+	}
+	var parts []*Partition
+	for i := 0; i < 4; i++ {
+		e := mbr[446+i*16 : 446+(i+1)*16]
+		typ := e[4]
+		start := int64(binary.LittleEndian.Uint32(e[8:]))
+		size := int64(binary.LittleEndian.Uint32(e[12:]))
+		if typ == mbrGPTProtective {
+			return readGPT(dev)
+		}
+		if typ == 0 || start == 0 || size == 0 {
+			continue
+		}
+		parts = append(parts, &Partition{
+			Number: i + 1,
+			Type:   fmt.Sprintf("0x%02x", typ),
+			Start:  start * imageSectorSize,
+			Size:   size * imageSectorSize,
+		})
+	}
+	if len(parts) == 0 {
+		return nil, errNoPartitions
+	}
+	return parts, nil
+}
+
+// guidString formats a GUID as stored on disk, with its first three fields
+// little-endian.
+func guidString(b []byte) string {
+	return strings.ToUpper(fmt.Sprintf("%08x-%04x-%04x-%x-%x",
+		binary.LittleEndian.Uint32(b[0:]), binary.LittleEndian.Uint16(b[4:]),
+		binary.LittleEndian.Uint16(b[6:]), b[8:10], b[10:16]))
+}
+
+func readGPT(dev BlockDevice) ([]*Partition, error) {
+	hdr := make([]byte, imageSectorSize)
+	if _, err := dev.ReadAt(hdr, imageSectorSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:8], []byte("EFI PART")) {
+		return nil, fmt.Errorf("protective MBR found, but no GPT header")
+	}
+	entriesLBA := int64(binary.LittleEndian.Uint64(hdr[72:]))
+	count := int64(binary.LittleEndian.Uint32(hdr[80:]))
+	entrySize := int64(binary.LittleEndian.Uint32(hdr[84:]))
+	// Entries are a multiple of 8 bytes, and in practice 128. Limiting them
+	// keeps a corrupt header from asking for gigabytes.
+	if entrySize < 128 || entrySize > 4096 || entrySize%8 != 0 || count > 1024 {
+		return nil, fmt.Errorf("invalid GPT header")
+	}
+	entries := make([]byte, count*entrySize)
+	if _, err := dev.ReadAt(entries, entriesLBA*imageSectorSize); err != nil {
+		return nil, err
+	}
+	var parts []*Partition
+	for i := int64(0); i < count; i++ {
+		e := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(e[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(e[32:]))
+		last := int64(binary.LittleEndian.Uint64(e[40:]))
+		name := make([]uint16, 36)
+		for j := range name {
+			name[j] = binary.LittleEndian.Uint16(e[56+j*2:])
+		}
+		for j, c := range name {
+			if c == 0 {
+				name = name[:j]
+				break
+			}
+		}
+		parts = append(parts, &Partition{
+			Number: int(i) + 1,
+			Type:   guidString(e[:16]),
+			Name:   string(utf16.Decode(name)),
+			Start:  first * imageSectorSize,
+			Size:   (last - first + 1) * imageSectorSize,
+		})
+	}
+	if len(parts) == 0 {
+		return nil, errNoPartitions
+	}
+	return parts, nil
+}
+
+// OpenBootPartition opens the boot partition of a disk image, which is the
+// first partition holding a FAT16 or FAT32 file system. An image with no
+// partition table, but a FAT file system, is used as is.
+func OpenBootPartition(dev BlockDevice) (*FatFs, error) {
+	parts, err := ReadPartitions(dev)
+	if err != nil && err != errNoPartitions {
+		return nil, err
+	}
+	for _, p := range parts {
+		if fs, err := NewFatFs(dev, p.Start); err == nil {
+			return fs, nil
+		}
+	}
+	// A FAT boot sector can look like an MBR, so try the whole image last.
+	if fs, err := NewFatFs(dev, 0); err == nil {
+		return fs, nil
+	}
+	return nil, errNoBootPartition
+}
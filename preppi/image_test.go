@@ -0,0 +1,195 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"encoding/binary"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	testPartitionStart   = 2048
+	testPartitionSectors = 8192
+)
+
+// mbrImageForTest returns a disk image with an MBR partition table, an empty
+// Linux partition and a FAT16 partition.
+func mbrImageForTest(t *testing.T) memDevice {
+	dev := make(memDevice, (testPartitionStart+2*testPartitionSectors)*512)
+	e := dev[446:]
+	e[4] = 0x83
+	binary.LittleEndian.PutUint32(e[8:], testPartitionStart)
+	binary.LittleEndian.PutUint32(e[12:], testPartitionSectors)
+	e = dev[446+16:]
+	e[4] = 0x0e
+	binary.LittleEndian.PutUint32(e[8:], testPartitionStart+testPartitionSectors)
+	binary.LittleEndian.PutUint32(e[12:], testPartitionSectors)
+	dev[510], dev[511] = 0x55, 0xaa
+	formatFATForTest(t, dev, (testPartitionStart+testPartitionSectors)*512, testPartitionSectors, false)
+	return dev
+}
+
+// gptImageForTest returns a disk image with a GPT partition table and a
+// single FAT16 partition.
+func gptImageForTest(t *testing.T) memDevice {
+	dev := make(memDevice, (testPartitionStart+testPartitionSectors+34)*512)
+	e := dev[446:]
+	e[4] = mbrGPTProtective
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], uint32(len(dev)/512-1))
+	dev[510], dev[511] = 0x55, 0xaa
+
+	hdr := dev[512:]
+	copy(hdr, "EFI PART")
+	binary.LittleEndian.PutUint64(hdr[72:], 2)
+	binary.LittleEndian.PutUint32(hdr[80:], 128)
+	binary.LittleEndian.PutUint32(hdr[84:], 128)
+
+	part := dev[2*512:]
+	// EFI System Partition, C12A7328-F81F-11D2-BA4B-00A0C93EC93B.
+	copy(part, []byte{0x28, 0x73, 0x2a, 0xc1, 0x1f, 0xf8, 0xd2, 0x11, 0xba, 0x4b, 0x00, 0xa0, 0xc9, 0x3e, 0xc9, 0x3b})
+	binary.LittleEndian.PutUint64(part[32:], testPartitionStart)
+	binary.LittleEndian.PutUint64(part[40:], testPartitionStart+testPartitionSectors-1)
+	for i, c := range utf16.Encode([]rune("boot")) {
+		binary.LittleEndian.PutUint16(part[56+i*2:], c)
+	}
+	formatFATForTest(t, dev, testPartitionStart*512, testPartitionSectors, false)
+	return dev
+}
+
+func TestReadPartitions(t *testing.T) {
+	parts, err := ReadPartitions(mbrImageForTest(t))
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if len(parts) != 2 {
+		t.Fatalf("wanted 2 partitions, got %v", parts)
+	}
+	if p := parts[1]; p.Number != 2 || p.Type != "0x0e" || p.Start != (testPartitionStart+testPartitionSectors)*512 || p.Size != testPartitionSectors*512 {
+		t.Errorf("wrong second MBR partition: %v", p)
+	}
+
+	parts, err = ReadPartitions(gptImageForTest(t))
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if len(parts) != 1 {
+		t.Fatalf("wanted 1 partition, got %v", parts)
+	}
+	want := &Partition{
+		Number: 1,
+		Type:   "C12A7328-F81F-11D2-BA4B-00A0C93EC93B",
+		Name:   "boot",
+		Start:  testPartitionStart * 512,
+		Size:   testPartitionSectors * 512,
+	}
+	if *parts[0] != *want {
+		t.Errorf("wanted %+v, got %+v", want, parts[0])
+	}
+
+	if _, err := ReadPartitions(make(memDevice, 4096)); err != errNoPartitions {
+		t.Errorf("wanted %v, got: %v", errNoPartitions, err)
+	}
+
+	// Corrupt entry sizes are refused, rather than allocated.
+	for _, size := range []uint32{0, 127, 130, 8192, 0xffffffff} {
+		dev := gptImageForTest(t)
+		binary.LittleEndian.PutUint32(dev[512+84:], size)
+		if _, err := ReadPartitions(dev); err == nil {
+			t.Errorf("entry size %d: wanted error", size)
+		}
+	}
+}
+
+func TestOpenBootPartition(t *testing.T) {
+	bare := make(memDevice, testPartitionSectors*512)
+	formatFATForTest(t, bare, 0, testPartitionSectors, false)
+
+	for name, dev := range map[string]memDevice{
+		"mbr":  mbrImageForTest(t),
+		"gpt":  gptImageForTest(t),
+		"bare": bare,
+	} {
+		fs, err := OpenBootPartition(dev)
+		if err != nil {
+			t.Errorf("%v: wanted no error, got: %v", name, err)
+			continue
+		}
+		if err := afero.WriteFile(fs, "/config.txt", []byte(name), 0644); err != nil {
+			t.Errorf("%v: couldn't write: %v", name, err)
+		}
+	}
+
+	if _, err := OpenBootPartition(make(memDevice, 4096)); err != errNoBootPartition {
+		t.Errorf("wanted %v, got: %v", errNoBootPartition, err)
+	}
+}
+
+func TestRecipeBakeToImage(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Vars: []string{"Hostname"}},
+		},
+		root: "/recipes/test",
+	}
+
+	dev := mbrImageForTest(t)
+	boot, err := OpenBootPartition(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+	if err := r.Bake("/preppi", d, &BakeOptions{Output: boot}); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+
+	// Baking again replaces the earlier bake.
+	d.Vars["Hostname"] = "pi2"
+	if err := r.Bake("/preppi", d, &BakeOptions{Output: boot}); err != nil {
+		t.Fatalf("wanted no error baking again, got: %v", err)
+	}
+
+	boot, err = OpenBootPartition(dev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := afero.ReadFile(boot, "/preppi/etc-hostname"); err != nil || string(got) != "pi2\n" {
+		t.Errorf("wanted baked ingredient, got %q, %v", got, err)
+	}
+	if exists, _ := afero.Exists(boot, "/preppi/preppi.conf"); !exists {
+		t.Error("wanted preppi.conf in the boot partition")
+	}
+	if names, _ := afero.ReadDir(boot, "/"); len(names) != 1 {
+		t.Errorf("wanted only the preppi directory in the boot partition, got %v", names)
+	}
+}
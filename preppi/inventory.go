@@ -0,0 +1,215 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// InventoryFromFile reads an inventory: the variables of each of a fleet of
+// devices. Its format is chosen by its extension:
+//
+//   - .csv: a header row of variable names, then a row of values per device.
+//   - .yaml or .yml: a list of flat mappings of names to scalar values.
+//   - anything else: a JSON array of objects of names to string values.
+func InventoryFromFile(name string) ([]map[string]string, error) {
+	data, err := readSource(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading inventory %q: %v", name, err)
+	}
+	var inventory []map[string]string
+	switch path.Ext(name) {
+	case ".csv":
+		inventory, err = parseCSVInventory(data)
+	case ".yaml", ".yml":
+		inventory, err = parseYAMLInventory(data)
+	default:
+		err = json.Unmarshal(data, &inventory)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading inventory %q: %v", name, err)
+	}
+	return inventory, nil
+}
+
+func parseCSVInventory(data []byte) ([]map[string]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no header row")
+	}
+	header := records[0]
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if header[i] == "" {
+			return nil, fmt.Errorf("column %d has no name", i+1)
+		}
+	}
+	inventory := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		vars := make(map[string]string)
+		for i, value := range record {
+			vars[header[i]] = value
+		}
+		inventory = append(inventory, vars)
+	}
+	return inventory, nil
+}
+
+// parseYAMLInventory parses the subset of YAML needed for an inventory: a
+// list of flat mappings, each of which is a device's variables.
+func parseYAMLInventory(data []byte) ([]map[string]string, error) {
+	var inventory []map[string]string
+	var vars map[string]string
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		switch {
+		case trimmed == "-" || strings.HasPrefix(line, "- "):
+			vars = make(map[string]string)
+			inventory = append(inventory, vars)
+			if line = strings.TrimSpace(line[1:]); line == "" {
+				continue
+			}
+		case vars == nil || (line[0] != ' ' && line[0] != '\t'):
+			return nil, fmt.Errorf("line %d: expected a list of devices' variables", n)
+		}
+		name, value, err := yamlPair(strings.TrimSpace(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		vars[name] = value
+	}
+	return inventory, s.Err()
+}
+
+// FleetOptions alter the way a Recipe is baked for a fleet. The zero value is
+// the default behavior.
+type FleetOptions struct {
+	BakeOptions
+
+	// Key is the variable which names each device's output. Defaults to
+	// Hostname.
+	Key string
+
+	// Archive is the extension of an archive to write for each device, eg
+	// .zip, or empty for a directory.
+	Archive string
+
+	// Jobs is the number of devices baked at once. Defaults to the number of
+	// CPUs.
+	Jobs int
+}
+
+// FleetResult is the outcome of baking for one device of an inventory.
+type FleetResult struct {
+	// Row is the device's 1-based position in the inventory.
+	Row int
+	// Key is the value of the device's key variable.
+	Key string
+	// Dest is where the device's files are written.
+	Dest string
+	Err  error
+}
+
+// BakeFleet bakes the recipe for each device of inventory, into an output
+// under dest named for the device's key variable. Each device's variables
+// override those of d. o may be nil. A device which fails doesn't stop the
+// others, and the results of all are returned, in inventory order.
+func (r *Recipe) BakeFleet(dest string, inventory []map[string]string, d *RecipeData, o *FleetOptions) ([]*FleetResult, error) {
+	if o == nil {
+		o = &FleetOptions{}
+	}
+	key := o.Key
+	if key == "" {
+		key = "Hostname"
+	}
+	if o.Archive != "" && !IsArchive(o.Archive) {
+		return nil, fmt.Errorf("%q isn't an archive extension", o.Archive)
+	}
+	jobs := o.Jobs
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	if err := preppiFS.MkdirAll(dest, 0755); err != nil {
+		return nil, err
+	}
+	if d == nil {
+		d = &RecipeData{}
+	}
+
+	results := make([]*FleetResult, len(inventory))
+	seen := make(map[string]int)
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < jobs; j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range work {
+				dd := *d
+				dd.Vars = MergeVars(d.Vars, inventory[n])
+				res := results[n]
+				if o.Archive != "" {
+					res.Err = r.BakeArchive(res.Dest, &dd, &o.BakeOptions)
+				} else {
+					res.Err = r.Bake(res.Dest, &dd, &o.BakeOptions)
+				}
+			}
+		}()
+	}
+	for n, vars := range inventory {
+		res := &FleetResult{Row: n + 1, Key: vars[key]}
+		results[n] = res
+		switch name := res.Key; {
+		case name == "":
+			res.Err = fmt.Errorf("no %v", key)
+		case name == "." || name == ".." || strings.ContainsAny(name, `/\`):
+			res.Err = fmt.Errorf("%v %q can't name an output", key, name)
+		case seen[strings.ToLower(name)] != 0:
+			res.Err = fmt.Errorf("%v %q is also row %d's", key, name, seen[strings.ToLower(name)])
+		}
+		if res.Err != nil {
+			continue
+		}
+		// Outputs may end up on case-insensitive file systems.
+		seen[strings.ToLower(res.Key)] = res.Row
+		res.Dest = path.Join(dest, res.Key+o.Archive)
+		work <- n
+	}
+	close(work)
+	wg.Wait()
+	return results, nil
+}
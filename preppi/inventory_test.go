@@ -0,0 +1,142 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestInventoryFromFile(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/fleet.csv": &testFile{[]byte("Hostname, Eth0CIDR\npi1,10.0.0.1/24\n\"pi2\",\"10.0.0.2/24\"\n"), 0644, 0755, 0, 0},
+		"/fleet.yaml": &testFile{[]byte(`# Two devices
+- Hostname: pi1
+  Eth0CIDR: 10.0.0.1/24 # the first
+-
+  Hostname: "pi2"
+  Eth0CIDR: '10.0.0.2/24'
+`), 0644, 0755, 0, 0},
+		"/fleet.json":     &testFile{[]byte(`[{"Hostname": "pi1", "Eth0CIDR": "10.0.0.1/24"}, {"Hostname": "pi2", "Eth0CIDR": "10.0.0.2/24"}]`), 0644, 0755, 0, 0},
+		"/ragged.csv":     &testFile{[]byte("Hostname,Eth0CIDR\npi1\n"), 0644, 0755, 0, 0},
+		"/unnamed.csv":    &testFile{[]byte("Hostname,\npi1,x\n"), 0644, 0755, 0, 0},
+		"/mapping.yaml":   &testFile{[]byte("Hostname: pi1\n"), 0644, 0755, 0, 0},
+		"/nested.yaml":    &testFile{[]byte("- Hostname: pi1\n  DNS: [1.1.1.1]\n"), 0644, 0755, 0, 0},
+		"/not-array.json": &testFile{[]byte(`{"Hostname": "pi1"}`), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	want := []map[string]string{
+		{"Hostname": "pi1", "Eth0CIDR": "10.0.0.1/24"},
+		{"Hostname": "pi2", "Eth0CIDR": "10.0.0.2/24"},
+	}
+	for _, name := range []string{"/fleet.csv", "/fleet.yaml", "/fleet.json"} {
+		got, err := InventoryFromFile(name)
+		if err != nil {
+			t.Errorf("%v: wanted no error, got: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: wanted %v, got %v", name, want, got)
+		}
+	}
+	for _, name := range []string{"/ragged.csv", "/unnamed.csv", "/mapping.yaml", "/nested.yaml", "/not-array.json", "/missing.csv"} {
+		if _, err := InventoryFromFile(name); err == nil {
+			t.Errorf("%v: wanted error", name)
+		}
+	}
+}
+
+func TestRecipeBakeFleet(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}.{{.Vars.Domain}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Vars: []string{"Hostname", "Domain"}},
+		},
+		Variables: []*Variable{&Variable{Name: "Hostname", Type: VarHostname}},
+		root:      "/recipes/test",
+	}
+	inventory := []map[string]string{
+		{"Hostname": "pi1"},
+		{"Hostname": "pi2", "Domain": "lab"},
+		{"Hostname": "PI1"},
+		{"Hostname": "../pi"},
+		{"Domain": "lab"},
+		{"Hostname": "pi3", "Serial": "bad/name"},
+		{"Hostname": "pi4"},
+	}
+	d := &RecipeData{Vars: map[string]string{"Domain": "local"}}
+	for _, archive := range []string{"", ".zip"} {
+		results, err := r.BakeFleet("/fleet", inventory, d, &FleetOptions{Archive: archive, Jobs: 3})
+		if err != nil {
+			t.Fatalf("wanted no error, got: %v", err)
+		}
+		var failed []int
+		for _, res := range results {
+			if res.Err != nil {
+				failed = append(failed, res.Row)
+			}
+		}
+		if want := []int{3, 4, 5}; !reflect.DeepEqual(failed, want) {
+			t.Errorf("archive %q: wanted rows %v to fail, got %v", archive, want, failed)
+		}
+		if got := results[1].Dest; got != "/fleet/pi2"+archive {
+			t.Errorf("archive %q: wanted output /fleet/pi2%v, got %q", archive, archive, got)
+		}
+	}
+	for name, want := range map[string]string{
+		"/fleet/pi1/etc-hostname": "pi1.local\n",
+		"/fleet/pi2/etc-hostname": "pi2.lab\n",
+	} {
+		if got, err := afero.ReadFile(preppiFS, name); err != nil || string(got) != want {
+			t.Errorf("%v: wanted %q, got %q, %v", name, want, got, err)
+		}
+	}
+	if exists, _ := afero.Exists(preppiFS, "/fleet/pi4.zip"); !exists {
+		t.Error("wanted an archive per device")
+	}
+
+	// A different key names outputs by another variable.
+	results, err := r.BakeFleet("/by-serial", inventory[5:], d, &FleetOptions{Key: "Serial"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[0].Err == nil || results[1].Err == nil {
+		t.Errorf("wanted errors for bad and missing keys, got %+v", results)
+	}
+	if _, err := r.BakeFleet("/fleet", inventory, d, &FleetOptions{Archive: ".rar"}); err == nil {
+		t.Error("wanted error for unknown archive extension")
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"text/template/parse"
+
+	"github.com/spf13/afero"
+)
+
+// LintProblem is a problem found in a recipe by Lint.
+type LintProblem struct {
+	// Source is the ingredient with the problem, or empty for the recipe.
+	Source string
+	// Warning is true for problems which won't break a bake.
+	Warning bool
+	Message string
+}
+
+func (p *LintProblem) String() string {
+	level := "error"
+	if p.Warning {
+		level = "warning"
+	}
+	where := "recipe"
+	if p.Source != "" {
+		where = p.Source
+	}
+	return fmt.Sprintf("%v: %v: %v", where, level, p.Message)
+}
+
+// Lint checks the recipe for mistakes which would otherwise only show up in
+// the baked files: variables which templates use but their ingredients don't
+// declare, and the reverse, templates which don't parse, and invalid variable
+// descriptions.
+func (r *Recipe) Lint() []*LintProblem {
+	var problems []*LintProblem
+	partials, err := r.partials()
+	if err != nil {
+		problems = append(problems, &LintProblem{Message: fmt.Sprintf("reading partials: %v", err)})
+	}
+	declared := make(map[string]bool)
+	for _, i := range r.Ingredients {
+		problems = append(problems, r.lintIngredient(i, partials)...)
+		for _, v := range i.vars() {
+			declared[v] = true
+		}
+	}
+	for _, v := range r.Variables {
+		if !declared[v.Name] {
+			problems = append(problems, &LintProblem{
+				Warning: true,
+				Message: fmt.Sprintf("variable %q is described, but no ingredient declares it", v.Name),
+			})
+		}
+		if err := v.check(); err != nil {
+			problems = append(problems, &LintProblem{Message: fmt.Sprintf("variable %q: %v", v.Name, err)})
+		} else if v.Default != nil {
+			if err := v.Validate(*v.Default); err != nil {
+				problems = append(problems, &LintProblem{Message: fmt.Sprintf("default of variable %q: %v", v.Name, err)})
+			}
+		}
+	}
+	return problems
+}
+
+func (r *Recipe) lintIngredient(i *Ingredient, partials map[string]string) []*LintProblem {
+	source := i.Source
+	root := r.sourceRoot(i)
+	if root != r.root {
+		// The ingredient came from another recipe.
+		source = path.Join(i.From(), i.Source)
+	}
+	problem := func(warning bool, format string, a ...interface{}) *LintProblem {
+		return &LintProblem{Source: source, Warning: warning, Message: fmt.Sprintf(format, a...)}
+	}
+	var problems []*LintProblem
+	// Variables in the When condition needn't be declared, since they may be
+	// missing.
+	inWhen := make(map[string]bool)
+	if i.When != "" {
+		if t, err := i.whenTemplate(root); err != nil {
+			problems = append(problems, problem(false, "%v", err))
+		} else {
+			varRefs(t.Tree.Root, inWhen)
+		}
+	}
+	if i.Foreach != "" && i.Output == "" {
+		problems = append(problems, problem(false, "repeats for each %v, so needs an output", i.Foreach))
+	}
+	data, err := afero.ReadFile(preppiFS, path.Join(root, i.Source))
+	if err != nil {
+		return append(problems, problem(false, "%v", err))
+	}
+	if i.Raw {
+		if len(i.Vars) > 0 || i.Delims != nil {
+			problems = append(problems, problem(true, "is raw, so its vars and delims are ignored"))
+		}
+		return problems
+	}
+	tmpl, err := i.compileTemplate(root, string(data), partials)
+	if err != nil {
+		return append(problems, problem(false, "%v", err))
+	}
+	// Variables count as used if they're in the ingredient's own templates or
+	// any partials which those use.
+	used := make(map[string]bool)
+	var pending []string
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil && t.Tree.ParseName == i.Source {
+			pending = append(pending, t.Name())
+		}
+	}
+	walked := make(map[string]bool)
+	for len(pending) > 0 {
+		name := pending[0]
+		pending = pending[1:]
+		t := tmpl.Lookup(name)
+		if walked[name] || t == nil || t.Tree == nil {
+			continue
+		}
+		walked[name] = true
+		varRefs(t.Tree.Root, used)
+		calls := make(map[string]bool)
+		templateCalls(t.Tree.Root, calls)
+		for c := range calls {
+			pending = append(pending, c)
+		}
+	}
+
+	// The Foreach list is declared by naming it, and needn't be used, since
+	// each of its values is the Item.
+	declared := make(map[string]bool)
+	for _, v := range i.vars() {
+		declared[v] = true
+		if !used[v] && !inWhen[v] && v != i.Foreach {
+			problems = append(problems, problem(true, "declares variable %q, but doesn't use it", v))
+		}
+	}
+	var undeclared []string
+	for v := range used {
+		if !declared[v] {
+			undeclared = append(undeclared, v)
+		}
+	}
+	sort.Strings(undeclared)
+	for _, v := range undeclared {
+		problems = append(problems, problem(false, "uses variable %q, but doesn't declare it", v))
+	}
+	return problems
+}
+
+// varRefs adds the names of the variables referenced by node, as .Vars.Name,
+// $.Vars.Name or index .Vars "Name", to refs. References relative to a dot
+// changed by range or with can't be attributed, and are ignored.
+func varRefs(node parse.Node, refs map[string]bool) {
+	dotVarRefs(node, refs, true)
+}
+
+// dotVarRefs is varRefs, counting references relative to dot only if dot is
+// still the RecipeData.
+func dotVarRefs(node parse.Node, refs map[string]bool, dot bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			dotVarRefs(c, refs, dot)
+		}
+	case *parse.ActionNode:
+		dotVarRefs(n.Pipe, refs, dot)
+	case *parse.IfNode:
+		varBranchRefs(&n.BranchNode, refs, dot, dot)
+	case *parse.RangeNode:
+		varBranchRefs(&n.BranchNode, refs, dot, false)
+	case *parse.WithNode:
+		varBranchRefs(&n.BranchNode, refs, dot, false)
+	case *parse.TemplateNode:
+		dotVarRefs(n.Pipe, refs, dot)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Cmds {
+			dotVarRefs(c, refs, dot)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) == 3 && dot {
+			if fn, ok := n.Args[0].(*parse.IdentifierNode); ok && fn.Ident == "index" {
+				if f, ok := n.Args[1].(*parse.FieldNode); ok && isVarsField(f.Ident) {
+					if s, ok := n.Args[2].(*parse.StringNode); ok {
+						refs[s.Text] = true
+					}
+				}
+			}
+		}
+		for _, c := range n.Args {
+			dotVarRefs(c, refs, dot)
+		}
+	case *parse.FieldNode:
+		if dot && len(n.Ident) > 1 && isVarsField(n.Ident[:1]) {
+			refs[n.Ident[1]] = true
+		}
+	case *parse.VariableNode:
+		if len(n.Ident) > 2 && n.Ident[0] == "$" && isVarsField(n.Ident[1:2]) {
+			refs[n.Ident[2]] = true
+		}
+	case *parse.ChainNode:
+		node := n.Node
+		// (.Vars).Name chains on a parenthesized pipeline.
+		if p, ok := node.(*parse.PipeNode); ok && len(p.Decl) == 0 && len(p.Cmds) == 1 && len(p.Cmds[0].Args) == 1 {
+			node = p.Cmds[0].Args[0]
+		}
+		if f, ok := node.(*parse.FieldNode); ok && dot && isVarsField(f.Ident) && len(n.Field) > 0 {
+			refs[n.Field[0]] = true
+		}
+		dotVarRefs(n.Node, refs, dot)
+	}
+}
+
+// templateCalls finds the names of templates which node executes.
+func templateCalls(node parse.Node, calls map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, c := range n.Nodes {
+			templateCalls(c, calls)
+		}
+	case *parse.IfNode:
+		templateCalls(n.List, calls)
+		templateCalls(n.ElseList, calls)
+	case *parse.RangeNode:
+		templateCalls(n.List, calls)
+		templateCalls(n.ElseList, calls)
+	case *parse.WithNode:
+		templateCalls(n.List, calls)
+		templateCalls(n.ElseList, calls)
+	case *parse.TemplateNode:
+		calls[n.Name] = true
+	}
+}
+
+// varBranchRefs adds the references of an if, range or with. The dot is
+// unchanged in its pipeline and else branch, but range and with change it for
+// their body, so only $.Vars references count there.
+func varBranchRefs(n *parse.BranchNode, refs map[string]bool, dot, bodyDot bool) {
+	dotVarRefs(n.Pipe, refs, dot)
+	dotVarRefs(n.List, refs, bodyDot)
+	dotVarRefs(n.ElseList, refs, dot)
+}
+
+// isVarsField returns true if ident is exactly the Vars field.
+func isVarsField(ident []string) bool {
+	return len(ident) == 1 && ident[0] == "Vars"
+}
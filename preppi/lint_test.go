@@ -0,0 +1,116 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRecipeLint(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostnme}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/etc-hosts": &testFile{[]byte(`127.0.1.1 {{index .Vars "Hostname"}}
+{{range $i, $s := .Vars.Servers}}{{$.Vars.Domain}}{{end}}
+{{with .Vars.Alias}}{{.}}{{end}}
+{{if .Facts}}{{(.Vars).Model}}{{end}}
+`), 0644, 0755, 0, 0},
+		"/recipes/test/broken":            &testFile{[]byte("{{.Vars.Hostname\n"), 0644, 0755, 0, 0},
+		"/recipes/test/wifi":              &testFile{[]byte("{{.Item}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/interface.network": &testFile{[]byte("# {{.Item}} of {{.Vars.Interfaces}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	bad := "not a hostname!"
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Vars: []string{"Hostname"}},
+			&Ingredient{Source: "etc-hosts", Vars: []string{"Hostname", "Servers", "Domain", "Alias", "Model"}},
+			&Ingredient{Source: "broken", Vars: []string{"Hostname"}},
+			&Ingredient{Source: "missing"},
+			&Ingredient{Source: "wifi", When: ".Vars.SSID", Vars: []string{"SSID"}},
+			&Ingredient{Source: "wifi", When: "(", Foreach: "Interfaces"},
+			&Ingredient{Source: "interface.network", Foreach: "Interfaces", Output: "{{.Item}}.network"},
+			&Ingredient{Source: "wifi", Foreach: "Bridges", Output: "{{.Item}}.network"},
+		},
+		Variables: []*Variable{
+			&Variable{Name: "Bridges", Type: VarList},
+			&Variable{Name: "Hostname", Type: VarHostname, Default: &bad},
+			&Variable{Name: "Unused"},
+			&Variable{Name: "Model", Type: "float"},
+		},
+		root: "/recipes/test",
+	}
+
+	var got []string
+	for _, p := range r.Lint() {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`etc-hostname: warning: declares variable "Hostname", but doesn't use it`,
+		`etc-hostname: error: uses variable "Hostnme", but doesn't declare it`,
+		"broken: error:",
+		"missing: error:",
+		`wifi: error: invalid when "("`,
+		"wifi: error: repeats for each Interfaces, so needs an output",
+		`recipe: error: default of variable "Hostname":`,
+		`recipe: warning: variable "Unused" is described, but no ingredient declares it`,
+		`recipe: error: variable "Model": unknown type "float"`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wanted %d problems, got:\n%v", len(want), strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("wanted problem starting %q, got %q", want[i], got[i])
+		}
+	}
+}
+
+func TestVarRefs(t *testing.T) {
+	i := &Ingredient{Source: "test"}
+	tmpl, err := i.compileTemplate("", `{{define "sub"}}{{.Vars.InDefine}}{{end}}
+{{.Vars.Plain}} {{index .Vars "Indexed"}} {{$.Vars.Rooted}} {{(.Vars).Chained}}
+{{if .Vars.InIf}}{{.Vars.InIfBody}}{{else}}{{.Vars.InElse}}{{end}}
+{{range .Vars.InRange}}{{.Vars.Field}}{{$.Vars.InRangeBody}}{{else}}{{.Vars.InRangeElse}}{{end}}
+{{with .Vars.InWith}}{{.Vars.Field}}{{index .Vars "Field"}}{{(.Vars).Field}}{{end}}
+{{printf "%v" .Vars.InCall | printf "%v"}} {{.Facts.Hostname}} {{index .Vars $.Facts.Model}}`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, t := range tmpl.Templates() {
+		varRefs(t.Tree.Root, got)
+	}
+	want := make(map[string]bool)
+	for _, v := range []string{"InDefine", "Plain", "Indexed", "Rooted", "Chained", "InIf", "InIfBody", "InElse", "InCall", "InRange", "InRangeBody", "InRangeElse", "InWith"} {
+		want[v] = true
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+}
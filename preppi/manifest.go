@@ -0,0 +1,163 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package preppi
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/spf13/afero"
+)
+
+// manifestFile is the name of the manifest, written beside preppi.conf.
+const manifestFile = "preppi.manifest.json"
+
+// Manifest records how a bake was made, so that it can be made again with a
+// newer recipe.
+type Manifest struct {
+	// Recipe is the name of the recipe's directory under its root.
+	Recipe string `json:"recipe"`
+	// Root is the recipe root the recipe was found under.
+	Root string `json:"root,omitempty"`
+	// Digest is the recipe's Digest when it was baked.
+	Digest string `json:"digest"`
+	// Version is the version of PrepPi which baked it.
+	Version string `json:"version"`
+	// Vars are the variables given to the bake, except secrets.
+	Vars map[string]string `json:"vars"`
+	// Secrets are the secret variables given to the bake, encrypted with its
+	// VarsKey. Without a key, secrets aren't kept.
+	Secrets *encryptedVars `json:"secrets,omitempty"`
+	// Prefix is the bake's BakeOptions.Prefix.
+	Prefix string `json:"prefix,omitempty"`
+	// InlineLimit is the bake's BakeOptions.InlineLimit.
+	InlineLimit int `json:"inline_limit,omitempty"`
+}
+
+// newManifest returns the manifest of a bake of r with the variables vars and
+// the options o. o.VarsKey, if set, encrypts the secret variables.
+func (r *Recipe) newManifest(vars map[string]string, o *BakeOptions) (*Manifest, error) {
+	digest, err := r.Digest()
+	if err != nil {
+		return nil, err
+	}
+	schema := r.VarSchema()
+	m := &Manifest{
+		Recipe:      path.Base(r.root),
+		Root:        path.Dir(r.root),
+		Digest:      digest,
+		Version:     VersionString(),
+		Vars:        PublicVars(schema, vars),
+		Prefix:      o.Prefix,
+		InlineLimit: o.InlineLimit,
+	}
+	key := o.VarsKey
+	if key == nil {
+		return m, nil
+	}
+	secrets := make(map[string]string)
+	for name, value := range vars {
+		if _, ok := m.Vars[name]; !ok {
+			secrets[name] = value
+		}
+	}
+	if len(secrets) > 0 {
+		if m.Secrets, err = sealVars(key, secrets); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// ReadManifest reads the manifest of the bake in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	name := path.Join(dir, manifestFile)
+	data, err := afero.ReadFile(preppiFS, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading manifest %q: %v", name, err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("failed reading manifest %q: %v", name, err)
+	}
+	return m, nil
+}
+
+// Values returns the variables of the bake, including its secrets if they
+// were kept and key decrypts them. Without key, secrets are left out.
+func (m *Manifest) Values(key []byte) (map[string]string, error) {
+	vars := MergeVars(m.Vars)
+	if m.Secrets == nil || key == nil {
+		return vars, nil
+	}
+	secrets, err := openVars(key, m.Secrets)
+	if err != nil {
+		return nil, fmt.Errorf("can't decrypt the manifest's secrets: %v", err)
+	}
+	return MergeVars(vars, secrets), nil
+}
+
+// writeManifest writes m into the bake at dest on fs.
+func writeManifest(fs Fs, dest string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return afero.WriteFile(fs, path.Join(dest, manifestFile), append(data, '\n'), 0644)
+}
+
+// Digest checksums everything which goes into baking the recipe: the resolved
+// recipe, its ingredients' sources and its partials. It changes whenever the
+// recipe might bake differently.
+func (r *Recipe) Digest() (string, error) {
+	h := sha256.New()
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	for _, i := range r.Ingredients {
+		// Sources of ingredients which are never baked may be missing.
+		content, err := afero.ReadFile(preppiFS, path.Join(r.sourceRoot(i), i.Source))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		fmt.Fprintf(h, "\x00%v\x00%d\x00", i.Source, len(content))
+		h.Write(content)
+	}
+	partials, err := r.partials()
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, 0, len(partials))
+	for name := range partials {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%v\x00%d\x00", name, len(partials[name]))
+		h.Write([]byte(partials[name]))
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package preppi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestRecipeBakeManifest(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/wpa": &testFile{[]byte("{{.Vars.SSID}} {{.Vars.PSK}}\n"), 0644, 0755, 0, 0},
+	})
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "wpa", Destination: "/etc/wpa", Vars: []string{"SSID", "PSK"}},
+		},
+		Variables: []*Variable{
+			&Variable{Name: "PSK", Secret: true},
+		},
+		root: "/recipes/test",
+	}
+	digest, err := r.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &RecipeData{Vars: map[string]string{"SSID": "home", "PSK": "hunter22"}}
+	key := []byte("correct horse")
+	for _, tc := range []struct {
+		key  []byte
+		want map[string]string
+	}{
+		{want: map[string]string{"SSID": "home"}},
+		{key: key, want: map[string]string{"SSID": "home", "PSK": "hunter22"}},
+	} {
+		if err := r.Bake("/out", d, &BakeOptions{VarsKey: tc.key}); err != nil {
+			t.Fatalf("wanted no error, got: %v", err)
+		}
+		m, err := ReadManifest("/out")
+		if err != nil {
+			t.Fatalf("wanted no error, got: %v", err)
+		}
+		if m.Recipe != "test" || m.Digest != digest || m.Version != VersionString() {
+			t.Errorf("wanted recipe test at %v by %v, got %v at %v by %v",
+				digest, VersionString(), m.Recipe, m.Digest, m.Version)
+		}
+		if _, ok := m.Vars["PSK"]; ok {
+			t.Errorf("wanted the secret left out of the manifest's vars, got %v", m.Vars)
+		}
+		got, err := m.Values(tc.key)
+		if err != nil {
+			t.Fatalf("wanted no error, got: %v", err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("wanted values %v, got %v", tc.want, got)
+		}
+	}
+	m, err := ReadManifest("/out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Values([]byte("wrong")); err == nil {
+		t.Error("wanted error decrypting with the wrong key")
+	}
+	if _, err := ReadManifest("/recipes"); err == nil {
+		t.Error("wanted error reading a missing manifest")
+	}
+}
+
+func TestRecipeDigest(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/motd":            &testFile{[]byte("{{template \"header\" .}}hello\n"), 0644, 0755, 0, 0},
+		"/recipes/test/partials/header": &testFile{[]byte("# header\n"), 0644, 0755, 0, 0},
+	})
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "motd", Destination: "/etc/motd"},
+		},
+		root: "/recipes/test",
+	}
+	digest := func() string {
+		t.Helper()
+		d, err := r.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	first := digest()
+	if again := digest(); again != first {
+		t.Errorf("wanted the same digest twice, got %v and %v", first, again)
+	}
+	for _, change := range []func(){
+		func() { afero.WriteFile(preppiFS, "/recipes/test/motd", []byte("hi\n"), 0644) },
+		func() { afero.WriteFile(preppiFS, "/recipes/test/partials/header", []byte("# new\n"), 0644) },
+		func() { r.Ingredients[0].Destination = "/etc/motd.tail" },
+	} {
+		before := digest()
+		change()
+		if after := digest(); after == before {
+			t.Errorf("wanted the digest to change, got %v again", after)
+		}
+	}
+}
+
+func TestRecipeMissingVars(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/hostname": &testFile{[]byte("{{.Vars.Hostname}}.{{.Vars.Domain}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/wpa":      &testFile{[]byte("{{.Vars.SSID}} {{.Vars.PSK}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/token":    &testFile{[]byte("{{.Vars.Token}}\n"), 0644, 0755, 0, 0},
+	})
+	local := "local"
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "hostname", Destination: "/etc/hostname", Vars: []string{"Hostname", "Domain"}},
+			&Ingredient{Source: "wpa", Destination: "/etc/wpa", Vars: []string{"SSID", "PSK"}, When: ".Vars.SSID"},
+			&Ingredient{Source: "token", Destination: "/etc/token", Vars: []string{"Token"}},
+		},
+		Variables: []*Variable{
+			&Variable{Name: "Domain", Default: &local},
+			&Variable{Name: "PSK", Secret: true},
+			&Variable{Name: "Token", Generate: "hex"},
+		},
+		root: "/recipes/test",
+	}
+	for _, tc := range []struct {
+		vars map[string]string
+		want []string
+	}{
+		// The bake being upgraded had no wifi, so its variables are unneeded.
+		{map[string]string{}, []string{"Hostname"}},
+		{map[string]string{"Hostname": "pi"}, nil},
+		// The secret wasn't kept, so it's asked for again.
+		{map[string]string{"Hostname": "pi", "SSID": "home"}, []string{"PSK"}},
+	} {
+		missing, err := r.MissingVars(tc.vars)
+		if err != nil {
+			t.Fatalf("%v: wanted no error, got: %v", tc.vars, err)
+		}
+		var got []string
+		for _, v := range missing {
+			got = append(got, v.Name)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: wanted missing %v, got %v", tc.vars, tc.want, got)
+		}
+	}
+}
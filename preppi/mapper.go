@@ -22,13 +22,17 @@ package preppi
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
+	"strings"
+	"text/template"
 
 	"github.com/spf13/afero"
 )
@@ -36,22 +40,82 @@ import (
 // clobberFlag is the set of flags passed to FileOpen when Apply()ing a Mapping.
 const clobberFlag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
 
+// bootPrefix is where the boot partition is mounted on the device.
+const bootPrefix = "/boot"
+
 var (
 	// preppiFS is a Fs. It is a var for testing.
 	preppiFS Fs
 
-	errCantClobber = errors.New("Can't clobber file")
+	// bootFS, when set, is read in place of the device's boot partition. See
+	// SetBootDir.
+	bootFS Fs
+
+	errCantClobber     = errors.New("Can't clobber file")
+	errNoSource        = errors.New("mapping has no source or content")
+	errAmbiguousSource = errors.New("mapping may have only one of source, content or content_base64")
 )
 
 func init() {
 	preppiFS = NewOsFs()
 }
 
+// SetTargetRoot makes PrepPi operate on the tree under root, eg a mounted
+// image, instead of the running system.
+func SetTargetRoot(root string) {
+	preppiFS = NewBasePathFs(NewOsFs(), root)
+}
+
+// SetBootDir makes PrepPi read configs and sources under /boot from dir
+// instead, eg a mounted boot partition.
+func SetBootDir(dir string) {
+	bootFS = NewBasePathFs(NewOsFs(), dir)
+}
+
+// sourceFs returns the Fs from which a config or source should be read, and
+// the name to read from it. Files under /boot come from bootFS, if set.
+func sourceFs(name string) (Fs, string) {
+	if bootFS != nil {
+		if name == bootPrefix {
+			return bootFS, "/"
+		}
+		if strings.HasPrefix(name, bootPrefix+"/") {
+			return bootFS, strings.TrimPrefix(name, bootPrefix)
+		}
+	}
+	return preppiFS, name
+}
+
+// openSource opens a config or source file.
+func openSource(name string) (afero.File, error) {
+	fs, name := sourceFs(name)
+	return fs.Open(name)
+}
+
+// readSource reads a config or source file.
+func readSource(name string) ([]byte, error) {
+	fs, name := sourceFs(name)
+	return afero.ReadFile(fs, name)
+}
+
+// SourceExists checks whether a config or source file exists.
+func SourceExists(name string) (bool, error) {
+	fs, name := sourceFs(name)
+	if _, err := fs.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
 // Mapping represents a file mapped from the Source to Destination. Mode, UID
 // and GID apply to the written Destination file. DirMode is applied to any
-// directories created.
+// directories created. Instead of a Source, a Mapping may carry its content
+// inline as either Content or ContentBase64.
 type Mapping struct {
-	Source      string      `json:"source"`
+	Source      string      `json:"source,omitempty"`
 	Destination string      `json:"destination"`
 	Mode        os.FileMode `json:"mode"`
 	DirMode     os.FileMode `json:"dirmode"`
@@ -60,6 +124,67 @@ type Mapping struct {
 
 	// Clobber is true when it's okay to overrwite Destination if it exists.
 	Clobber bool `json:"clobber,omitempty"`
+
+	// Content is the UTF-8 content of the destination file, used in place of
+	// Source for small files.
+	Content string `json:"content,omitempty"`
+	// ContentBase64 is the base64-encoded content of the destination file, for
+	// inline content which isn't UTF-8.
+	ContentBase64 string `json:"content_base64,omitempty"`
+
+	// SHA256 is the hex-encoded checksum of the content, required when Source
+	// is an HTTP(S) URL.
+	SHA256 string `json:"sha256,omitempty"`
+	// OnFetchError is the policy, "fail" or "skip", for when a remote Source
+	// can't be fetched. Defaults to DefaultOnFetchError.
+	OnFetchError string `json:"on_fetch_error,omitempty"`
+
+	// Template is true when the source is a text/template, to be executed on
+	// the device with the RecipeData passed to Apply.
+	Template bool `json:"template,omitempty"`
+
+	// When, if set, is the condition under which the mapping applies. Others
+	// are skipped.
+	When *Condition `json:"when,omitempty"`
+
+	// root is the directory against which a relative Source is resolved,
+	// usually that of the config file. Empty leaves it relative to the working
+	// directory.
+	root string
+}
+
+// sourceReader is the interface satisfied by both source files and inline
+// content.
+type sourceReader interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// inlineContent is a sourceReader for content carried in the Mapping itself.
+type inlineContent struct {
+	*bytes.Reader
+}
+
+// Close does nothing, there is nothing to release.
+func (inlineContent) Close() error {
+	return nil
+}
+
+// sourcePath returns the path of a local Source, resolved against the root.
+func (m *Mapping) sourcePath() string {
+	if m.root == "" || path.IsAbs(m.Source) || isRemote(m.Source) {
+		return m.Source
+	}
+	return path.Join(m.root, m.Source)
+}
+
+// describeSource returns a human-readable description of where the content
+// comes from, for logging.
+func (m *Mapping) describeSource() string {
+	if m.Source == "" {
+		return "inline content"
+	}
+	return m.sourcePath()
 }
 
 // destinationExists checks if the file exists. If anything unexpected happens,
@@ -108,6 +233,12 @@ func (m *Mapping) prepareNewDestination() (afero.File, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The mode given to OpenFile is masked by the umask, and an existing
+	// file keeps its own.
+	if err := preppiFS.Chmod(m.Destination, m.Mode); err != nil {
+		dst.Close()
+		return nil, err
+	}
 	return dst, nil
 }
 
@@ -139,23 +270,120 @@ func (m *Mapping) shouldCopy(srcCksm []byte) (bool, error) {
 	return false, errCantClobber
 }
 
-// source opens and checksums the file. The caller is responsible for closing.
-// Return values are undefined if the returned error is not nil.
-func (m *Mapping) source() (afero.File, []byte, error) {
-	src, err := preppiFS.Open(m.Source)
+// open returns a reader for the source file or inline content. Exactly one of
+// Source, Content or ContentBase64 must be set.
+func (m *Mapping) open() (sourceReader, error) {
+	set := 0
+	for _, s := range []string{m.Source, m.Content, m.ContentBase64} {
+		if s != "" {
+			set++
+		}
+	}
+	if set == 0 {
+		return nil, errNoSource
+	}
+	if set > 1 {
+		return nil, errAmbiguousSource
+	}
+	switch {
+	case m.Content != "":
+		return inlineContent{bytes.NewReader([]byte(m.Content))}, nil
+	case m.ContentBase64 != "":
+		b, err := base64.StdEncoding.DecodeString(m.ContentBase64)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode content_base64: %v", err)
+		}
+		return inlineContent{bytes.NewReader(b)}, nil
+	}
+	if isRemote(m.Source) {
+		b, err := fetchSource(m.Source, m.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		return inlineContent{bytes.NewReader(b)}, nil
+	}
+	src, err := openSource(m.sourcePath())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open source: %v", err)
+	}
+	return src, nil
+}
+
+// render executes the source as a template with d, returning a reader for the
+// output. src is closed.
+func (m *Mapping) render(src sourceReader, d *RecipeData) (sourceReader, error) {
+	defer src.Close()
+	tmplData, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New(m.describeSource()).Option("missingkey=error").Funcs(templateFuncs(m.root)).Parse(string(tmplData))
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't open source: %v", err)
+		return nil, err
+	}
+	if d == nil {
+		d = &RecipeData{}
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, d); err != nil {
+		return nil, err
+	}
+	return inlineContent{bytes.NewReader(b.Bytes())}, nil
+}
+
+// source opens and checksums the file, rendering it first if it's a template.
+// The caller is responsible for closing. Return values are undefined if the
+// returned error is not nil.
+func (m *Mapping) source(d *RecipeData) (sourceReader, []byte, error) {
+	src, err := m.open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.Template {
+		if src, err = m.render(src, d); err != nil {
+			return nil, nil, fmt.Errorf("couldn't render %q: %v", m.describeSource(), err)
+		}
 	}
 	cksm, err := Fingerprint(m.Mode, src)
 	if err != nil {
+		src.Close()
 		return nil, nil, err
 	}
 	return src, cksm, nil
 }
 
-// Apply the mapping, copying Source to Destination and set the metadata.
-func (m *Mapping) Apply() (bool, error) {
-	src, srcCksm, err := m.source()
+// selected reports whether the mapping applies to the device described by d,
+// and if not, why not.
+func (m *Mapping) selected(d *RecipeData) (bool, string, error) {
+	if m.When == nil {
+		return true, "", nil
+	}
+	return m.When.Match(d)
+}
+
+// skippable is true when err shouldn't stop the rest of the mappings from being
+// applied.
+func (m *Mapping) skippable(err error) (bool, error) {
+	if _, ok := err.(*fetchError); !ok {
+		return false, nil
+	}
+	policy := m.OnFetchError
+	if policy == "" {
+		policy = DefaultOnFetchError
+	}
+	switch policy {
+	case FetchErrorFail:
+		return false, nil
+	case FetchErrorSkip:
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown on_fetch_error policy %q for %q", policy, m.Destination)
+}
+
+// Apply the mapping, copying Source to Destination and set the metadata. d is
+// used to execute template sources, and may be nil otherwise.
+func (m *Mapping) Apply(d *RecipeData) (bool, error) {
+	src, srcCksm, err := m.source(d)
 	if err != nil {
 		return false, err
 	}
@@ -170,12 +398,16 @@ func (m *Mapping) Apply() (bool, error) {
 		return false, nil
 	}
 
-	log.Printf("beginning copy %q -> %q", m.Source, m.Destination)
+	log.Printf("beginning copy %q -> %q", m.describeSource(), m.Destination)
 	dst, err := m.prepareNewDestination()
 	if err != nil {
 		return false, err
 	}
 	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return false, err
+	}
+	if err := dst.Close(); err != nil {
 		return false, err
 	}
 	if err := preppiFS.Chown(m.Destination, m.UID, m.GID); err != nil {
@@ -191,25 +423,47 @@ type Mapper struct {
 }
 
 // Apply the set of mappings to the preppiFS. Returns a count of files modified,
-// and the first error encountered. If an error is encoutered, modified count
-// reflects number of files modified beforehand.
-func (m *Mapper) Apply() (int, error) {
+// the mappings skipped because their remote source couldn't be fetched, and the
+// first error encountered. If an error is encoutered, modified count reflects
+// number of files modified beforehand. Mappings with a remote source which
+// can't be fetched are skipped rather than failed if their policy says so, as
+// are mappings whose conditions don't match d. d is also used to execute
+// template sources.
+func (m *Mapper) Apply(d *RecipeData) (int, []*PlanEntry, error) {
 	modified := 0
+	var skipped []*PlanEntry
 	for _, mapping := range m.Mappings {
-		ok, err := mapping.Apply()
+		selected, why, err := mapping.selected(d)
+		if err != nil {
+			return modified, skipped, err
+		}
+		if !selected {
+			log.Printf("skipping %q: %v", mapping.Destination, why)
+			continue
+		}
+		ok, err := mapping.Apply(d)
 		if err != nil {
-			return modified, err
+			skip, perr := mapping.skippable(err)
+			if perr != nil {
+				return modified, skipped, perr
+			}
+			if !skip {
+				return modified, skipped, err
+			}
+			log.Printf("skipping %q: %v", mapping.Destination, err)
+			skipped = append(skipped, &PlanEntry{Mapping: mapping, Action: ActionSkip, Reason: err.Error()})
+			continue
 		}
 		if ok {
 			modified++
 		}
 	}
-	return modified, nil
+	return modified, skipped, nil
 }
 
 // MapperFromConfig reads a config and returns a Mapper
 func MapperFromConfig(config string) (*Mapper, error) {
-	data, err := afero.ReadFile(preppiFS, config)
+	data, err := readSource(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed reading config %q: %v", config, err)
 	}
@@ -217,21 +471,36 @@ func MapperFromConfig(config string) (*Mapper, error) {
 	if err := json.Unmarshal(data, m); err != nil {
 		return nil, fmt.Errorf("failed reading config %q: %v", config, err)
 	}
+	m.SetSourceRoot(path.Dir(config))
 	return m, nil
 }
 
+// SetSourceRoot sets the directory against which relative sources are
+// resolved. MapperFromConfig uses the directory holding the config.
+func (m *Mapper) SetSourceRoot(dir string) {
+	for _, mapping := range m.Mappings {
+		mapping.root = dir
+	}
+}
+
 // MapperToFile marshals m to path as JSON.
 func MapperToFile(path string, m *Mapper) error {
+	return mapperToFs(preppiFS, path, m)
+}
+
+// mapperToFs marshals m to path on fs as JSON.
+func mapperToFs(fs Fs, path string, m *Mapper) error {
 	b, err := json.MarshalIndent(m, "", "\t")
 	if err != nil {
 		return err
 	}
-	f, err := preppiFS.Create(path)
+	f, err := fs.Create(path)
 	if err != nil {
 		return err
 	}
 	if _, err := f.Write(b); err != nil {
+		f.Close()
 		return err
 	}
-	return nil
+	return f.Close()
 }
@@ -40,9 +40,12 @@ package preppi
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
+
+	"github.com/spf13/afero"
 )
 
 type testFile struct {
@@ -95,11 +98,11 @@ func TestDestinationExists(t *testing.T) {
 	}{
 		{
 			name:    "doesn't exist",
-			mapping: &Mapping{"/whatever", "/doesnt/exists", 0640, 0750, 500, 500, false},
+			mapping: &Mapping{Source: "/whatever", Destination: "/doesnt/exists", Mode: 0640, DirMode: 0750, UID: 500, GID: 500},
 		},
 		{
 			name:    "exists",
-			mapping: &Mapping{"/whatever", "/some/file", 0640, 0750, 500, 500, false},
+			mapping: &Mapping{Source: "/whatever", Destination: "/some/file", Mode: 0640, DirMode: 0750, UID: 500, GID: 500},
 			want:    true,
 		},
 	} {
@@ -156,21 +159,21 @@ func TestShouldCopy(t *testing.T) {
 	}{
 		{
 			name:    "exists, should copy",
-			mapping: &Mapping{"/whatever", "/exists/should/copy", 0640, 0750, 500, 500, true},
+			mapping: &Mapping{Source: "/whatever", Destination: "/exists/should/copy", Mode: 0640, DirMode: 0750, UID: 500, GID: 500, Clobber: true},
 			want:    true,
 		},
 		{
 			name:    "exists, skipped",
-			mapping: &Mapping{"/whatever", "/exists/skipped", 0640, 0750, 500, 500, true},
+			mapping: &Mapping{Source: "/whatever", Destination: "/exists/skipped", Mode: 0640, DirMode: 0750, UID: 500, GID: 500, Clobber: true},
 		},
 		{
 			name:    "exists, can't clobber",
-			mapping: &Mapping{"/whatever", "/exists/cant/clobber", 0640, 0750, 500, 500, false},
+			mapping: &Mapping{Source: "/whatever", Destination: "/exists/cant/clobber", Mode: 0640, DirMode: 0750, UID: 500, GID: 500},
 			wantErr: errCantClobber,
 		},
 		{
 			name:    "doesn't exist, should copy",
-			mapping: &Mapping{"/whatever", "/doesnt/exist", 0640, 0750, 500, 500, false},
+			mapping: &Mapping{Source: "/whatever", Destination: "/doesnt/exist", Mode: 0640, DirMode: 0750, UID: 500, GID: 500},
 			want:    true,
 		},
 		// No such thing as "doesn't exist, shouldn't copy"
@@ -184,3 +187,336 @@ func TestShouldCopy(t *testing.T) {
 		}
 	}
 }
+
+func TestMappingOpen(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/boot/preppi/etc-hostname": &testFile{
+			[]byte("fromfile\n"),
+			0644,
+			0755,
+			0,
+			0,
+		},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	for _, tt := range []struct {
+		name    string
+		mapping *Mapping
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "source file",
+			mapping: &Mapping{Source: "/boot/preppi/etc-hostname"},
+			want:    "fromfile\n",
+		},
+		{
+			name:    "content",
+			mapping: &Mapping{Content: "inline\n"},
+			want:    "inline\n",
+		},
+		{
+			name:    "content_base64",
+			mapping: &Mapping{ContentBase64: "aW5saW5lCg=="},
+			want:    "inline\n",
+		},
+		{
+			name:    "bad content_base64",
+			mapping: &Mapping{ContentBase64: "not base64!"},
+			wantErr: true,
+		},
+		{
+			name:    "nothing",
+			mapping: &Mapping{},
+			wantErr: true,
+		},
+		{
+			name:    "source and content",
+			mapping: &Mapping{Source: "/boot/preppi/etc-hostname", Content: "inline\n"},
+			wantErr: true,
+		},
+	} {
+		src, err := tt.mapping.open()
+		if err != nil {
+			if !tt.wantErr {
+				t.Errorf("%v: wanted no error, got: %v", tt.name, err)
+			}
+			continue
+		}
+		if tt.wantErr {
+			t.Errorf("%v: wanted error, but got none", tt.name)
+		}
+		var b bytes.Buffer
+		if _, err := io.Copy(&b, src); err != nil {
+			t.Fatalf("%v: couldn't read source: %v", tt.name, err)
+		}
+		src.Close()
+		if got := b.String(); got != tt.want {
+			t.Errorf("%v: wanted %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestMappingApplyContent(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	m := &Mapping{Content: "raspberrypi\n", Destination: "/etc/hostname", Mode: 0644, DirMode: 0755}
+	changed, err := m.Apply(nil)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if !changed {
+		t.Error("wanted destination to change on first apply")
+	}
+	got, err := afero.ReadFile(preppiFS, "/etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != m.Content {
+		t.Errorf("wanted %q, got %q", m.Content, string(got))
+	}
+
+	// The content now matches, so a second application is a no-op.
+	changed, err = m.Apply(nil)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if changed {
+		t.Error("wanted destination to be unchanged on second apply")
+	}
+}
+
+func TestMappingApplyTemplate(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/boot/preppi/etc-hostname": &testFile{
+			[]byte("{{.Vars.Prefix}}-{{.Facts.CPUSerial}}\n"),
+			0644,
+			0755,
+			0,
+			0,
+		},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	d := &RecipeData{
+		Vars:  map[string]string{"Prefix": "pi"},
+		Facts: &Facts{CPUSerial: "deadbeef"},
+	}
+	m := &Mapping{Source: "/boot/preppi/etc-hostname", Destination: "/etc/hostname", Mode: 0644, DirMode: 0755, Template: true}
+	changed, err := m.Apply(d)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if !changed {
+		t.Error("wanted destination to change on first apply")
+	}
+	want := "pi-deadbeef\n"
+	got, err := afero.ReadFile(preppiFS, "/etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("wanted %q, got %q", want, string(got))
+	}
+
+	// The rendered output is fingerprinted, so it matches the destination.
+	changed, err = m.Apply(d)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if changed {
+		t.Error("wanted destination to be unchanged on second apply")
+	}
+
+	// Different facts render differently, and so clobber the destination.
+	d.Facts.CPUSerial = "cafef00d"
+	m.Clobber = true
+	changed, err = m.Apply(d)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if !changed {
+		t.Error("wanted destination to change with new facts")
+	}
+
+	// A missing variable is an error, rather than rendering "<no value>".
+	delete(d.Vars, "Prefix")
+	if _, err := m.Apply(d); err == nil {
+		t.Error("wanted error for missing variable")
+	}
+	if got, _ := afero.ReadFile(preppiFS, "/etc/hostname"); string(got) != "pi-cafef00d\n" {
+		t.Errorf("wanted destination untouched, got %q", got)
+	}
+}
+
+func TestMapperApplyConditions(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	m := &Mapper{Mappings: []*Mapping{
+		&Mapping{Content: "pi1\n", Destination: "/etc/hostname", Mode: 0644, When: &Condition{CPUSerial: "deadbeef"}},
+		&Mapping{Content: "pi2\n", Destination: "/etc/hostname", Mode: 0644, When: &Condition{CPUSerial: "cafef00d"}},
+	}}
+	d := &RecipeData{Facts: &Facts{CPUSerial: "cafef00d"}}
+	n, _, err := m.Apply(d)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("wanted 1 modified, got %d", n)
+	}
+	got, err := afero.ReadFile(preppiFS, "/etc/hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "pi2\n" {
+		t.Errorf("wanted %q, got %q", "pi2\n", string(got))
+	}
+}
+
+func TestMapperApplyUnderRoot(t *testing.T) {
+	origPreppiFS, origBootFS := preppiFS, bootFS
+	defer func() { preppiFS, bootFS = origPreppiFS, origBootFS }()
+	host := NewMemMapFs()
+	preppiFS = NewBasePathFs(host, "/mnt/rootfs")
+	bootFS = NewBasePathFs(host, "/mnt/boot")
+
+	files := map[string]*testFile{
+		"/mnt/boot/preppi/preppi.conf": &testFile{
+			[]byte(`{"map": [{"source": "/boot/preppi/etc-hostname", "destination": "/etc/hostname", "mode": 420, "dirmode": 493}]}`),
+			0644,
+			0755,
+			0,
+			0,
+		},
+		"/mnt/boot/preppi/etc-hostname": &testFile{[]byte("offline\n"), 0644, 0755, 0, 0},
+		"/mnt/rootfs/etc/hosts":         &testFile{[]byte("127.0.0.1 localhost\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, host, files)
+
+	if ok, err := SourceExists("/boot/preppi/preppi.conf"); !ok || err != nil {
+		t.Fatalf("wanted config to exist under -boot, got %v, %v", ok, err)
+	}
+	m, err := MapperFromConfig("/boot/preppi/preppi.conf")
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if _, _, err := m.Apply(nil); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	got, err := afero.ReadFile(host, "/mnt/rootfs/etc/hostname")
+	if err != nil {
+		t.Fatalf("wanted destination written under root: %v", err)
+	}
+	if string(got) != "offline\n" {
+		t.Errorf("wanted %q, got %q", "offline\n", string(got))
+	}
+	if exists, _ := afero.Exists(host, "/etc/hostname"); exists {
+		t.Error("wanted nothing written outside of root")
+	}
+}
+
+func TestMapperApplyThenPlan(t *testing.T) {
+	origPreppiFS, origBootFS := preppiFS, bootFS
+	defer func() { preppiFS, bootFS = origPreppiFS, origBootFS }()
+	// The umask only applies to real files.
+	root, err := ioutil.TempDir("", "TestMapperApplyThenPlan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	SetTargetRoot(root)
+	if err := os.MkdirAll(path.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(root, "etc/hostname"), []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	m := &Mapper{Mappings: []*Mapping{
+		&Mapping{Content: "interface eth0\n", Destination: "/etc/dhcpcd.conf", Mode: 0664, DirMode: 0755, UID: uid, GID: gid, Clobber: true},
+		&Mapping{Content: "pi\n", Destination: "/etc/hostname", Mode: 0644, DirMode: 0755, UID: uid, GID: gid, Clobber: true},
+	}}
+	if n, _, err := m.Apply(nil); n != 2 || err != nil {
+		t.Fatalf("wanted 2 files modified, got %v, %v", n, err)
+	}
+	for _, mapping := range m.Mappings {
+		info, err := os.Stat(path.Join(root, mapping.Destination))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != mapping.Mode {
+			t.Errorf("%v: wanted mode %v, got %v", mapping.Destination, mapping.Mode, info.Mode().Perm())
+		}
+	}
+	// Verifying straight after preparing finds nothing to do.
+	entries, err := m.Plan(nil)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	for _, e := range entries {
+		if e.Action != ActionNone {
+			t.Errorf("%v: wanted no drift, got %v: %v", e.Mapping.Destination, e.Action, e.Reason)
+		}
+	}
+	if n, _, err := m.Apply(nil); n != 0 || err != nil {
+		t.Errorf("wanted nothing modified applying again, got %v, %v", n, err)
+	}
+}
+
+func TestMapperRelativeSources(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/boot/preppi/preppi.conf": &testFile{
+			[]byte(`{"map": [
+				{"source": "etc-hostname", "destination": "/etc/hostname", "mode": 420, "dirmode": 493, "clobber": true},
+				{"source": "/srv/etc-motd", "destination": "/etc/motd", "mode": 420, "dirmode": 493, "clobber": true}
+			]}`),
+			0644,
+			0755,
+			0,
+			0,
+		},
+		"/boot/preppi/etc-hostname": &testFile{[]byte("relative\n"), 0644, 0755, 0, 0},
+		"/srv/etc-hostname":         &testFile{[]byte("overridden\n"), 0644, 0755, 0, 0},
+		"/srv/etc-motd":             &testFile{[]byte("absolute\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	m, err := MapperFromConfig("/boot/preppi/preppi.conf")
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	for _, root := range []string{"", "/srv"} {
+		want := "relative\n"
+		if root != "" {
+			m.SetSourceRoot(root)
+			want = "overridden\n"
+		}
+		if _, _, err := m.Apply(nil); err != nil {
+			t.Fatalf("source root %q: wanted no error, got: %v", root, err)
+		}
+		if got, _ := afero.ReadFile(preppiFS, "/etc/hostname"); string(got) != want {
+			t.Errorf("source root %q: wanted %q, got %q", root, want, got)
+		}
+		if got, _ := afero.ReadFile(preppiFS, "/etc/motd"); string(got) != "absolute\n" {
+			t.Errorf("source root %q: wanted absolute source untouched, got %q", root, got)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// partialsDir is the directory of a recipe holding its partials: templates
+// which every ingredient can use with {{template "name" .}}.
+const partialsDir = "partials"
+
+// partials reads the partials available to r's ingredients, by template name,
+// which is the file name without its extension. Those of the recipes r
+// extends or includes come first, so that r's own replace them.
+func (r *Recipe) partials() (map[string]string, error) {
+	dirs := r.partialDirs
+	if dirs == nil {
+		dirs = []string{path.Join(r.root, partialsDir)}
+	}
+	partials := make(map[string]string)
+	for _, dir := range dirs {
+		infos, err := afero.ReadDir(preppiFS, dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir() {
+				continue
+			}
+			data, err := afero.ReadFile(preppiFS, path.Join(dir, info.Name()))
+			if err != nil {
+				return nil, err
+			}
+			partials[strings.TrimSuffix(info.Name(), path.Ext(info.Name()))] = string(data)
+		}
+	}
+	return partials, nil
+}
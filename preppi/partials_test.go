@@ -0,0 +1,89 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestRecipeBakePartials(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/base/recipe.json":          &testFile{[]byte(`{"name": "Base"}`), 0644, 0755, 0, 0},
+		"/recipes/base/partials/header.tmpl": &testFile{[]byte("# base header\n"), 0644, 0755, 0, 0},
+		"/recipes/base/partials/footer.tmpl": &testFile{[]byte("# {{.Vars.Hostname}} footer\n"), 0644, 0755, 0, 0},
+		"/recipes/test/recipe.json": &testFile{[]byte(`{
+			"extends": "base",
+			"ingredients": [
+				{"source": "etc-hosts", "destination": "/etc/hosts", "vars": ["Hostname"]},
+				{"source": "config.j2", "destination": "/etc/app/config.j2", "delims": ["[[", "]]"], "vars": ["Hostname"]},
+				{"source": "template.go", "destination": "/etc/app/template.go", "raw": true}
+			]
+		}`), 0644, 0755, 0, 0},
+		"/recipes/test/partials/header": &testFile{[]byte("# {{.Vars.Hostname}} header\n"), 0644, 0755, 0, 0},
+		"/recipes/test/etc-hosts":       &testFile{[]byte("{{template \"header\" . -}}\n127.0.1.1 {{.Vars.Hostname}}\n{{template \"footer\" .}}"), 0644, 0755, 0, 0},
+		"/recipes/test/config.j2":       &testFile{[]byte("name: {{ name }} [[.Vars.Hostname]]\n[[template \"footer\" .]]"), 0644, 0755, 0, 0},
+		"/recipes/test/template.go":     &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	r, err := RecipeFromFile("/recipes/test/recipe.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+	if err := r.Bake("/out", d, nil); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	for name, want := range map[string]string{
+		// The recipe's own header replaces the one it extends.
+		"/out/etc-hosts":   "# pi header\n127.0.1.1 pi\n# pi footer\n",
+		"/out/config.j2":   "name: {{ name }} pi\n# pi footer\n",
+		"/out/template.go": "{{.Vars.Hostname}}\n",
+	} {
+		if got, err := afero.ReadFile(preppiFS, name); err != nil || string(got) != want {
+			t.Errorf("%v: wanted %q, got %q, %v", name, want, got, err)
+		}
+	}
+	if problems := r.Lint(); len(problems) != 0 {
+		t.Errorf("wanted no lint problems, got %v", problems)
+	}
+
+	// Variables used by partials count as the ingredient's.
+	r.Ingredients[0].Vars = nil
+	if problems := r.Lint(); len(problems) != 1 || problems[0].Warning {
+		t.Errorf("wanted an error for the undeclared variable used by partials, got %v", problems)
+	}
+}
+
+func TestIngredientDelims(t *testing.T) {
+	for _, delims := range [][]string{{"[["}, {"[[", ""}, {"", "]]"}} {
+		i := &Ingredient{Source: "test", Delims: delims}
+		if _, err := i.compileTemplate("", "[[.Vars.Hostname]]", nil); err == nil {
+			t.Errorf("delims %q: wanted error", delims)
+		}
+	}
+}
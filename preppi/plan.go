@@ -0,0 +1,151 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"fmt"
+	"io"
+)
+
+// Action is what applying a Mapping would do.
+type Action int
+
+const (
+	// ActionWrite means the destination would be written.
+	ActionWrite Action = iota
+	// ActionNone means the destination is already up to date.
+	ActionNone
+	// ActionSkip means the mapping would be skipped, by condition or because
+	// its source is unavailable.
+	ActionSkip
+	// ActionConflict means the destination differs, but can't be clobbered.
+	ActionConflict
+	// ActionFetch means the source is remote and not yet cached, so it would
+	// be fetched before telling whether the destination differs.
+	ActionFetch
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionWrite:
+		return "write"
+	case ActionNone:
+		return "unchanged"
+	case ActionSkip:
+		return "skip"
+	case ActionConflict:
+		return "conflict"
+	case ActionFetch:
+		return "fetch"
+	}
+	return fmt.Sprintf("Action(%d)", int(a))
+}
+
+// PlanEntry describes what applying a Mapping would do, and why.
+type PlanEntry struct {
+	Mapping *Mapping
+	Action  Action
+	Reason  string
+}
+
+// plan works out what applying the mapping would do, without doing it.
+func (m *Mapping) plan(d *RecipeData) (*PlanEntry, error) {
+	e := &PlanEntry{Mapping: m}
+	selected, why, err := m.selected(d)
+	if err != nil {
+		return nil, err
+	}
+	if !selected {
+		e.Action, e.Reason = ActionSkip, why
+		return e, nil
+	}
+	// Planning fetches nothing, so only a cached remote source can be
+	// compared.
+	if m.Content == "" && m.ContentBase64 == "" && isRemote(m.Source) {
+		cached, err := cachedSource(m.Source, m.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		if cached == nil {
+			e.Action, e.Reason = ActionFetch, fmt.Sprintf("would fetch %v", m.Source)
+			return e, nil
+		}
+	}
+
+	src, srcCksm, err := m.source(d)
+	if err != nil {
+		skip, perr := m.skippable(err)
+		if perr != nil {
+			return nil, perr
+		}
+		if !skip {
+			return nil, err
+		}
+		e.Action, e.Reason = ActionSkip, err.Error()
+		return e, nil
+	}
+	src.Close()
+
+	exists, err := m.destinationExists()
+	if err != nil {
+		return nil, err
+	}
+	ok, err := m.shouldCopy(srcCksm)
+	switch {
+	case err == errCantClobber:
+		e.Action, e.Reason = ActionConflict, "destination differs and clobber is false"
+	case err != nil:
+		return nil, err
+	case !ok:
+		e.Action, e.Reason = ActionNone, "destination matches"
+	case exists:
+		e.Action, e.Reason = ActionWrite, "destination differs"
+	default:
+		e.Action, e.Reason = ActionWrite, "destination doesn't exist"
+	}
+	return e, nil
+}
+
+// Plan works out what Apply would do with d, without modifying anything. The
+// first error encountered is returned.
+func (m *Mapper) Plan(d *RecipeData) ([]*PlanEntry, error) {
+	entries := make([]*PlanEntry, 0, len(m.Mappings))
+	for _, mapping := range m.Mappings {
+		e, err := mapping.plan(d)
+		if err != nil {
+			return entries, fmt.Errorf("%q: %v", mapping.Destination, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// WritePlan writes a human-readable description of the plan to w, one mapping
+// per line.
+func WritePlan(w io.Writer, entries []*PlanEntry) error {
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "%-9v %v <- %v (%v)\n",
+			e.Action, e.Mapping.Destination, e.Mapping.describeSource(), e.Reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
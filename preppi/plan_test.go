@@ -0,0 +1,121 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestMapperPlan(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/etc/unchanged": &testFile{[]byte("same"), 0644, 0755, 0, 0},
+		"/etc/differs":   &testFile{[]byte("old"), 0644, 0755, 0, 0},
+		"/etc/conflict":  &testFile{[]byte("old"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	m := &Mapper{Mappings: []*Mapping{
+		&Mapping{Content: "new", Destination: "/etc/new", Mode: 0644},
+		&Mapping{Content: "same", Destination: "/etc/unchanged", Mode: 0644},
+		&Mapping{Content: "new", Destination: "/etc/differs", Mode: 0644, Clobber: true},
+		&Mapping{Content: "new", Destination: "/etc/conflict", Mode: 0644},
+		&Mapping{Content: "new", Destination: "/etc/other", Mode: 0644, When: &Condition{CPUSerial: "cafef00d"}},
+	}}
+	d := &RecipeData{Facts: &Facts{CPUSerial: "deadbeef"}}
+	entries, err := m.Plan(d)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	want := []Action{ActionWrite, ActionNone, ActionWrite, ActionConflict, ActionSkip}
+	if len(entries) != len(want) {
+		t.Fatalf("wanted %d entries, got %d", len(want), len(entries))
+	}
+	for i, e := range entries {
+		if e.Action != want[i] {
+			t.Errorf("%v: wanted %v, got %v", e.Mapping.Destination, want[i], e.Action)
+		}
+	}
+	if exists, _ := afero.Exists(preppiFS, "/etc/new"); exists {
+		t.Error("wanted plan to make no changes")
+	}
+
+	var b bytes.Buffer
+	if err := WritePlan(&b, entries[4:]); err != nil {
+		t.Fatal(err)
+	}
+	wantOut := "skip      /etc/other <- inline content (cpu_serial is \"deadbeef\", wanted \"cafef00d\")\n"
+	if b.String() != wantOut {
+		t.Errorf("wanted output %q, got %q", wantOut, b.String())
+	}
+}
+
+func TestMapperPlanRemote(t *testing.T) {
+	defer setUpFetchForTest()()
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, fetchTestContent)
+	}))
+	defer srv.Close()
+
+	m := &Mapper{Mappings: []*Mapping{
+		&Mapping{Source: srv.URL, SHA256: fetchTestSum, Destination: "/etc/remote", Mode: 0644},
+	}}
+	entries, err := m.Plan(&RecipeData{})
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if e := entries[0]; e.Action != ActionFetch || e.Reason != "would fetch "+srv.URL {
+		t.Errorf("wanted fetch, got %v (%v)", e.Action, e.Reason)
+	}
+	if requests != 0 {
+		t.Errorf("wanted plan to fetch nothing, got %d requests", requests)
+	}
+	if exists, _ := afero.Exists(preppiFS, CacheDir); exists {
+		t.Error("wanted plan to cache nothing")
+	}
+
+	// A cached source is compared as any other.
+	if _, err := fetchSource(srv.URL, fetchTestSum); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = m.Plan(&RecipeData{})
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if e := entries[0]; e.Action != ActionWrite {
+		t.Errorf("wanted write, got %v (%v)", e.Action, e.Reason)
+	}
+	if requests != 1 {
+		t.Errorf("wanted only the explicit fetch, got %d requests", requests)
+	}
+}
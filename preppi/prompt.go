@@ -0,0 +1,205 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prompter asks the user for the values of variables.
+type Prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+	// echo turns the echoing of typed input on and off, to hide secrets. It's
+	// nil when that isn't possible.
+	echo func(on bool) error
+}
+
+// NewTerminalPrompter returns a Prompter reading answers from the terminal
+// in, and writing prompts to out.
+func NewTerminalPrompter(in *os.File, out io.Writer) (*Prompter, error) {
+	if !isTerminal(in) {
+		return nil, fmt.Errorf("%v is not a terminal", in.Name())
+	}
+	return &Prompter{
+		in:   bufio.NewReader(in),
+		out:  out,
+		echo: func(on bool) error { return setEcho(in, on) },
+	}, nil
+}
+
+// ReadPassword reads a password from in. A terminal is asked for it twice,
+// without echo, and the answers must match. Otherwise, the first line of in
+// is the password.
+func ReadPassword(in *os.File, out io.Writer) (string, error) {
+	if !isTerminal(in) {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return trimNewline(line), nil
+	}
+	p, err := NewTerminalPrompter(in, out)
+	if err != nil {
+		return "", err
+	}
+	password, err := p.prompt(&Variable{Name: "Password", Secret: true})
+	if err != nil {
+		return "", err
+	}
+	again, err := p.prompt(&Variable{Name: "Retype password", Secret: true})
+	if err != nil {
+		return "", err
+	}
+	if password != again {
+		return "", fmt.Errorf("passwords don't match")
+	}
+	return password, nil
+}
+
+// PromptVars asks for every variable in schema which is missing from vars,
+// storing the answers in vars. Answers are validated, and asked for again if
+// invalid. An empty answer takes the variable's default, if it has one.
+func (p *Prompter) PromptVars(schema []*Variable, vars map[string]string) error {
+	for _, v := range schema {
+		// Generated variables are filled in by the bake.
+		if _, ok := vars[v.Name]; ok || v.Generate != "" {
+			continue
+		}
+		for {
+			value, err := p.prompt(v)
+			if err != nil {
+				return fmt.Errorf("no value for %q: %v", v.Name, err)
+			}
+			if err := v.Validate(value); err != nil {
+				fmt.Fprintf(p.out, "  %v\n", err)
+				continue
+			}
+			vars[v.Name] = value
+			break
+		}
+	}
+	return nil
+}
+
+// prompt asks for a single value of v.
+func (p *Prompter) prompt(v *Variable) (string, error) {
+	q := v.Name
+	if v.Description != "" {
+		q += fmt.Sprintf(" (%v)", v.Description)
+	}
+	if v.Default != nil {
+		def := *v.Default
+		if v.IsSecret() {
+			def = "hidden"
+		}
+		q += fmt.Sprintf(" [%v]", def)
+	}
+	fmt.Fprintf(p.out, "%v: ", q)
+
+	if v.IsSecret() {
+		if p.echo == nil || p.echo(false) != nil {
+			fmt.Fprint(p.out, "(input will be visible) ")
+		} else {
+			defer func() {
+				p.echo(true)
+				fmt.Fprintln(p.out)
+			}()
+		}
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	line = trimNewline(line)
+	if line == "" && v.Default != nil {
+		return *v.Default, nil
+	}
+	return line, nil
+}
+
+// PublicVars returns vars without the values of variables which schema marks
+// as secret, eg for saving.
+func PublicVars(schema []*Variable, vars map[string]string) map[string]string {
+	secret := make(map[string]bool)
+	for _, v := range schema {
+		if v.IsSecret() {
+			secret[v.Name] = true
+		}
+	}
+	public := make(map[string]string)
+	for k, v := range vars {
+		if !secret[k] {
+			public[k] = v
+		}
+	}
+	return public
+}
+
+// WriteVarsFile writes vars to a file which VarsFromFile can read, in the
+// format suggested by its extension.
+func WriteVarsFile(name string, vars map[string]string) error {
+	names := make([]string, 0, len(vars))
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var b []byte
+	switch path.Ext(name) {
+	case ".yaml", ".yml":
+		b = writeQuotedVars(names, vars, ": ")
+	case ".env":
+		b = writeQuotedVars(names, vars, "=")
+	default:
+		var err error
+		if b, err = json.MarshalIndent(vars, "", "\t"); err != nil {
+			return err
+		}
+		b = append(b, '\n')
+	}
+	f, err := preppiFS.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeQuotedVars writes a line per variable, with its value double quoted.
+func writeQuotedVars(names []string, vars map[string]string, sep string) []byte {
+	var b strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&b, "%v%v%v\n", k, sep, strconv.Quote(vars[k]))
+	}
+	return []byte(b.String())
+}
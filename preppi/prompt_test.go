@@ -0,0 +1,115 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrompterPromptVars(t *testing.T) {
+	local := "local"
+	schema := []*Variable{
+		&Variable{Name: "Hostname", Type: VarHostname, Description: "name of the host"},
+		&Variable{Name: "LocalDomain", Type: VarHostname, Default: &local},
+		&Variable{Name: "Eth0CIDR", Type: VarCIDR},
+		&Variable{Name: "WPAPSK", Pattern: ".{8,63}", Secret: true},
+	}
+	var out bytes.Buffer
+	var echoes []bool
+	p := &Prompter{
+		in:   bufio.NewReader(strings.NewReader("\n192.168.1.5\n192.168.1.5/24\nshort\nlong enough\n")),
+		out:  &out,
+		echo: func(on bool) error { echoes = append(echoes, on); return nil },
+	}
+	vars := map[string]string{"Hostname": "given"}
+	if err := p.PromptVars(schema, vars); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	want := map[string]string{
+		"Hostname":    "given",
+		"LocalDomain": "local",
+		"Eth0CIDR":    "192.168.1.5/24",
+		"WPAPSK":      "long enough",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("wanted %v, got %v", want, vars)
+	}
+	// Echo is turned off and back on for each attempt at the secret.
+	if wantEchoes := []bool{false, true, false, true}; !reflect.DeepEqual(echoes, wantEchoes) {
+		t.Errorf("wanted echo changes %v, got %v", wantEchoes, echoes)
+	}
+	prompts := out.String()
+	for _, want := range []string{"LocalDomain [local]: ", "not an address with a prefix length", "WPAPSK: "} {
+		if !strings.Contains(prompts, want) {
+			t.Errorf("wanted prompts to contain %q, got:\n%v", want, prompts)
+		}
+	}
+	if strings.Contains(prompts, "Hostname") {
+		t.Errorf("wanted no prompt for given variable, got:\n%v", prompts)
+	}
+	if strings.Contains(prompts, "short") {
+		t.Errorf("wanted secret kept out of prompts, got:\n%v", prompts)
+	}
+
+	p = &Prompter{in: bufio.NewReader(strings.NewReader("not a cidr\n")), out: &out}
+	if err := p.PromptVars(schema, map[string]string{"Hostname": "pi", "LocalDomain": "local"}); err == nil {
+		t.Error("wanted error when input runs out")
+	}
+}
+
+func TestWriteVarsFile(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	vars := map[string]string{
+		"Hostname": "pi",
+		"SSID":     `My "Network" # 2`,
+		"PSK":      "c2VjcmV0=",
+		"Motd":     "two\nlines",
+		"Empty":    "",
+	}
+	for _, name := range []string{"/vars.json", "/vars.yaml", "/vars.env"} {
+		if err := WriteVarsFile(name, vars); err != nil {
+			t.Fatalf("%v: wanted no error, got: %v", name, err)
+		}
+		got, err := VarsFromFile(name)
+		if err != nil {
+			t.Fatalf("%v: wanted no error reading back, got: %v", name, err)
+		}
+		if !reflect.DeepEqual(got, vars) {
+			t.Errorf("%v: wanted %v, got %v", name, vars, got)
+		}
+	}
+}
+
+func TestPublicVars(t *testing.T) {
+	schema := []*Variable{&Variable{Name: "Hostname"}, &Variable{Name: "WPAPSK", Secret: true}}
+	got := PublicVars(schema, map[string]string{"Hostname": "pi", "WPAPSK": "secret", "Other": "x"})
+	want := map[string]string{"Hostname": "pi", "Other": "x"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+}
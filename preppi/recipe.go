@@ -21,13 +21,14 @@
 package preppi
 
 import (
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"text/template"
+	"unicode/utf8"
 
 	"github.com/spf13/afero"
 )
@@ -44,6 +45,18 @@ import (
 // files for the recipe.
 type RecipeData struct {
 	Vars map[string]string
+
+	// Facts about the device, available to templates as .Facts. They're only
+	// known on the device, so recipes are baked without them.
+	Facts *Facts
+
+	// Item is the current value of a repeated ingredient's Foreach list.
+	Item string
+
+	// version, if set, replaces VersionString in GeneratedByPrepPi.
+	version string
+	// sandbox, if set, limits the templates executed with the data.
+	sandbox *Sandbox
 }
 
 type Ingredient struct {
@@ -55,34 +68,157 @@ type Ingredient struct {
 	GID         int         `json:"gid"`
 	Clobber     bool        `json:"clobber,omitempty"`
 	Vars        []string    `json:"vars"`
+	// Delims, if set, are the left and right delimiters of the template's
+	// actions, in place of "{{" and "}}", for files which contain those.
+	Delims []string `json:"delims,omitempty"`
+	// Raw ingredients aren't templates, and are copied as they are.
+	Raw bool `json:"raw,omitempty"`
+	// When, if set, is a template pipeline, eg `.Vars.SSID` or
+	// `eq .Vars.Model "3B"`, and the ingredient is only baked if it's true.
+	// Missing variables are empty in it, rather than errors.
+	When string `json:"when,omitempty"`
+	// Foreach names a list variable. The ingredient is baked once for each of
+	// its values, which templates see as .Item.
+	Foreach string `json:"foreach,omitempty"`
+	// Output is the name of the baked file, defaulting to Source. Output and
+	// Destination are templates, so that those of a repeated ingredient can
+	// differ by .Item.
+	Output string `json:"output,omitempty"`
+
+	// root is the directory holding Source, and recipe the name of the recipe
+	// which the ingredient came from, which differ from those of the recipe
+	// using the ingredient if it's extended or included.
+	root   string
+	recipe string
+}
+
+// From returns the name of the recipe which provides the ingredient.
+func (i *Ingredient) From() string {
+	return i.recipe
+}
+
+// vars returns the variables which the ingredient needs.
+func (i *Ingredient) vars() []string {
+	if i.Foreach == "" {
+		return i.Vars
+	}
+	return append([]string{i.Foreach}, i.Vars...)
 }
 
-func (i *Ingredient) Prepare(srcRoot, destRoot string, d *RecipeData) error {
-	src, err := preppiFS.Open(path.Join(srcRoot, i.Source))
+// whenTemplate parses the ingredient's When condition.
+func (i *Ingredient) whenTemplate(srcRoot string) (*template.Template, error) {
+	t, err := template.New("when").Option("missingkey=zero").Funcs(templateFuncs(srcRoot)).Parse("{{if " + i.When + "}}true{{end}}")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("invalid when %q: %v", i.When, err)
+	}
+	return t, nil
+}
+
+// included evaluates the ingredient's When condition.
+func (i *Ingredient) included(srcRoot string, d *RecipeData) (bool, error) {
+	if i.When == "" {
+		return true, nil
 	}
-	tmplData, err := ioutil.ReadAll(src)
+	t, err := i.whenTemplate(srcRoot)
 	if err != nil {
-		return err
+		return false, err
+	}
+	b, err := d.sandboxed().execute(fmt.Sprintf("ingredient %q", i.Source), t, d)
+	if err != nil {
+		return false, fmt.Errorf("when %q: %v", i.When, err)
 	}
-	src.Close()
+	return string(b) == "true", nil
+}
+
+// bakedIngredient is one file which an ingredient bakes into.
+type bakedIngredient struct {
+	// Ingredient is a copy of the ingredient, with Source naming the baked
+	// file and Destination rendered.
+	*Ingredient
+	// data is what the ingredient's template is executed with.
+	data *RecipeData
+}
+
+// instances returns the files the ingredient bakes into: none if its When
+// condition is false, one for each value of its Foreach list, or else one.
+func (i *Ingredient) instances(srcRoot string, d *RecipeData) ([]*bakedIngredient, error) {
+	if ok, err := i.included(srcRoot, d); err != nil || !ok {
+		return nil, err
+	}
+	items := []string{""}
+	if i.Foreach != "" {
+		if i.Output == "" {
+			return nil, fmt.Errorf("ingredient %q repeats for each %v, so needs an output", i.Source, i.Foreach)
+		}
+		items = listValues(d.Vars[i.Foreach])
+	}
+	var baked []*bakedIngredient
+	for _, item := range items {
+		data := *d
+		data.Item = item
+		b := *i
+		var err error
+		if i.Output != "" {
+			if b.Source, err = renderString(srcRoot, i.Output, &data); err != nil {
+				return nil, fmt.Errorf("output of ingredient %q: %v", i.Source, err)
+			}
+		}
+		if b.Destination, err = renderString(srcRoot, i.Destination, &data); err != nil {
+			return nil, fmt.Errorf("destination of ingredient %q: %v", i.Source, err)
+		}
+		baked = append(baked, &bakedIngredient{&b, &data})
+	}
+	return baked, nil
+}
 
-	tmpl, err := i.compileTemplate(string(tmplData))
+// renderString executes text as a template.
+func renderString(srcRoot, text string, d *RecipeData) (string, error) {
+	t, err := template.New(text).Option("missingkey=error").Funcs(templateFuncs(srcRoot)).Parse(text)
 	if err != nil {
-		return err
+		return "", err
+	}
+	b, err := d.sandboxed().execute(fmt.Sprintf("template %q", text), t, d)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// render executes the ingredient's template, which may use partials,
+// returning the generated content. A raw ingredient's source is returned as
+// it is.
+func (i *Ingredient) render(srcRoot string, partials map[string]string, d *RecipeData) ([]byte, error) {
+	tmplData, err := afero.ReadFile(preppiFS, path.Join(srcRoot, i.Source))
+	if err != nil {
+		return nil, err
+	}
+	if i.Raw {
+		return tmplData, nil
 	}
 
-	dst, err := preppiFS.Create(path.Join(destRoot, i.Source))
+	tmpl, err := i.compileTemplate(srcRoot, string(tmplData), partials)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer dst.Close()
 
-	if err := tmpl.Execute(dst, d); err != nil {
+	return d.sandboxed().execute(fmt.Sprintf("ingredient %q", i.Source), tmpl, d)
+}
+
+// write saves rendered content under destRoot on fs.
+func (i *Ingredient) write(fs Fs, destRoot string, content []byte) error {
+	name := path.Join(destRoot, i.Source)
+	if err := fs.MkdirAll(path.Dir(name), 0755); err != nil {
 		return err
 	}
-	return nil
+	dst, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(content); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
 }
 
 func (i *Ingredient) Mapping() *Mapping {
@@ -97,8 +233,36 @@ func (i *Ingredient) Mapping() *Mapping {
 	}
 }
 
-func (i *Ingredient) compileTemplate(tmplData string) (*template.Template, error) {
-	t := template.New(i.Source)
+// inlineMapping returns a Mapping which carries content rather than referring
+// to a source file.
+func (i *Ingredient) inlineMapping(content []byte) *Mapping {
+	m := i.Mapping()
+	m.Source = ""
+	if utf8.Valid(content) {
+		m.Content = string(content)
+	} else {
+		m.ContentBase64 = base64.StdEncoding.EncodeToString(content)
+	}
+	return m
+}
+
+// compileTemplate parses the ingredient's template, along with partials, whose
+// readFile function reads files relative to srcRoot.
+func (i *Ingredient) compileTemplate(srcRoot, tmplData string, partials map[string]string) (*template.Template, error) {
+	// A missing variable is an error, rather than <no value> in the output.
+	t := template.New(i.Source).Option("missingkey=error").Funcs(templateFuncs(srcRoot))
+	// Partials always use the default delimiters.
+	for name, p := range partials {
+		if _, err := t.New(name).Parse(p); err != nil {
+			return nil, fmt.Errorf("partial %q: %v", name, err)
+		}
+	}
+	if i.Delims != nil {
+		if len(i.Delims) != 2 || i.Delims[0] == "" || i.Delims[1] == "" {
+			return nil, fmt.Errorf("delims must be a left and a right delimiter, got %q", i.Delims)
+		}
+		t.Delims(i.Delims[0], i.Delims[1])
+	}
 	tmpl, err := t.Parse(tmplData)
 	if err != nil {
 		return nil, err
@@ -109,54 +273,262 @@ func (i *Ingredient) compileTemplate(tmplData string) (*template.Template, error
 // GeneratedByPrepPi returns a string of the format:
 // "Generated by PrepPi $VERSION ($BUILD_ID)"
 func (r *RecipeData) GeneratedByPrepPi() string {
+	if r.version != "" {
+		return fmt.Sprintf("Generated by %v", r.version)
+	}
 	return fmt.Sprintf("Generated by %v", VersionString())
 }
 
 type Recipe struct {
-	Name        string        `json:"name"`
+	Name string `json:"name"`
+	// Description tells users what the recipe is for.
+	Description string `json:"description,omitempty"`
+	// Extends names a recipe, under the same recipe root, whose ingredients
+	// and variables this recipe starts from.
+	Extends string `json:"extends,omitempty"`
+	// Include names further recipes whose ingredients and variables are
+	// added, after those of Extends. Ingredients replace any earlier ones with
+	// the same destination, and variables those of the same name.
+	Include     []string      `json:"include,omitempty"`
 	Ingredients []*Ingredient `json:"ingredients"`
+	// Variables describes the variables the ingredients expect. Those used
+	// but not described here are required strings.
+	Variables []*Variable `json:"variables,omitempty"`
 
 	// root is the path to the directory in which the recipe file exists.
 	// All ingredient file paths will be interpreted relative to this.
 	root string
+	// partialDirs are the partials directories of the recipe and those it
+	// extends or includes, in increasing precedence. nil means only the
+	// recipe's own.
+	partialDirs []string
+}
+
+// BakeOptions alter the way a Recipe is baked. The zero value is the default
+// behavior.
+type BakeOptions struct {
+	// InlineLimit is the size in bytes at or under which a rendered ingredient
+	// is inlined into preppi.conf instead of being written to its own file. Zero
+	// disables inlining.
+	InlineLimit int
+
+	// Output is the Fs to which baked files are written. Defaults to the
+	// local file system.
+	Output Fs
+
+	// Prefix is the directory on the device under which the baked files will
+	// be found, eg /boot/preppi, written into preppi.conf as the sources'
+	// directory. Empty leaves sources relative to preppi.conf.
+	Prefix string
+
+	// VarsRecord is the file on the local file system recording the values of
+	// generated variables, so that baking again gives the same ones. It
+	// defaults to the output's name followed by .vars.json, unless Output is
+	// set, in which case nothing is recorded.
+	VarsRecord string
+
+	// VarsKey, if set, encrypts VarsRecord.
+	VarsKey []byte
+
+	// Sandbox, if set, limits what the recipe's templates can do, for recipes
+	// which aren't trusted.
+	Sandbox *Sandbox
+}
+
+// Bake renders the recipe's ingredients into dest, along with a preppi.conf
+// mapping them to their destinations. o may be nil.
+//
+// Everything is rendered into a staging directory beside dest first, which
+// replaces dest only once the whole recipe has baked, so a failed bake leaves
+// dest as it was. An existing dest must be empty or hold an earlier bake.
+//
+// Generated variables which d lacks are taken from, or else generated and
+// added to, the record named by o.VarsRecord once the bake succeeds. A
+// Manifest of the bake is written beside preppi.conf, keeping d's variables,
+// except secrets unless o.VarsKey encrypts them.
+func (r *Recipe) Bake(dest string, d *RecipeData, o *BakeOptions) error {
+	record, err := r.bake(dest, d, o)
+	if err != nil {
+		return err
+	}
+	return record.write()
+}
+
+// bake does the work of Bake, but leaves the record of generated variables to
+// be written once the caller is done with the bake.
+func (r *Recipe) bake(dest string, d *RecipeData, o *BakeOptions) (*varsRecord, error) {
+	if o == nil {
+		o = &BakeOptions{}
+	}
+	out := o.Output
+	dest = path.Clean(dest)
+	record := o.VarsRecord
+	if out == nil {
+		out = preppiFS
+		if record == "" {
+			record = dest + VarsRecordExt
+		}
+	}
+	if err := checkBakeDest(out, dest); err != nil {
+		return nil, err
+	}
+	var given map[string]string
+	if d != nil {
+		given = d.Vars
+	}
+	manifest, err := r.newManifest(given, o)
+	if err != nil {
+		return nil, err
+	}
+	d, pending, err := r.generateVars(d, record, o.VarsKey)
+	if err != nil {
+		return nil, err
+	}
+	if d, err = r.resolveVars(d); err != nil {
+		return nil, err
+	}
+	d.sandbox = o.Sandbox
+	staging := bakeSibling(dest, "staging")
+	// A previous bake may have been interrupted.
+	if err := out.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := r.bakeInto(out, staging, d, o); err != nil {
+		out.RemoveAll(staging)
+		return nil, err
+	}
+	if err := writeManifest(out, staging, manifest); err != nil {
+		out.RemoveAll(staging)
+		return nil, err
+	}
+	if err := replaceDir(out, staging, dest); err != nil {
+		return nil, err
+	}
+	return pending, nil
 }
 
-func (r *Recipe) Bake(dest string, d *RecipeData) error {
+func (r *Recipe) bakeInto(out Fs, dest string, d *RecipeData, o *BakeOptions) error {
 	m := make([]*Mapping, 0)
-	if err := r.checkVars(d); err != nil {
+	if err := out.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	// Written files by lower-cased name, since boot partitions are FAT and
+	// case-insensitive.
+	written := map[string]string{"preppi.conf": "preppi.conf", manifestFile: manifestFile}
+	partials, err := r.partials()
+	if err != nil {
 		return err
 	}
 	for _, i := range r.Ingredients {
-		if err := i.Prepare(r.root, dest, d); err != nil {
-			// Stop at the first error
+		instances, err := i.instances(r.sourceRoot(i), d)
+		if err != nil {
 			return err
 		}
-		m = append(m, i.Mapping())
+		for _, b := range instances {
+			content, err := i.render(r.sourceRoot(i), partials, b.data)
+			if err != nil {
+				// Stop at the first error
+				return err
+			}
+			// Empty content can't be told apart from no content, so it always
+			// gets a file of its own.
+			if len(content) > 0 && len(content) <= o.InlineLimit {
+				m = append(m, b.inlineMapping(content))
+				continue
+			}
+			name := path.Clean(b.Source)
+			if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+				return fmt.Errorf("ingredient %q is outside the recipe", b.Source)
+			}
+			key := strings.ToLower(name)
+			if other, ok := written[key]; ok {
+				return fmt.Errorf("ingredient %q collides with %q", b.Source, other)
+			}
+			written[key] = b.Source
+			if err := b.write(out, dest, content); err != nil {
+				return err
+			}
+			mapping := b.Mapping()
+			if o.Prefix != "" {
+				mapping.Source = path.Join(o.Prefix, name)
+			}
+			m = append(m, mapping)
+		}
+	}
+	return mapperToFs(out, path.Join(dest, "preppi.conf"), &Mapper{Mappings: m})
+}
+
+// sourceRoot returns the directory holding the source of i, one of r's
+// ingredients.
+func (r *Recipe) sourceRoot(i *Ingredient) string {
+	if i.root != "" {
+		return i.root
+	}
+	return r.root
+}
+
+// bakeSibling returns a hidden name beside dest.
+func bakeSibling(dest, suffix string) string {
+	return path.Join(path.Dir(dest), fmt.Sprintf(".%v.preppi-%v", path.Base(dest), suffix))
+}
+
+// checkBakeDest makes sure that replacing dest can't destroy anything but an
+// earlier bake.
+func checkBakeDest(fs Fs, dest string) error {
+	if base := path.Base(dest); base == "/" || base == "." || base == ".." {
+		return fmt.Errorf("refusing to bake into %q, which would be replaced", dest)
+	}
+	info, err := fs.Stat(dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%q exists and is not a directory", dest)
 	}
-	if err := MapperToFile(path.Join(dest, "preppi.conf"), &Mapper{Mappings: m}); err != nil {
+	if empty, err := afero.IsEmpty(fs, dest); err != nil || empty {
 		return err
 	}
+	if baked, err := afero.Exists(fs, path.Join(dest, "preppi.conf")); err != nil || !baked {
+		return fmt.Errorf("refusing to replace %q, which doesn't hold a baked recipe", dest)
+	}
 	return nil
 }
 
-func (r *Recipe) checkVars(d *RecipeData) error {
-	missing := make([]string, 0)
-	for _, v := range r.vars() {
-		if _, ok := d.Vars[v]; !ok {
-			missing = append(missing, v)
+// replaceDir replaces dest with src, keeping dest if that fails.
+func replaceDir(fs Fs, src, dest string) error {
+	old := bakeSibling(dest, "old")
+	if err := fs.RemoveAll(old); err != nil {
+		return err
+	}
+	if err := fs.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	_, err := fs.Stat(dest)
+	existed := err == nil
+	if existed {
+		if err := fs.Rename(dest, old); err != nil {
+			fs.RemoveAll(src)
+			return err
 		}
 	}
-	if len(missing) > 0 {
-		return fmt.Errorf("recipe %q expected the following missing variables: %+v", r.Name, missing)
+	if err := fs.Rename(src, dest); err != nil {
+		if existed {
+			fs.Rename(old, dest)
+		}
+		fs.RemoveAll(src)
+		return err
 	}
-	return nil
+	return fs.RemoveAll(old)
 }
 
 // vars accumulates the variables expected for each ingredient.
 func (r *Recipe) vars() []string {
 	varMap := make(map[string]bool)
 	for _, i := range r.Ingredients {
-		for _, v := range i.Vars {
+		for _, v := range i.vars() {
 			varMap[v] = true
 		}
 	}
@@ -169,17 +541,46 @@ func (r *Recipe) vars() []string {
 	return vars
 }
 
-// RecipeFromFile reads a config and returns a Mapper
-func RecipeFromFile(name string) (*Recipe, error) {
-	data, err := afero.ReadFile(preppiFS, name)
-	if err != nil {
-		return nil, fmt.Errorf("failed reading recipe %q: %v", name, err)
+// ConditionalVars returns the variables which only ingredients with When
+// conditions need, so which are only required for some values of the others.
+func (r *Recipe) ConditionalVars() map[string]bool {
+	always := make(map[string]bool)
+	conditional := make(map[string]bool)
+	for _, i := range r.Ingredients {
+		for _, v := range i.vars() {
+			if i.When == "" {
+				always[v] = true
+			} else {
+				conditional[v] = true
+			}
+		}
 	}
-	r := &Recipe{
-		root: path.Dir(name),
+	for v := range always {
+		delete(conditional, v)
+	}
+	return conditional
+}
+
+// unneededVars returns the variables which are only needed by ingredients
+// which d excludes by their When conditions.
+func (r *Recipe) unneededVars(d *RecipeData) (map[string]bool, error) {
+	needed := make(map[string]bool)
+	unneeded := make(map[string]bool)
+	for _, i := range r.Ingredients {
+		ok, err := i.included(r.sourceRoot(i), d)
+		if err != nil {
+			return nil, fmt.Errorf("ingredient %q: %v", i.Source, err)
+		}
+		for _, v := range i.vars() {
+			if ok {
+				needed[v] = true
+			} else {
+				unneeded[v] = true
+			}
+		}
 	}
-	if err := json.Unmarshal(data, r); err != nil {
-		return nil, fmt.Errorf("failed reading recipe %q: %v", name, err)
+	for v := range needed {
+		delete(unneeded, v)
 	}
-	return r, nil
+	return unneeded, nil
 }
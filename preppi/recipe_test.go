@@ -21,7 +21,10 @@ package preppi
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/spf13/afero"
 )
 
 func TestRecipeVars(t *testing.T) {
@@ -56,7 +59,7 @@ func TestIngredientCompileTemplate(t *testing.T) {
 		ingredient := &Ingredient{
 			Source: "/some/file/path",
 		}
-		_, err := ingredient.compileTemplate(tt.tmplString)
+		_, err := ingredient.compileTemplate("", tt.tmplString, nil)
 		if err != nil && !tt.wantErr {
 			t.Errorf("wanted no error, got: %v", err)
 		} else if err == nil && tt.wantErr {
@@ -64,3 +67,254 @@ func TestIngredientCompileTemplate(t *testing.T) {
 		}
 	}
 }
+
+func TestRecipeBakeInline(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/etc-motd":     &testFile{[]byte("Welcome to {{.Vars.Hostname}}, a very fine host.\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Vars: []string{"Hostname"}},
+			&Ingredient{Source: "etc-motd", Destination: "/etc/motd", Vars: []string{"Hostname"}},
+		},
+		root: "/recipes/test",
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+	if err := r.Bake("/out", d, &BakeOptions{InlineLimit: 16}); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+
+	m, err := MapperFromConfig("/out/preppi.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Mappings) != 2 {
+		t.Fatalf("wanted 2 mappings, got %d", len(m.Mappings))
+	}
+	if got := m.Mappings[0]; got.Source != "" || got.Content != "pi\n" {
+		t.Errorf("wanted inlined content %q, got source %q content %q", "pi\n", got.Source, got.Content)
+	}
+	if exists, _ := afero.Exists(preppiFS, "/out/etc-hostname"); exists {
+		t.Error("wanted no file for inlined ingredient")
+	}
+	if got := m.Mappings[1]; got.Source != "etc-motd" || got.Content != "" {
+		t.Errorf("wanted source %q without content, got source %q content %q", "etc-motd", got.Source, got.Content)
+	}
+	if exists, _ := afero.Exists(preppiFS, "/out/etc-motd"); !exists {
+		t.Error("wanted a file for ingredient over the inline limit")
+	}
+}
+
+func TestRecipeBakeReplacesOutput(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname":    &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/boot/config.txt": &testFile{[]byte("dtparam=audio=on\n"), 0644, 0755, 0, 0},
+		"/recipes/test/broken":          &testFile{[]byte("{{.Vars.Hostname\n"), 0644, 0755, 0, 0},
+		"/out/preppi.conf":              &testFile{[]byte(`{"map": []}`), 0644, 0755, 0, 0},
+		"/out/stale":                    &testFile{[]byte("from a previous bake"), 0644, 0755, 0, 0},
+		"/precious/file":                &testFile{[]byte("not a bake"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+	recipe := func(sources ...string) *Recipe {
+		r := &Recipe{Name: "Test Recipe", root: "/recipes/test"}
+		for _, s := range sources {
+			r.Ingredients = append(r.Ingredients, &Ingredient{Source: s, Destination: "/" + s, Vars: []string{"Hostname"}})
+		}
+		return r
+	}
+
+	// A failed bake leaves the earlier one alone.
+	if err := recipe("etc-hostname", "broken").Bake("/out", d, nil); err == nil {
+		t.Error("wanted error baking broken template")
+	}
+	if exists, _ := afero.Exists(preppiFS, "/out/stale"); !exists {
+		t.Error("wanted output untouched after failed bake")
+	}
+	if err := recipe("etc-hostname", "ETC-HOSTNAME").Bake("/out", d, nil); err == nil {
+		t.Error("wanted error for colliding ingredients")
+	}
+	if err := recipe("../etc-hostname").Bake("/out", d, nil); err == nil {
+		t.Error("wanted error for ingredient outside the recipe")
+	}
+
+	if err := recipe("etc-hostname", "boot/config.txt").Bake("/out", d, nil); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if got, err := afero.ReadFile(preppiFS, "/out/boot/config.txt"); err != nil || string(got) != "dtparam=audio=on\n" {
+		t.Errorf("wanted nested ingredient written, got %q, %v", got, err)
+	}
+	if exists, _ := afero.Exists(preppiFS, "/out/stale"); exists {
+		t.Error("wanted stale file from previous bake removed")
+	}
+	infos, err := afero.ReadDir(preppiFS, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	if want := []string{"out", "precious", "recipes"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("wanted no staging left behind, got %v", names)
+	}
+
+	if err := recipe("etc-hostname").Bake("/precious", d, nil); err == nil {
+		t.Error("wanted error replacing directory which doesn't hold a bake")
+	}
+	if exists, _ := afero.Exists(preppiFS, "/precious/file"); !exists {
+		t.Error("wanted directory which doesn't hold a bake untouched")
+	}
+}
+
+func TestRecipeBakePrefix(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Mode: 0644, DirMode: 0755, Vars: []string{"Hostname"}},
+		},
+		root: "/recipes/test",
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+
+	for prefix, want := range map[string]string{
+		"":             "etc-hostname",
+		"/boot/preppi": "/boot/preppi/etc-hostname",
+	} {
+		if err := r.Bake("/boot/preppi", d, &BakeOptions{Prefix: prefix}); err != nil {
+			t.Fatalf("prefix %q: wanted no error, got: %v", prefix, err)
+		}
+		m, err := MapperFromConfig("/boot/preppi/preppi.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := m.Mappings[0].Source; got != want {
+			t.Errorf("prefix %q: wanted source %q, got %q", prefix, want, got)
+		}
+		// Either way, the baked config must work where it was baked.
+		if err := preppiFS.RemoveAll("/etc"); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := m.Apply(d); err != nil {
+			t.Fatalf("prefix %q: wanted baked config to apply, got: %v", prefix, err)
+		}
+		if got, _ := afero.ReadFile(preppiFS, "/etc/hostname"); string(got) != "pi\n" {
+			t.Errorf("prefix %q: wanted %q, got %q", prefix, "pi\n", got)
+		}
+	}
+}
+
+func TestRecipeBakeMissingKey(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostnme}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Vars: []string{"Hostname"}},
+		},
+		root: "/recipes/test",
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+	if err := r.Bake("/out", d, nil); err == nil {
+		t.Error("wanted error for template using a missing variable")
+	}
+}
+
+func TestRecipeBakeWhenForeach(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	files := map[string]*testFile{
+		"/recipes/test/etc-hostname": &testFile{[]byte("{{.Vars.Hostname}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/wpa":          &testFile{[]byte("ssid={{wpaquote .Vars.SSID}}\n"), 0644, 0755, 0, 0},
+		"/recipes/test/network":      &testFile{[]byte("[Match]\nName={{.Item}}\n"), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Source: "etc-hostname", Destination: "/etc/hostname", Vars: []string{"Hostname"}},
+			&Ingredient{Source: "wpa", Destination: "/etc/wpa_supplicant/wpa_supplicant.conf", When: ".Vars.SSID", Vars: []string{"SSID"}},
+			&Ingredient{Source: "network", Output: "network-{{.Item}}", Destination: "/etc/systemd/network/{{.Item}}.network", Foreach: "Interfaces"},
+		},
+		root: "/recipes/test",
+	}
+	if got, want := r.vars(), []string{"Hostname", "Interfaces", "SSID"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted vars %v, got %v", want, got)
+	}
+	if got, want := r.ConditionalVars(), map[string]bool{"SSID": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted conditional vars %v, got %v", want, got)
+	}
+
+	// Without SSID, the wpa_supplicant ingredient is left out, and SSID isn't
+	// needed.
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi", "Interfaces": "eth0,wlan0"}}
+	if err := r.Bake("/out", d, nil); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	m, err := MapperFromConfig("/out/preppi.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, mapping := range m.Mappings {
+		got = append(got, mapping.Source+" "+mapping.Destination)
+	}
+	want := []string{
+		"etc-hostname /etc/hostname",
+		"network-eth0 /etc/systemd/network/eth0.network",
+		"network-wlan0 /etc/systemd/network/wlan0.network",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted mappings %v, got %v", want, got)
+	}
+	if got, _ := afero.ReadFile(preppiFS, "/out/network-wlan0"); string(got) != "[Match]\nName=wlan0\n" {
+		t.Errorf("wanted repeated ingredient rendered with its item, got %q", got)
+	}
+
+	d.Vars["SSID"] = "home"
+	if err := r.Bake("/out", d, nil); err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	if got, _ := afero.ReadFile(preppiFS, "/out/wpa"); string(got) != "ssid=\"home\"\n" {
+		t.Errorf("wanted conditional ingredient baked, got %q", got)
+	}
+
+	// The list of a repeated ingredient is needed.
+	delete(d.Vars, "Interfaces")
+	if err := r.Bake("/out", d, nil); err == nil || !strings.Contains(err.Error(), "missing: Interfaces") {
+		t.Errorf("wanted error for missing list, got: %v", err)
+	}
+	r.Ingredients[2].Output = ""
+	d.Vars["Interfaces"] = "eth0"
+	if err := r.Bake("/out", d, nil); err == nil {
+		t.Error("wanted error for repeated ingredient without output")
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package preppi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Sandbox limits what the templates of an untrusted recipe can do while it's
+// baked. Functions reading files are disabled, and templates exceeding a limit
+// fail with an error naming the ingredient. Zero limits are unlimited, except
+// that {{template}} calls never nest deeper than sandboxMaxDepth.
+type Sandbox struct {
+	// MaxOutput is the most bytes an ingredient's template may render.
+	MaxOutput int
+	// Timeout is the longest an ingredient's template may run.
+	Timeout time.Duration
+	// MaxDepth is the deepest which {{template}} calls may nest.
+	MaxDepth int
+	// MaxIterations is the most times which an ingredient's template may go
+	// round its {{range}} loops, all told.
+	MaxIterations int
+}
+
+// DefaultSandbox returns a sandbox whose limits leave room for any reasonable
+// recipe.
+func DefaultSandbox() *Sandbox {
+	return &Sandbox{
+		MaxOutput:     1 << 20,
+		Timeout:       10 * time.Second,
+		MaxDepth:      32,
+		MaxIterations: 1 << 20,
+	}
+}
+
+// sandboxMaxDepth is the deepest which {{template}} calls may nest in any
+// sandbox. Each is a new execution, escaping text/template's own limit, so
+// unbounded recursion would otherwise exhaust the stack.
+const sandboxMaxDepth = 10000
+
+// fileFuncs are the template functions which read files.
+var fileFuncs = []string{"readFile"}
+
+const (
+	// sandboxTemplateFunc is the function which stands in for {{template}}
+	// calls in a sandbox.
+	sandboxTemplateFunc = "sandboxTemplate"
+	// sandboxIterateFunc is the function which a sandbox calls at the start of
+	// every iteration of a {{range}} loop.
+	sandboxIterateFunc = "sandboxIterate"
+)
+
+// sandboxedExec is a single execution of a template in a sandbox.
+type sandboxedExec struct {
+	*Sandbox
+	ctx  context.Context
+	what string
+	tmpl *template.Template
+	// written counts the bytes rendered so far, depth the {{template}} calls
+	// being executed, iterations the loops gone round, and err is the first
+	// limit exceeded.
+	written    int
+	depth      int
+	iterations int
+	err        error
+}
+
+// sandboxed returns the sandbox in which to execute templates with r.
+func (r *RecipeData) sandboxed() *Sandbox {
+	if r == nil {
+		return nil
+	}
+	return r.sandbox
+}
+
+// execute executes t with data, within the sandbox's limits, returning the
+// output. what names the template for errors, eg `ingredient "etc-hosts"`. t
+// is altered to keep it in the sandbox. A nil sandbox executes t as it is.
+//
+// A template running past the timeout is abandoned, and stops at its next
+// output, {{template}} call or iteration of a loop.
+func (s *Sandbox) execute(what string, t *template.Template, data interface{}) ([]byte, error) {
+	if s == nil {
+		var b bytes.Buffer
+		if err := t.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if s.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+	}
+	defer cancel()
+	x := &sandboxedExec{Sandbox: s, ctx: ctx, what: what, tmpl: t}
+	x.restrict()
+
+	var b bytes.Buffer
+	done := make(chan error, 1)
+	go func() {
+		done <- t.Execute(&sandboxedWriter{x, &b}, data)
+	}()
+	select {
+	case err := <-done:
+		if x.err != nil {
+			return nil, x.err
+		}
+		if err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%v ran longer than the sandbox's limit of %v", what, s.Timeout)
+	}
+}
+
+// fail records err as the limit which the execution exceeded, unless it
+// already exceeded one, and returns it.
+func (x *sandboxedExec) fail(format string, args ...interface{}) error {
+	if x.err == nil {
+		x.err = fmt.Errorf("%v %v", x.what, fmt.Sprintf(format, args...))
+	}
+	return x.err
+}
+
+// restrict disables the functions of x.tmpl which read files, replaces its
+// {{template}} calls with calls of x.template, and has its loops call
+// x.iterate.
+func (x *sandboxedExec) restrict() {
+	funcs := template.FuncMap{
+		sandboxTemplateFunc: x.template,
+		sandboxIterateFunc:  x.iterate,
+	}
+	for _, name := range fileFuncs {
+		name := name
+		funcs[name] = func(...interface{}) (string, error) {
+			return "", x.fail("can't use %v, which is disabled in the sandbox", name)
+		}
+	}
+	x.tmpl.Funcs(funcs)
+	for _, t := range x.tmpl.Templates() {
+		if t.Tree != nil && t.Root != nil {
+			sandboxNodes(t.Root)
+		}
+	}
+}
+
+// template executes the named template with data, as {{template}} would, for
+// a sandbox, which limits how deeply such calls nest.
+func (x *sandboxedExec) template(name string, data interface{}) (string, error) {
+	if x.ctx.Err() != nil {
+		return "", x.ctx.Err()
+	}
+	limit := x.MaxDepth
+	if limit <= 0 || limit > sandboxMaxDepth {
+		limit = sandboxMaxDepth
+	}
+	if x.depth >= limit {
+		return "", x.fail("nests template calls deeper than the sandbox's limit of %d", limit)
+	}
+	t := x.tmpl.Lookup(name)
+	if t == nil {
+		return "", fmt.Errorf("no such template %q", name)
+	}
+	x.depth++
+	defer func() { x.depth-- }()
+	var b bytes.Buffer
+	if err := t.Execute(&sandboxedWriter{x, &b}, data); err != nil {
+		// Passing the limit up as it is keeps text/template from wrapping it
+		// again at every level.
+		if x.err != nil {
+			return "", x.err
+		}
+		return "", err
+	}
+	// The caller writes the output again, counting it again.
+	x.written -= b.Len()
+	return b.String(), nil
+}
+
+// iterate counts an iteration of a loop, failing once there have been too
+// many, or the execution times out.
+func (x *sandboxedExec) iterate() (string, error) {
+	if x.ctx.Err() != nil {
+		return "", x.ctx.Err()
+	}
+	x.iterations++
+	if x.MaxIterations > 0 && x.iterations > x.MaxIterations {
+		return "", x.fail("loops more than the sandbox's limit of %d times", x.MaxIterations)
+	}
+	return "", nil
+}
+
+// sandboxedWriter counts the output of a sandboxed execution, failing once it
+// exceeds the limit, or the execution times out.
+type sandboxedWriter struct {
+	x *sandboxedExec
+	w io.Writer
+}
+
+func (w *sandboxedWriter) Write(p []byte) (int, error) {
+	x := w.x
+	if x.ctx.Err() != nil {
+		return 0, x.ctx.Err()
+	}
+	if x.MaxOutput > 0 && x.written+len(p) > x.MaxOutput {
+		return 0, x.fail("renders more than the sandbox's limit of %d bytes", x.MaxOutput)
+	}
+	x.written += len(p)
+	return w.w.Write(p)
+}
+
+// sandboxNodes replaces every {{template "name" pipeline}} under n with
+// {{sandboxTemplate "name" pipeline}}, and starts the body of every {{range}}
+// with {{sandboxIterate}}.
+func sandboxNodes(n parse.Node) {
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for k, c := range n.Nodes {
+			if t, ok := c.(*parse.TemplateNode); ok {
+				n.Nodes[k] = sandboxCall(t.Pos, t.Line, sandboxTemplateFunc,
+					&parse.StringNode{NodeType: parse.NodeString, Pos: t.Pos, Quoted: fmt.Sprintf("%q", t.Name), Text: t.Name},
+					templateData(t))
+				continue
+			}
+			sandboxNodes(c)
+		}
+	case *parse.IfNode:
+		sandboxNodes(n.List)
+		sandboxNodes(n.ElseList)
+	case *parse.RangeNode:
+		sandboxNodes(n.List)
+		sandboxNodes(n.ElseList)
+		if n.List == nil {
+			n.List = &parse.ListNode{NodeType: parse.NodeList, Pos: n.Pos}
+		}
+		n.List.Nodes = append([]parse.Node{sandboxCall(n.Pos, n.Line, sandboxIterateFunc)}, n.List.Nodes...)
+	case *parse.WithNode:
+		sandboxNodes(n.List)
+		sandboxNodes(n.ElseList)
+	}
+}
+
+// templateData returns the node giving the data of the template call t.
+func templateData(t *parse.TemplateNode) parse.Node {
+	if t.Pipe == nil {
+		return &parse.NilNode{NodeType: parse.NodeNil, Pos: t.Pos}
+	}
+	return t.Pipe
+}
+
+// sandboxCall returns an action calling the function fn with args.
+func sandboxCall(pos parse.Pos, line int, fn string, args ...parse.Node) parse.Node {
+	cmd := &parse.CommandNode{
+		NodeType: parse.NodeCommand,
+		Pos:      pos,
+		Args:     append([]parse.Node{parse.NewIdentifier(fn).SetPos(pos)}, args...),
+	}
+	return &parse.ActionNode{
+		NodeType: parse.NodeAction,
+		Pos:      pos,
+		Line:     line,
+		Pipe:     &parse.PipeNode{NodeType: parse.NodePipe, Pos: pos, Line: line, Cmds: []*parse.CommandNode{cmd}},
+	}
+}
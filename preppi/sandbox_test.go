@@ -0,0 +1,121 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+package preppi
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestRecipeBakeSandbox(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	// Each of halve's calls makes two more, with the list's tail, so a list
+	// of N makes 2^N calls, N deep.
+	halve := `{{define "halve"}}{{if .}}{{template "halve" (slice . 1)}}{{template "halve" (slice . 1)}}{{end}}{{end}}`
+	// spin goes round a loop a trillion times, rendering nothing.
+	spin := `{{range split "" (printf "%0999999d" 0)}}{{range split "" (printf "%0999999d" 0)}}{{end}}{{end}}`
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/recipes/test/partials/header.tmpl": &testFile{[]byte("# header\n"), 0644, 0755, 0, 0},
+		"/recipes/test/motd":                 &testFile{[]byte(`{{template "header" .}}{{.Vars.Hostname}}` + "\n"), 0644, 0755, 0, 0},
+		"/recipes/test/count":                &testFile{[]byte(`{{define "r"}}{{if .}}x{{template "r" (slice . 1)}}{{end}}{{end}}{{template "r" (split "," "a,b,c")}}`), 0644, 0755, 0, 0},
+		"/recipes/test/forever":              &testFile{[]byte(`{{define "r"}}{{template "r" .}}{{end}}{{template "r" .}}`), 0644, 0755, 0, 0},
+		"/recipes/test/slow":                 &testFile{[]byte(halve + `{{template "halve" (split "," "` + strings.Repeat("a,", 40) + `a")}}`), 0644, 0755, 0, 0},
+		"/recipes/test/big":                  &testFile{[]byte(`{{range split "," "` + strings.Repeat("a,", 99) + `a"}}{{template "header"}}{{end}}`), 0644, 0755, 0, 0},
+		"/recipes/test/spin":                 &testFile{[]byte(spin), 0644, 0755, 0, 0},
+		"/recipes/test/file":                 &testFile{[]byte(`{{readFile "motd"}}`), 0644, 0755, 0, 0},
+	})
+	recipe := func(source string) *Recipe {
+		return &Recipe{
+			Name: "Test Recipe",
+			Ingredients: []*Ingredient{
+				&Ingredient{Source: source, Destination: "/etc/" + source},
+			},
+			root: "/recipes/test",
+		}
+	}
+	d := &RecipeData{Vars: map[string]string{"Hostname": "pi"}}
+
+	// A loop rendering nothing stops once it times out.
+	before := runtime.NumGoroutine()
+	err := recipe("spin").Bake("/out", d, &BakeOptions{Sandbox: &Sandbox{Timeout: 200 * time.Millisecond}})
+	if want := `ingredient "spin" ran longer than the sandbox's limit of 200ms`; err == nil || err.Error() != want {
+		t.Errorf("wanted error %q, got: %v", want, err)
+	}
+	for deadline := time.Now().Add(2 * time.Second); runtime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("wanted the timed out template stopped, got %d goroutines, up from %d", runtime.NumGoroutine(), before)
+		}
+	}
+
+	sandbox := &Sandbox{MaxOutput: 100, Timeout: 100 * time.Millisecond, MaxDepth: 4, MaxIterations: 1000}
+	for _, tc := range []struct {
+		source  string
+		want    string
+		wantErr string
+	}{
+		{source: "motd", want: "# header\npi\n"},
+		{source: "count", want: "xxx"},
+		{source: "forever", wantErr: `ingredient "forever" nests template calls deeper than the sandbox's limit of 4`},
+		{source: "big", wantErr: `ingredient "big" renders more than the sandbox's limit of 100 bytes`},
+		{source: "spin", wantErr: `ingredient "spin" loops more than the sandbox's limit of 1000 times`},
+		{source: "file", wantErr: `ingredient "file" can't use readFile, which is disabled in the sandbox`},
+	} {
+		err := recipe(tc.source).Bake("/out", d, &BakeOptions{Sandbox: sandbox})
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("%v: wanted error %q, got: %v", tc.source, tc.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: wanted no error, got: %v", tc.source, err)
+			continue
+		}
+		got, err := afero.ReadFile(preppiFS, "/out/"+tc.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tc.want {
+			t.Errorf("%v: wanted %q, got %q", tc.source, tc.want, got)
+		}
+	}
+
+	sandbox = &Sandbox{Timeout: 50 * time.Millisecond}
+	err = recipe("slow").Bake("/out", d, &BakeOptions{Sandbox: sandbox})
+	if want := `ingredient "slow" ran longer than the sandbox's limit of 50ms`; err == nil || err.Error() != want {
+		t.Errorf("wanted error %q, got: %v", want, err)
+	}
+
+	err = recipe("forever").Bake("/out", d, &BakeOptions{Sandbox: &Sandbox{}})
+	if err == nil || !strings.Contains(err.Error(), "deeper than the sandbox's limit") {
+		t.Errorf("wanted unbounded recursion stopped, got: %v", err)
+	}
+	// Outside a sandbox, only the recursion fails.
+	if err := recipe("file").Bake("/out", d, nil); err != nil {
+		t.Errorf("wanted no error outside the sandbox, got: %v", err)
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build ignore
+// +build ignore
+
+// mkfat writes the FAT16 and FAT32 images in this directory, which FatFs is
+// tested against:
+//
+//	go run mkfat.go
+//
+// It shares no code with FatFs. The boot sector, reserved sectors, FAT sizes,
+// alignment, FSInfo, backup boot sector and volume label are laid out the way
+// dosfstools' mkfs.fat -n BOOT lays them out, for a 16 MiB image with -F 16
+// and a 40 MiB one with -F 32 -s 1. The files are then added the way mtools'
+// mcopy and mmd add them: long names with numbered short names, directories
+// growing a cluster at a time between the clusters of their files, and holes
+// left by deleted files.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"unicode/utf16"
+)
+
+// bootCode is mkfs.fat's boot code, which prints the message following it.
+// Byte 3 is the low byte of the message's address.
+var bootCode = []byte{
+	0x0e, 0x1f, 0xbe, 0x00, 0x7c, 0xac, 0x22, 0xc0, 0x74, 0x0b, 0x56, 0xb4, 0x0e, 0xbb, 0x07, 0x00,
+	0xcd, 0x10, 0x5e, 0xeb, 0xf0, 0x32, 0xe4, 0xcd, 0x16, 0xcd, 0x19, 0xeb, 0xfe,
+}
+
+const bootMessage = "This is not a bootable disk.  Please insert a bootable floppy and\r\n" +
+	"press any key to try again ... \r\n"
+
+const (
+	sectorSize = 512
+	// stamp is 2017-09-25 12:30:10, as DOS date and time.
+	stampDate = (2017-1980)<<9 | 9<<5 | 25
+	stampTime = 12<<11 | 30<<5 | 10/2
+	volumeID  = 0x5052ebb1
+)
+
+// image is a FAT file system being built.
+type image struct {
+	fat32       bool
+	data        []byte
+	spc         int
+	reserved    int
+	fatSectors  int
+	rootEntries int
+	clusters    int
+	next        uint32
+	fat         []uint32
+}
+
+func (im *image) dataStart() int {
+	return (im.reserved + 2*im.fatSectors + im.rootEntries*32/sectorSize) * sectorSize
+}
+
+func (im *image) clusterSize() int {
+	return im.spc * sectorSize
+}
+
+func (im *image) clusterOffset(c uint32) int {
+	return im.dataStart() + int(c-2)*im.clusterSize()
+}
+
+// alloc takes the next free cluster, ending the chain there.
+func (im *image) alloc() uint32 {
+	c := im.next
+	im.next++
+	im.fat[c] = 0x0ffffff8
+	return c
+}
+
+// chain allocates clusters for size bytes, linked in the order given. Every
+// other cluster is skipped if sparse, leaving free holes.
+func (im *image) chain(size int, sparse bool) []uint32 {
+	var cs []uint32
+	for n := 0; n < size; n += im.clusterSize() {
+		if sparse && len(cs) > 0 {
+			im.next++
+		}
+		c := im.alloc()
+		if len(cs) > 0 {
+			im.fat[cs[len(cs)-1]] = c
+		}
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+// write writes b across the clusters cs.
+func (im *image) write(cs []uint32, b []byte) {
+	for i, c := range cs {
+		end := (i + 1) * im.clusterSize()
+		if end > len(b) {
+			end = len(b)
+		}
+		copy(im.data[im.clusterOffset(c):], b[i*im.clusterSize():end])
+	}
+}
+
+// dir is a directory being built. The FAT16 root has no clusters.
+type dir struct {
+	im       *image
+	entries  []byte
+	clusters []uint32
+}
+
+func shortSum(short string) byte {
+	var sum byte
+	for i := 0; i < 11; i++ {
+		sum = (sum&1)<<7 + sum>>1 + short[i]
+	}
+	return sum
+}
+
+func entry(short string, attr, caseFlags byte, cluster uint32, size int) []byte {
+	e := make([]byte, 32)
+	copy(e, short)
+	e[11], e[12] = attr, caseFlags
+	binary.LittleEndian.PutUint16(e[14:], stampTime)
+	binary.LittleEndian.PutUint16(e[16:], stampDate)
+	binary.LittleEndian.PutUint16(e[18:], stampDate)
+	binary.LittleEndian.PutUint16(e[20:], uint16(cluster>>16))
+	binary.LittleEndian.PutUint16(e[22:], stampTime)
+	binary.LittleEndian.PutUint16(e[24:], stampDate)
+	binary.LittleEndian.PutUint16(e[26:], uint16(cluster))
+	binary.LittleEndian.PutUint32(e[28:], uint32(size))
+	return e
+}
+
+// longEntries are the long name entries for name, last part first.
+func longEntries(name, short string) []byte {
+	u := utf16.Encode([]rune(name))
+	n := (len(u) + 12) / 13
+	padded := make([]uint16, n*13)
+	for i := range padded {
+		switch {
+		case i < len(u):
+			padded[i] = u[i]
+		case i == len(u):
+			padded[i] = 0
+		default:
+			padded[i] = 0xffff
+		}
+	}
+	var b []byte
+	for ord := n; ord >= 1; ord-- {
+		e := make([]byte, 32)
+		e[0] = byte(ord)
+		if ord == n {
+			e[0] |= 0x40
+		}
+		e[11], e[13] = 0x0f, shortSum(short)
+		chars := padded[(ord-1)*13:]
+		for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(e[off:], chars[j])
+		}
+		b = append(b, e...)
+	}
+	return b
+}
+
+// add adds entries to d, growing it first if it's full.
+func (d *dir) add(b []byte) {
+	d.entries = append(d.entries, b...)
+	if d.clusters == nil {
+		return
+	}
+	for len(d.entries) > len(d.clusters)*d.im.clusterSize() {
+		c := d.im.alloc()
+		d.im.fat[d.clusters[len(d.clusters)-1]] = c
+		d.clusters = append(d.clusters, c)
+	}
+}
+
+// file adds a file named name with the short name short. Names which aren't
+// 8.3 get long name entries, as mtools writes them.
+func (d *dir) file(name, short string, caseFlags byte, content []byte, sparse bool) {
+	var cluster uint32
+	if len(content) > 0 {
+		cs := d.im.chain(len(content), sparse)
+		d.im.write(cs, content)
+		cluster = cs[0]
+	}
+	if caseFlags == 0 && name != strings.TrimSpace(short) {
+		d.add(longEntries(name, short))
+	}
+	d.add(entry(short, 0x20, caseFlags, cluster, len(content)))
+}
+
+// mkdir adds a subdirectory with . and .. entries.
+func (d *dir) mkdir(name, short string) *dir {
+	sub := &dir{im: d.im, clusters: []uint32{d.im.alloc()}}
+	parent := uint32(0)
+	if d.clusters != nil && !(d.im.fat32 && d.clusters[0] == 2) {
+		parent = d.clusters[0]
+	}
+	sub.add(entry(".          ", 0x10, 0, sub.clusters[0], 0))
+	sub.add(entry("..         ", 0x10, 0, parent, 0))
+	d.add(longEntries(name, short))
+	d.add(entry(short, 0x10, 0, sub.clusters[0], 0))
+	return sub
+}
+
+func (d *dir) flush() {
+	if d.clusters == nil {
+		copy(d.im.data[(d.im.reserved+2*d.im.fatSectors)*sectorSize:], d.entries)
+		return
+	}
+	d.im.write(d.clusters, d.entries)
+}
+
+func newImage(fat32 bool) (*image, *dir) {
+	im := &image{fat32: fat32, next: 2}
+	sectors := 16 << 11
+	if fat32 {
+		// mkfs.fat -F 32 -s 1 on 40 MiB.
+		sectors = 40 << 11
+		im.spc, im.reserved, im.fatSectors = 1, 32, 630
+	} else {
+		// mkfs.fat -F 16 on 16 MiB, with the reserved sectors padded so that
+		// the data is aligned to clusters.
+		im.spc, im.reserved, im.fatSectors, im.rootEntries = 4, 4, 32, 512
+	}
+	im.data = make([]byte, sectors*sectorSize)
+	im.clusters = (sectors*sectorSize - im.dataStart()) / im.clusterSize()
+	im.fat = make([]uint32, im.clusters+2)
+	im.fat[0], im.fat[1] = 0x0fffff00|0xf8, 0x0fffffff
+
+	bs := im.data[:sectorSize]
+	binary.LittleEndian.PutUint16(bs[11:], sectorSize)
+	bs[13] = byte(im.spc)
+	binary.LittleEndian.PutUint16(bs[14:], uint16(im.reserved))
+	bs[16] = 2
+	binary.LittleEndian.PutUint16(bs[17:], uint16(im.rootEntries))
+	if sectors < 0x10000 {
+		binary.LittleEndian.PutUint16(bs[19:], uint16(sectors))
+	} else {
+		binary.LittleEndian.PutUint32(bs[32:], uint32(sectors))
+	}
+	bs[21] = 0xf8
+	binary.LittleEndian.PutUint16(bs[24:], 32)
+	binary.LittleEndian.PutUint16(bs[26:], 64)
+	copy(bs[3:], "mkfs.fat")
+	ext, fsType := 36, "FAT16   "
+	if fat32 {
+		binary.LittleEndian.PutUint32(bs[36:], uint32(im.fatSectors))
+		binary.LittleEndian.PutUint32(bs[44:], 2)
+		binary.LittleEndian.PutUint16(bs[48:], 1)
+		binary.LittleEndian.PutUint16(bs[50:], 6)
+		ext, fsType = 64, "FAT32   "
+	} else {
+		binary.LittleEndian.PutUint16(bs[22:], uint16(im.fatSectors))
+	}
+	bs[ext], bs[ext+2] = 0x80, 0x29
+	binary.LittleEndian.PutUint32(bs[ext+3:], volumeID)
+	copy(bs[ext+7:], "BOOT       ")
+	copy(bs[ext+18:], fsType)
+	code := ext + 26
+	copy(bs, []byte{0xeb, byte(code - 2), 0x90})
+	copy(bs[code:], bootCode)
+	bs[code+3] = byte(code + len(bootCode))
+	copy(bs[code+len(bootCode):], bootMessage)
+	bs[510], bs[511] = 0x55, 0xaa
+
+	root := &dir{im: im}
+	if fat32 {
+		root.clusters = []uint32{im.alloc()}
+	}
+	root.add(entry("BOOT       ", 0x08, 0, 0, 0))
+	return im, root
+}
+
+// finish writes the FATs, and for FAT32 the FSInfo and backup boot sectors.
+func (im *image) finish() {
+	free := 0
+	for c := 2; c < len(im.fat); c++ {
+		if im.fat[c] == 0 {
+			free++
+		}
+	}
+	for i := 0; i < 2; i++ {
+		start := (im.reserved + i*im.fatSectors) * sectorSize
+		for c, v := range im.fat {
+			if im.fat32 {
+				binary.LittleEndian.PutUint32(im.data[start+c*4:], v&0x0fffffff)
+			} else {
+				binary.LittleEndian.PutUint16(im.data[start+c*2:], uint16(v))
+			}
+		}
+	}
+	if !im.fat32 {
+		return
+	}
+	info := im.data[sectorSize : 2*sectorSize]
+	binary.LittleEndian.PutUint32(info[0:], 0x41615252)
+	binary.LittleEndian.PutUint32(info[484:], 0x61417272)
+	binary.LittleEndian.PutUint32(info[488:], uint32(free))
+	binary.LittleEndian.PutUint32(info[492:], im.next)
+	binary.LittleEndian.PutUint32(info[508:], 0xaa550000)
+	im.data[3*sectorSize-2], im.data[3*sectorSize-1] = 0x55, 0xaa
+	copy(im.data[6*sectorSize:], im.data[:3*sectorSize])
+}
+
+func main() {
+	for _, fat32 := range []bool{false, true} {
+		im, root := newImage(fat32)
+		// mtools keeps 8.3 names in lower case with the case flags.
+		root.file("config.txt", "CONFIG  TXT", 0x18, []byte("dtparam=audio=on\n"), false)
+		root.file("cmdline.txt", "CMDLINE TXT", 0x18, []byte("console=serial0,115200 root=/dev/mmcblk0p2\n"), false)
+		// A deleted file leaves its entry and a hole in the FAT.
+		root.file("Deleted File.txt", "DELETE~1TXT", 0, []byte("gone\n"), false)
+		overlays := root.mkdir("overlays", "OVERLAYS   ")
+		overlays.file("Long Overlay Name.dtbo", "LONGOV~1DTB", 0, bytes.Repeat([]byte("dtoverlay\n"), 300), true)
+		for i := 1; i <= 40; i++ {
+			short := fmt.Sprintf("OVERLA~%dDTB", i)
+			if i >= 10 {
+				short = fmt.Sprintf("OVERL~%dDTB", i)
+			}
+			overlays.file(fmt.Sprintf("overlay-%02d-with-a-long-name.dtbo", i), short, 0, []byte(fmt.Sprintf("%d\n", i)), false)
+		}
+		root.file("empty", "EMPTY      ", 0x08, nil, false)
+
+		// Delete the deleted file, as mdel would.
+		for i := 0; i+32 <= len(root.entries); i += 32 {
+			e := root.entries[i:]
+			if e[11] == 0x0f && e[13] == shortSum("DELETE~1TXT") || string(e[:11]) == "DELETE~1TXT" {
+				if string(e[:11]) == "DELETE~1TXT" {
+					im.fat[binary.LittleEndian.Uint16(e[26:])] = 0
+				}
+				e[0] = 0xe5
+			}
+		}
+		root.flush()
+		overlays.flush()
+		im.finish()
+
+		var b bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+		w.Write(im.data)
+		w.Close()
+		name := "fat16.img.gz"
+		if fat32 {
+			name = "fat32.img.gz"
+		}
+		if err := ioutil.WriteFile(name, b.Bytes(), 0644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Variable types.
+const (
+	VarString   = "string"
+	VarInt      = "int"
+	VarBool     = "bool"
+	VarIP       = "ip"
+	VarCIDR     = "cidr"
+	VarHostname = "hostname"
+	// VarList is a list of values separated by commas or spaces. A Pattern
+	// applies to each of them.
+	VarList = "list"
+)
+
+// Variable describes a variable expected by a recipe.
+type Variable struct {
+	Name string `json:"name"`
+	// Type is one of the Var types. Defaults to VarString.
+	Type string `json:"type,omitempty"`
+	// Pattern, if set, is a regular expression which the whole value must
+	// match.
+	Pattern string `json:"pattern,omitempty"`
+	// Default is used when no value is given. Variables without one are
+	// required.
+	Default *string `json:"default,omitempty"`
+	// Description tells the user what the variable is for.
+	Description string `json:"description,omitempty"`
+	// Secret variables' values are never shown.
+	Secret bool `json:"secret,omitempty"`
+	// Generate, if set, is how a value is generated when none is given:
+	// random_password(N), hex(N) or uuid. Generated variables are secret.
+	Generate string `json:"generate,omitempty"`
+}
+
+// IsSecret returns true if v's values must never be shown.
+func (v *Variable) IsSecret() bool {
+	return v.Secret || v.Generate != ""
+}
+
+// hostnameLabel is a single label of an RFC 1123 hostname.
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// check returns an error if v's type or pattern is invalid, whatever the
+// value.
+func (v *Variable) check() error {
+	switch v.Type {
+	case "", VarString, VarInt, VarBool, VarIP, VarCIDR, VarHostname, VarList:
+	default:
+		return fmt.Errorf("unknown type %q", v.Type)
+	}
+	if v.Pattern != "" {
+		if _, err := regexp.Compile(v.Pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", v.Pattern, err)
+		}
+	}
+	if v.Generate != "" {
+		if _, _, err := parseGenerator(v.Generate); err != nil {
+			return err
+		}
+		if v.Default != nil {
+			return fmt.Errorf("has both a default and a generator")
+		}
+	}
+	return nil
+}
+
+// Validate returns an error describing why value isn't valid for v.
+func (v *Variable) Validate(value string) error {
+	var pattern *regexp.Regexp
+	if v.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile("^(?:" + v.Pattern + ")$"); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", v.Pattern, err)
+		}
+	}
+	values := []string{value}
+	if v.Type == VarList {
+		values = listValues(value)
+		if len(values) == 0 {
+			return fmt.Errorf("wanted at least one value")
+		}
+	}
+	for _, value := range values {
+		if err := v.validateType(value); err != nil {
+			return err
+		}
+		if pattern != nil && !pattern.MatchString(value) {
+			return fmt.Errorf("%v doesn't match %q", v.describe(value), v.Pattern)
+		}
+	}
+	return nil
+}
+
+// listValues splits the value of a list variable.
+func listValues(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+func (v *Variable) validateType(value string) error {
+	switch v.Type {
+	case "", VarString, VarList:
+	case VarInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%v is not an integer", v.describe(value))
+		}
+	case VarBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%v is not true or false", v.describe(value))
+		}
+	case VarIP:
+		if net.ParseIP(value) == nil {
+			return fmt.Errorf("%v is not an IP address", v.describe(value))
+		}
+	case VarCIDR:
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			return fmt.Errorf("%v is not an address with a prefix length, eg 192.168.1.5/24", v.describe(value))
+		}
+	case VarHostname:
+		if len(value) == 0 || len(value) > 253 {
+			return fmt.Errorf("%v is not a hostname", v.describe(value))
+		}
+		for _, label := range strings.Split(value, ".") {
+			if !hostnameLabel.MatchString(label) {
+				return fmt.Errorf("%v is not a hostname", v.describe(value))
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q", v.Type)
+	}
+	return nil
+}
+
+// describe quotes value for an error message, unless it's a secret.
+func (v *Variable) describe(value string) string {
+	if v.IsSecret() {
+		return "value"
+	}
+	return strconv.Quote(value)
+}
+
+// VarSchema returns the variables expected by the recipe: those it declares,
+// followed by any others its ingredients use, which are strings, or lists if
+// an ingredient repeats for each of their values.
+func (r *Recipe) VarSchema() []*Variable {
+	vars := make([]*Variable, 0, len(r.Variables))
+	declared := make(map[string]bool)
+	for _, v := range r.Variables {
+		vars = append(vars, v)
+		declared[v.Name] = true
+	}
+	lists := make(map[string]bool)
+	for _, i := range r.Ingredients {
+		if i.Foreach != "" {
+			lists[i.Foreach] = true
+		}
+	}
+	for _, name := range r.vars() {
+		if !declared[name] {
+			v := &Variable{Name: name}
+			if lists[name] {
+				v.Type = VarList
+			}
+			vars = append(vars, v)
+		}
+	}
+	return vars
+}
+
+// MissingVars returns the variables which the recipe needs, but vars lacks,
+// leaving out those with defaults or generators, and those only needed by
+// ingredients which vars exclude by their When conditions.
+func (r *Recipe) MissingVars(vars map[string]string) ([]*Variable, error) {
+	d := &RecipeData{Vars: MergeVars(vars)}
+	schema := r.VarSchema()
+	for _, v := range schema {
+		if _, ok := d.Vars[v.Name]; !ok && v.Default != nil {
+			d.Vars[v.Name] = *v.Default
+		}
+	}
+	unneeded, err := r.unneededVars(d)
+	if err != nil {
+		return nil, err
+	}
+	var missing []*Variable
+	for _, v := range schema {
+		if _, ok := d.Vars[v.Name]; ok || v.Generate != "" || unneeded[v.Name] {
+			continue
+		}
+		missing = append(missing, v)
+	}
+	return missing, nil
+}
+
+// resolveVars returns a copy of d with defaults filled in, or an error listing
+// every missing or invalid variable. Variables needed only by ingredients
+// which are excluded by their When conditions may be missing.
+func (r *Recipe) resolveVars(d *RecipeData) (*RecipeData, error) {
+	resolved := &RecipeData{Vars: make(map[string]string)}
+	if d != nil {
+		*resolved = *d
+		resolved.Vars = MergeVars(d.Vars)
+	}
+	schema := r.VarSchema()
+	for _, v := range schema {
+		if _, ok := resolved.Vars[v.Name]; !ok && v.Default != nil {
+			resolved.Vars[v.Name] = *v.Default
+		}
+	}
+	unneeded, err := r.unneededVars(resolved)
+	if err != nil {
+		return nil, err
+	}
+	var missing, problems []string
+	for _, v := range schema {
+		value, ok := resolved.Vars[v.Name]
+		if !ok {
+			if !unneeded[v.Name] {
+				missing = append(missing, v.Name)
+			}
+			continue
+		}
+		if err := v.Validate(value); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", v.Name, err))
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		problems = append([]string{fmt.Sprintf("missing: %v", strings.Join(missing, ", "))}, problems...)
+	}
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("recipe %q has bad variables:\n\t%v", r.Name, strings.Join(problems, "\n\t"))
+	}
+	return resolved, nil
+}
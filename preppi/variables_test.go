@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVariableValidate(t *testing.T) {
+	for _, tc := range []struct {
+		v       *Variable
+		value   string
+		wantErr bool
+	}{
+		{&Variable{}, "anything", false},
+		{&Variable{Type: VarString, Pattern: "[a-z]+"}, "abc", false},
+		{&Variable{Type: VarString, Pattern: "[a-z]+"}, "abc1", true},
+		{&Variable{Type: VarString, Pattern: "[a-z"}, "abc", true},
+		{&Variable{Type: VarInt}, "42", false},
+		{&Variable{Type: VarInt}, "4.2", true},
+		{&Variable{Type: VarBool}, "true", false},
+		{&Variable{Type: VarBool}, "yes", true},
+		{&Variable{Type: VarIP}, "192.168.1.1", false},
+		{&Variable{Type: VarIP}, "fe80::1", false},
+		{&Variable{Type: VarIP}, "192.168.1", true},
+		{&Variable{Type: VarCIDR}, "192.168.1.5/24", false},
+		{&Variable{Type: VarCIDR}, "192.168.1.5", true},
+		{&Variable{Type: VarHostname}, "pi", false},
+		{&Variable{Type: VarHostname}, "pi-3.local", false},
+		{&Variable{Type: VarHostname}, "-pi", true},
+		{&Variable{Type: VarHostname}, "pi_3", true},
+		{&Variable{Type: VarHostname}, "pi..local", true},
+		{&Variable{Type: VarList}, "8.8.8.8 8.8.4.4", false},
+		{&Variable{Type: VarList}, " , ", true},
+		{&Variable{Type: VarList, Pattern: "[0-9.]+"}, "8.8.8.8,8.8.4.4", false},
+		{&Variable{Type: VarList, Pattern: "[0-9.]+"}, "8.8.8.8,dns.google", true},
+		{&Variable{Type: "float"}, "4.2", true},
+	} {
+		err := tc.v.Validate(tc.value)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%+v: %q: wanted error %v, got: %v", tc.v, tc.value, tc.wantErr, err)
+		}
+	}
+}
+
+func TestRecipeResolveVars(t *testing.T) {
+	local := "local"
+	r := &Recipe{
+		Name: "Test Recipe",
+		Ingredients: []*Ingredient{
+			&Ingredient{Vars: []string{"Hostname", "LocalDomain", "Undeclared"}},
+			&Ingredient{Vars: []string{"Eth0CIDR", "WPAPSK"}},
+		},
+		Variables: []*Variable{
+			&Variable{Name: "Hostname", Type: VarHostname},
+			&Variable{Name: "LocalDomain", Type: VarHostname, Default: &local},
+			&Variable{Name: "Eth0CIDR", Type: VarCIDR},
+			&Variable{Name: "WPAPSK", Pattern: ".{8,63}", Secret: true},
+		},
+	}
+
+	d := &RecipeData{Vars: map[string]string{"Eth0CIDR": "192.168.1.5", "WPAPSK": "short"}}
+	_, err := r.resolveVars(d)
+	if err == nil {
+		t.Fatal("wanted error for bad variables")
+	}
+	msg := err.Error()
+	for _, want := range []string{"missing: Hostname, Undeclared", "Eth0CIDR:", "WPAPSK:"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("wanted error to mention %q, got: %v", want, msg)
+		}
+	}
+	if strings.Contains(msg, "short") {
+		t.Errorf("wanted secret value kept out of error, got: %v", msg)
+	}
+
+	d = &RecipeData{Vars: map[string]string{
+		"Hostname":   "pi",
+		"Undeclared": "",
+		"Eth0CIDR":   "192.168.1.5/24",
+		"WPAPSK":     "long enough",
+	}}
+	got, err := r.resolveVars(d)
+	if err != nil {
+		t.Fatalf("wanted no error, got: %v", err)
+	}
+	want := map[string]string{
+		"Hostname":    "pi",
+		"LocalDomain": "local",
+		"Undeclared":  "",
+		"Eth0CIDR":    "192.168.1.5/24",
+		"WPAPSK":      "long enough",
+	}
+	if !reflect.DeepEqual(got.Vars, want) {
+		t.Errorf("wanted %v, got %v", want, got.Vars)
+	}
+	if _, ok := d.Vars["LocalDomain"]; ok {
+		t.Error("wanted caller's vars left alone")
+	}
+}
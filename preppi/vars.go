@@ -0,0 +1,276 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// VarsFromFile reads variables from a file, whose format is chosen by its
+// extension:
+//
+//   - .yaml or .yml: a flat mapping of names to scalar values.
+//   - .env: NAME=value lines, as understood by most dotenv tools.
+//   - anything else: a JSON object of names to string, number or boolean
+//     values.
+func VarsFromFile(name string) (map[string]string, error) {
+	data, err := readSource(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading vars %q: %v", name, err)
+	}
+	var vars map[string]string
+	switch path.Ext(name) {
+	case ".yaml", ".yml":
+		vars, err = parseYAMLVars(data)
+	case ".env":
+		vars, err = parseEnvVars(data)
+	default:
+		vars, err = parseJSONVars(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading vars %q: %v", name, err)
+	}
+	return vars, nil
+}
+
+// parseJSONVars parses a JSON object of names to scalars. Numbers and booleans
+// are kept as written, and null is empty, as in YAML.
+func parseJSONVars(data []byte) (map[string]string, error) {
+	var values map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&values); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the object")
+	}
+	vars := make(map[string]string)
+	for name, value := range values {
+		switch v := value.(type) {
+		case nil:
+			vars[name] = ""
+		case string, json.Number, bool:
+			vars[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%q: only string, number and boolean values are supported", name)
+		}
+	}
+	return vars, nil
+}
+
+// parseYAMLVars parses the subset of YAML needed for vars: a single flat
+// mapping of names to plain, single or double quoted scalars, with comments.
+func parseYAMLVars(data []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := s.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: only a flat mapping of names to values is supported", n)
+		}
+		name, value, err := yamlPair(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		vars[name] = value
+	}
+	return vars, s.Err()
+}
+
+// yamlPair parses a name: value line of a YAML mapping.
+func yamlPair(line string) (string, string, error) {
+	i := strings.Index(line, ":")
+	if i < 1 {
+		return "", "", fmt.Errorf("expected name: value")
+	}
+	value, err := yamlScalar(strings.TrimSpace(line[i+1:]))
+	if err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(line[:i]), value, nil
+}
+
+// yamlScalar returns the value of a YAML scalar, stripping any comment.
+func yamlScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := closingQuote(v)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		end := strings.Index(strings.Replace(v[1:], "''", "  ", -1), "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string %s", v)
+		}
+		return strings.Replace(v[1:end+1], "''", "'", -1), nil
+	case strings.HasPrefix(v, "[") || strings.HasPrefix(v, "{") ||
+		strings.HasPrefix(v, "|") || strings.HasPrefix(v, ">"):
+		return "", fmt.Errorf("only scalar values are supported, got %s", v)
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		v = strings.TrimSpace(v[:i])
+	}
+	if v == "~" || v == "null" {
+		return "", nil
+	}
+	return v, nil
+}
+
+// closingQuote returns the index of the double quote closing the string
+// opening v, or -1.
+func closingQuote(v string) int {
+	for i := 1; i < len(v); i++ {
+		switch v[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// parseEnvVars parses NAME=value lines. Values may be single quoted, taken
+// literally, or double quoted, with escapes. Lines may start with export.
+func parseEnvVars(data []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: expected NAME=value", n)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch {
+		case strings.HasPrefix(value, `"`):
+			end := closingQuote(value)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", n)
+			}
+			v, err := strconv.Unquote(value[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			value = v
+		case strings.HasPrefix(value, "'"):
+			end := strings.Index(value[1:], "'")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", n)
+			}
+			value = value[1 : end+1]
+		default:
+			if i := strings.Index(value, " #"); i >= 0 {
+				value = strings.TrimSpace(value[:i])
+			}
+		}
+		vars[name] = value
+	}
+	return vars, s.Err()
+}
+
+// VarsFromEnv returns the variables in environ, as from os.Environ, whose
+// names start with prefix. The prefix is stripped from their names.
+func VarsFromEnv(prefix string, environ []string) map[string]string {
+	vars := make(map[string]string)
+	for _, kv := range environ {
+		s := strings.SplitN(kv, "=", 2)
+		if len(s) != 2 || !strings.HasPrefix(s[0], prefix) || s[0] == prefix {
+			continue
+		}
+		vars[strings.TrimPrefix(s[0], prefix)] = s[1]
+	}
+	return vars
+}
+
+// VarsFromArgs parses name=value arguments, splitting each at its first =. A
+// value of @- is read from stdin, and one of @path from the named file, so
+// that secrets needn't be typed on the command line. A single trailing
+// newline is removed from values read either way. @@ escapes a value which
+// really starts with @.
+func VarsFromArgs(args []string, stdin io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	usedStdin := false
+	for _, kv := range args {
+		s := strings.SplitN(kv, "=", 2)
+		if len(s) != 2 || s[0] == "" {
+			return nil, fmt.Errorf("invalid variable %q, wanted name=value", kv)
+		}
+		name, value := s[0], s[1]
+		switch {
+		case strings.HasPrefix(value, "@@"):
+			value = value[1:]
+		case value == "@-":
+			if usedStdin {
+				return nil, fmt.Errorf("variable %q can't also be read from stdin", name)
+			}
+			usedStdin = true
+			b, err := ioutil.ReadAll(stdin)
+			if err != nil {
+				return nil, fmt.Errorf("failed reading variable %q from stdin: %v", name, err)
+			}
+			value = trimNewline(string(b))
+		case strings.HasPrefix(value, "@"):
+			b, err := readSource(value[1:])
+			if err != nil {
+				return nil, fmt.Errorf("failed reading variable %q: %v", name, err)
+			}
+			value = trimNewline(string(b))
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+func trimNewline(s string) string {
+	s = strings.TrimSuffix(s, "\n")
+	return strings.TrimSuffix(s, "\r")
+}
+
+// MergeVars merges sets of variables, later sets taking precedence.
+func MergeVars(sets ...map[string]string) map[string]string {
+	vars := make(map[string]string)
+	for _, set := range sets {
+		for k, v := range set {
+			vars[k] = v
+		}
+	}
+	return vars
+}
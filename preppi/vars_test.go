@@ -0,0 +1,167 @@
+// Copyright (c) 2017 Christian Funkhouser <christian.funkhouser@gmail.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package preppi
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVarsFromFile(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+
+	want := map[string]string{
+		"Hostname":   "pi",
+		"PSK":        "c2VjcmV0=",
+		"SSID":       "My Network # 2",
+		"Quoted":     "it's",
+		"Empty":      "",
+		"Commented":  "value",
+		"WithEquals": "a=b=c",
+		"Port":       "22",
+		"Enabled":    "true",
+	}
+	files := map[string]*testFile{
+		"/vars.json": &testFile{[]byte(`{
+			"Hostname": "pi",
+			"PSK": "c2VjcmV0=",
+			"SSID": "My Network # 2",
+			"Quoted": "it's",
+			"Empty": "",
+			"Commented": "value",
+			"WithEquals": "a=b=c",
+			"Port": 22,
+			"Enabled": true
+		}`), 0644, 0755, 0, 0},
+		"/vars.yaml": &testFile{[]byte(`---
+# Variables for the living room pi.
+Hostname: pi
+PSK: c2VjcmV0=
+SSID: "My Network # 2"
+Quoted: 'it''s'
+Empty: ~
+Commented: value # not this
+WithEquals: a=b=c
+Port: 22
+Enabled: true
+`), 0644, 0755, 0, 0},
+		"/vars.env": &testFile{[]byte(`# Variables for the living room pi.
+Hostname=pi
+export PSK=c2VjcmV0=
+SSID="My Network # 2"
+Quoted="it's"
+Empty=
+Commented=value # not this
+WithEquals='a=b=c'
+Port=22
+Enabled=true
+`), 0644, 0755, 0, 0},
+		"/nested.yaml": &testFile{[]byte("wifi:\n  ssid: home\n"), 0644, 0755, 0, 0},
+		"/list.yml":    &testFile{[]byte("hosts: [a, b]\n"), 0644, 0755, 0, 0},
+		"/bad.env":     &testFile{[]byte("just some words\n"), 0644, 0755, 0, 0},
+		"/nested.json": &testFile{[]byte(`{"wifi": {"ssid": "home"}}`), 0644, 0755, 0, 0},
+		"/list.json":   &testFile{[]byte(`{"hosts": ["a", "b"]}`), 0644, 0755, 0, 0},
+		"/extra.json":  &testFile{[]byte(`{"Hostname": "pi"} {}`), 0644, 0755, 0, 0},
+	}
+	setUpFilesystemForTest(t, preppiFS, files)
+
+	for _, name := range []string{"/vars.json", "/vars.yaml", "/vars.env"} {
+		got, err := VarsFromFile(name)
+		if err != nil {
+			t.Errorf("%v: wanted no error, got: %v", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: wanted %v, got %v", name, want, got)
+		}
+	}
+	for _, name := range []string{"/nested.yaml", "/list.yml", "/bad.env", "/nested.json", "/list.json", "/extra.json", "/missing.json"} {
+		if _, err := VarsFromFile(name); err == nil {
+			t.Errorf("%v: wanted error", name)
+		}
+	}
+}
+
+func TestVarsFromEnv(t *testing.T) {
+	environ := []string{"PREPPI_Hostname=pi", "PREPPI_PSK=a=b", "PREPPI_=nameless", "HOME=/root"}
+	want := map[string]string{"Hostname": "pi", "PSK": "a=b"}
+	if got := VarsFromEnv("PREPPI_", environ); !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+}
+
+func TestVarsFromArgs(t *testing.T) {
+	origPreppiFS := preppiFS
+	defer func() { preppiFS = origPreppiFS }()
+	preppiFS = NewMemMapFs()
+	setUpFilesystemForTest(t, preppiFS, map[string]*testFile{
+		"/secret": &testFile{[]byte("from a file\n"), 0644, 0755, 0, 0},
+	})
+
+	for _, tc := range []struct {
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			args: []string{"Hostname=pi", "PSK=c2VjcmV0==", "Empty="},
+			want: map[string]string{"Hostname": "pi", "PSK": "c2VjcmV0==", "Empty": ""},
+		},
+		{
+			args: []string{"File=@/secret", "Stdin=@-", "At=@@home"},
+			want: map[string]string{"File": "from a file", "Stdin": "from stdin", "At": "@home"},
+		},
+		{args: []string{"Hostname"}, wantErr: true},
+		{args: []string{"=pi"}, wantErr: true},
+		{args: []string{"File=@/missing"}, wantErr: true},
+		{args: []string{"One=@-", "Two=@-"}, wantErr: true},
+	} {
+		got, err := VarsFromArgs(tc.args, strings.NewReader("from stdin\n"))
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("%v: wanted error", tc.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: wanted no error, got: %v", tc.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%v: wanted %v, got %v", tc.args, tc.want, got)
+		}
+	}
+}
+
+func TestMergeVars(t *testing.T) {
+	got := MergeVars(
+		map[string]string{"A": "file", "B": "file", "C": "file"},
+		map[string]string{"B": "env", "C": "env"},
+		map[string]string{"C": "arg"},
+	)
+	want := map[string]string{"A": "file", "B": "env", "C": "arg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+}